@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	consulApi "github.com/hashicorp/consul/api"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -16,14 +21,20 @@ import (
 	katalogsync "github.com/wish/katalog-sync/proto"
 )
 
-// TODO: consul flags
 var opts struct {
-	LogLevel        string `long:"log-level" env:"LOG_LEVEL" description:"Log level" default:"info"`
-	BindAddr        string `long:"bind-address" env:"BIND_ADDRESS" description:"address for binding RPC interface for sidecar"`
-	MetricsBindAddr string `long:"metrics-bind-address" env:"METRICS_BIND_ADDRESS" description:"address for binding metrics interface"`
-	PProfBindAddr   string `long:"pprof-bind-address" env:"PPROF_BIND_ADDRESS" description:"address for binding pprof"`
+	LogLevel        string        `long:"log-level" env:"LOG_LEVEL" description:"Log level" default:"info"`
+	BindAddr        string        `long:"bind-address" env:"BIND_ADDRESS" description:"address for binding RPC interface for sidecar"`
+	MetricsBindAddr string        `long:"metrics-bind-address" env:"METRICS_BIND_ADDRESS" description:"address for binding metrics interface"`
+	PProfBindAddr   string        `long:"pprof-bind-address" env:"PPROF_BIND_ADDRESS" description:"address for binding pprof"`
+	StartTimeout    time.Duration `long:"start-timeout" env:"START_TIMEOUT" description:"how long to wait for the initial sync on startup before retrying it in the background" default:"30s"`
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" description:"how long to wait for the shutdown policy to apply on exit" default:"4s"`
+	PodSource       string        `long:"pod-source" env:"POD_SOURCE" description:"where to get the pods of the node from: kubelet, apiserver or file:///path/to/pods" default:"kubelet"`
 	daemon.DaemonConfig
 	daemon.KubeletClientConfig
+	daemon.InformerClientConfig
+	daemon.FileClientConfig
+	daemon.EventReporterConfig
+	daemon.ConsulClientConfig
 }
 
 func main() {
@@ -48,20 +59,6 @@ func main() {
 		}()
 	}
 
-	if opts.MetricsBindAddr != "" {
-		l, err := net.Listen("tcp", opts.MetricsBindAddr)
-		if err != nil {
-			logrus.Fatalf("Error binding: %v", err)
-		}
-
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", promhttp.Handler())
-
-		go func() {
-			http.Serve(l, mux)
-		}()
-	}
-
 	// Use log level
 	level, err := logrus.ParseLevel(opts.LogLevel)
 	if err != nil {
@@ -75,22 +72,93 @@ func main() {
 	}
 	logrus.SetFormatter(formatter)
 
-	kubeletClient, err := daemon.NewKubeletClient(opts.KubeletClientConfig)
-	if err != nil {
-		logrus.Fatalf("Unable to create kubelet client: %v", err)
+	// Everything talking to the apiserver shares one client; outside of a
+	// cluster there is none
+	clientset, clientsetErr := daemon.NewInClusterClientset()
+
+	var podSource daemon.Kubelet
+	switch {
+	case strings.HasPrefix(opts.PodSource, daemon.FilePodSourcePrefix):
+		fileClient, err := daemon.NewFileClient(strings.TrimPrefix(opts.PodSource, daemon.FilePodSourcePrefix), opts.FileClientConfig)
+		if err != nil {
+			logrus.Fatalf("Unable to create file pod source: %v", err)
+		}
+		fileStopCh := make(chan struct{})
+		defer close(fileStopCh)
+		fileClient.Start(fileStopCh)
+		podSource = fileClient
+	case opts.PodSource == "apiserver":
+		if clientsetErr != nil {
+			logrus.Fatalf("Unable to create apiserver client: %v", clientsetErr)
+		}
+		informerClient, err := daemon.NewInformerClient(clientset, opts.InformerClientConfig)
+		if err != nil {
+			logrus.Fatalf("Unable to create apiserver pod informer: %v", err)
+		}
+		informerStopCh := make(chan struct{})
+		defer close(informerStopCh)
+		if err := informerClient.Start(informerStopCh); err != nil {
+			logrus.Fatalf("Unable to start apiserver pod informer: %v", err)
+		}
+		podSource = informerClient
+	case opts.PodSource == "kubelet":
+		kubeletClient, err := daemon.NewKubeletClient(opts.KubeletClientConfig)
+		if err != nil {
+			logrus.Fatalf("Unable to create kubelet client: %v", err)
+		}
+		podSource = kubeletClient
+	default:
+		logrus.Fatalf("Unknown pod source: %s", opts.PodSource)
 	}
 
-	// Consul testing
-	consulCfg := consulApi.DefaultConfig()
-	client, err := consulApi.NewClient(consulCfg)
+	client, err := daemon.NewConsulClient(opts.ConsulClientConfig)
 	if err != nil {
-		panic(err)
+		logrus.Fatalf("Unable to create consul client: %v", err)
 	}
 
-	d := daemon.NewDaemon(opts.DaemonConfig, kubeletClient, client)
+	d := daemon.NewDaemon(opts.DaemonConfig, podSource, client.Agent(), client.Catalog())
+	if clientsetErr != nil {
+		logrus.Warnf("Unable to create apiserver client, readiness gates can't be set: %v", clientsetErr)
+	} else {
+		d.SetK8sClientset(clientset)
+	}
+	if opts.EventReporterConfig.Enabled() {
+		if clientsetErr != nil {
+			logrus.Fatalf("Unable to create event reporter: %v", clientsetErr)
+		}
+		reporter := daemon.NewEventReporter(clientset, opts.EventReporterConfig, opts.AnnotationPrefix, opts.LegacyAnnotations)
+		defer reporter.Stop()
+		d.SetConfigReporter(reporter)
+	}
+
+	if opts.MetricsBindAddr != "" {
+		l, err := net.Listen("tcp", opts.MetricsBindAddr)
+		if err != nil {
+			logrus.Fatalf("Error binding: %v", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/plan", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(d.LastPlan())
+		})
 
+		go func() {
+			http.Serve(l, mux)
+		}()
+	}
+
+	// Do the initial sync before we start serving requests from sidecars
+	startCtx, startCancel := context.WithTimeout(context.Background(), opts.StartTimeout)
+	defer startCancel()
+	if err := d.Start(startCtx); err != nil {
+		logrus.Fatalf("Unable to start daemon: %v", err)
+	}
+
+	var s *grpc.Server
 	if opts.BindAddr != "" {
-		s := grpc.NewServer()
+		s = grpc.NewServer()
 		katalogsync.RegisterKatalogSyncServer(s, d)
 		l, err := net.Listen("tcp", opts.BindAddr)
 		if err != nil {
@@ -101,6 +169,19 @@ func main() {
 		}()
 	}
 
-	// TODO: change to background, and wait on signals to die
-	d.Run()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	logrus.Infof("Got signal %v, stopping with shutdown policy %s", sig, opts.ShutdownPolicy)
+
+	// Stop any in-flight sidecar requests; the sidecars will retry against the next daemon
+	if s != nil {
+		s.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+	if err := d.Stop(ctx); err != nil {
+		logrus.Errorf("Error stopping daemon: %v", err)
+	}
 }
@@ -83,6 +83,31 @@ func main() {
 
 	client := katalogsync.NewKatalogSyncClient(conn)
 
+	// Allow the pod to put its services into maintenance mode; POST/PUT enables
+	// it and DELETE disables it, optionally for a single service
+	http.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		q := &katalogsync.SetMaintenanceQuery{
+			Namespace:   opts.Namespace,
+			PodName:     opts.PodName,
+			ServiceName: r.URL.Query().Get("service"),
+			Reason:      r.URL.Query().Get("reason"),
+		}
+		switch r.Method {
+		case http.MethodPost, http.MethodPut:
+			q.Enable = true
+		case http.MethodDelete:
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if _, err := client.SetMaintenance(r.Context(), q); err != nil {
+			logrus.Errorf("error setting maintenance with katalog-sync-daemon: %v %v", grpc.Code(err), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logrus.Infof("maintenance enable=%v service=%q reason=%q", q.Enable, q.ServiceName, q.Reason)
+	})
+
 	// Connect to sidecar and send register request
 	// We want to retry until we are successful
 	for {
@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Service address sources; anything else is used as a literal address
+const (
+	AddressSourcePodIP  = "podIP"  // the pod's primary IP
+	AddressSourceHostIP = "hostIP" // the IP of the node the pod runs on
+	AddressSourceIPv4   = "ipv4"   // the pod's IPv4 address
+	AddressSourceIPv6   = "ipv6"   // the pod's IPv6 address
+)
+
+// Tagged address names consul uses
+const (
+	taggedAddressLANIPv4 = "lan_ipv4"
+	taggedAddressLANIPv6 = "lan_ipv6"
+	taggedAddressWAN     = "wan"
+)
+
+// validateAddressSource checks that source is one of the address sources or a
+// literal IP or hostname
+func validateAddressSource(source string) error {
+	switch source {
+	case "", AddressSourcePodIP, AddressSourceHostIP, AddressSourceIPv4, AddressSourceIPv6:
+		return nil
+	}
+	if net.ParseIP(source) != nil {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(source); len(errs) > 0 {
+		return fmt.Errorf("Invalid service address %q: must be one of %s, %s, %s, %s or an IP or hostname", source, AddressSourcePodIP, AddressSourceHostIP, AddressSourceIPv4, AddressSourceIPv6)
+	}
+	return nil
+}
+
+// validateAddresses checks the address annotations of all services of the pod
+func (p *Pod) validateAddresses() error {
+	if err := validateAddressSource(p.AddressSource); err != nil {
+		return err
+	}
+	for _, serviceName := range p.GetServiceNames() {
+		if source, ok := p.serviceAnnotation(ConsulServiceAddress, ConsulServiceAddressOverride, serviceName); ok {
+			if err := validateAddressSource(source); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// podIPs returns the pod's IPv4 and IPv6 address, if it has one of the family
+func (p *Pod) podIPs() (ipv4, ipv6 string) {
+	ips := []string{p.Status.PodIP}
+	for _, podIP := range p.Status.PodIPs {
+		ips = append(ips, podIP.IP)
+	}
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			if ipv4 == "" {
+				ipv4 = ipStr
+			}
+		default:
+			if ipv6 == "" {
+				ipv6 = ipStr
+			}
+		}
+	}
+	return ipv4, ipv6
+}
+
+// getAddressSource returns the address source for the given service
+func (p *Pod) getAddressSource(n string) string {
+	if spec := p.serviceSpec(n); spec != nil && spec.AddressMode != "" {
+		return spec.AddressMode
+	}
+	if source, ok := p.serviceAnnotation(ConsulServiceAddress, ConsulServiceAddressOverride, n); ok {
+		return source
+	}
+	if p.AddressSource != "" {
+		return p.AddressSource
+	}
+	return AddressSourcePodIP
+}
+
+// GetServiceAddress returns the address to register the given service with. If
+// the pod has no address of the requested family its primary IP is used.
+func (p *Pod) GetServiceAddress(n string) string {
+	switch source := p.getAddressSource(n); source {
+	case AddressSourcePodIP:
+		return p.Status.PodIP
+	case AddressSourceHostIP:
+		return p.Status.HostIP
+	case AddressSourceIPv4, AddressSourceIPv6:
+		ipv4, ipv6 := p.podIPs()
+		if source == AddressSourceIPv4 && ipv4 != "" {
+			return ipv4
+		}
+		if source == AddressSourceIPv6 && ipv6 != "" {
+			return ipv6
+		}
+		return p.Status.PodIP
+	default:
+		return source
+	}
+}
+
+// GetTaggedAddresses returns the tagged addresses to register the given service
+// with on the given port: the pod's IPv4 and IPv6 addresses as lan_ipv4 and
+// lan_ipv6, and the host IP as wan if the service is reachable on it.
+func (p *Pod) GetTaggedAddresses(n string, port int) map[string]consulApi.ServiceAddress {
+	addresses := make(map[string]consulApi.ServiceAddress)
+	ipv4, ipv6 := p.podIPs()
+	if ipv4 != "" {
+		addresses[taggedAddressLANIPv4] = consulApi.ServiceAddress{Address: ipv4, Port: port}
+	}
+	if ipv6 != "" {
+		addresses[taggedAddressLANIPv6] = consulApi.ServiceAddress{Address: ipv6, Port: port}
+	}
+	if p.Status.HostIP != "" && (p.Spec.HostNetwork || p.getAddressSource(n) == AddressSourceHostIP) {
+		addresses[taggedAddressWAN] = consulApi.ServiceAddress{Address: p.Status.HostIP, Port: port}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	return addresses
+}
+
+// taggedAddressesChanged returns whether any of the tagged addresses we set
+// differ from the registered ones. Other tagged addresses are ignored, as the
+// agent may add some of its own.
+func taggedAddressesChanged(registered, expected map[string]consulApi.ServiceAddress) bool {
+	for name, address := range expected {
+		if r, ok := registered[name]; !ok || r != address {
+			return true
+		}
+	}
+	return false
+}
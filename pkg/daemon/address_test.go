@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+	k8sApi "k8s.io/api/core/v1"
+)
+
+func TestServiceAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		defaultAddr string
+		hostNetwork bool
+		singleStack bool
+		err         bool
+		address     string
+		tagged      map[string]consulApi.ServiceAddress
+	}{
+		{
+			name:    "default",
+			address: "10.1.1.140",
+			tagged: map[string]consulApi.ServiceAddress{
+				"lan_ipv4": {Address: "10.1.1.140", Port: 8080},
+				"lan_ipv6": {Address: "fd00::8c", Port: 8080},
+			},
+		},
+		{
+			name:        "daemon default",
+			defaultAddr: AddressSourceIPv6,
+			address:     "fd00::8c",
+			tagged: map[string]consulApi.ServiceAddress{
+				"lan_ipv4": {Address: "10.1.1.140", Port: 8080},
+				"lan_ipv6": {Address: "fd00::8c", Port: 8080},
+			},
+		},
+		{
+			name:        "annotation overrides daemon default",
+			annotations: map[string]string{ConsulServiceAddress: AddressSourceHostIP},
+			defaultAddr: AddressSourceIPv6,
+			address:     "192.168.1.10",
+			tagged: map[string]consulApi.ServiceAddress{
+				"lan_ipv4": {Address: "10.1.1.140", Port: 8080},
+				"lan_ipv6": {Address: "fd00::8c", Port: 8080},
+				"wan":      {Address: "192.168.1.10", Port: 8080},
+			},
+		},
+		{
+			name: "service override",
+			annotations: map[string]string{
+				ConsulServiceAddress:                             AddressSourceHostIP,
+				ConsulServiceAddressOverride + "hw-service-name": "svc.example.com",
+			},
+			address: "svc.example.com",
+			tagged: map[string]consulApi.ServiceAddress{
+				"lan_ipv4": {Address: "10.1.1.140", Port: 8080},
+				"lan_ipv6": {Address: "fd00::8c", Port: 8080},
+			},
+		},
+		{
+			name:        "host network",
+			hostNetwork: true,
+			address:     "10.1.1.140",
+			tagged: map[string]consulApi.ServiceAddress{
+				"lan_ipv4": {Address: "10.1.1.140", Port: 8080},
+				"lan_ipv6": {Address: "fd00::8c", Port: 8080},
+				"wan":      {Address: "192.168.1.10", Port: 8080},
+			},
+		},
+		{
+			name:        "missing family falls back to pod IP",
+			annotations: map[string]string{ConsulServiceAddress: AddressSourceIPv6},
+			singleStack: true,
+			address:     "10.1.1.140",
+			tagged: map[string]consulApi.ServiceAddress{
+				"lan_ipv4": {Address: "10.1.1.140", Port: 8080},
+			},
+		},
+		{
+			name:        "invalid annotation",
+			annotations: map[string]string{ConsulServiceAddress: "not an address!"},
+			err:         true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k8sPod := loadTestPod(t, "basic/working")
+			for k, v := range test.annotations {
+				k8sPod.ObjectMeta.Annotations[k] = v
+			}
+			k8sPod.Spec.HostNetwork = test.hostNetwork
+			k8sPod.Status.HostIP = "192.168.1.10"
+			k8sPod.Status.PodIPs = []k8sApi.PodIP{{IP: "10.1.1.140"}}
+			if !test.singleStack {
+				k8sPod.Status.PodIPs = append(k8sPod.Status.PodIPs, k8sApi.PodIP{IP: "fd00::8c"})
+			}
+
+			pod, err := NewPod(k8sPod, &DaemonConfig{DefaultServiceAddress: test.defaultAddr})
+			if (err != nil) != test.err {
+				t.Fatalf("expected error=%v, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			r := pod.Registration("hw-service-name", consulApi.HealthPassing, "")
+			if r.Address != test.address {
+				t.Fatalf("expected address %s, got %s", test.address, r.Address)
+			}
+			if !reflect.DeepEqual(r.TaggedAddresses, test.tagged) {
+				t.Fatalf("expected tagged addresses %v, got %v", test.tagged, r.TaggedAddresses)
+			}
+
+			// A service registered as defined has no changes, switching modes does
+			c := consultest.New("node")
+			if err := c.Agent().ServiceRegister(r); err != nil {
+				t.Fatalf("error registering service: %v", err)
+			}
+			service := c.AgentServices()[r.ID]
+			if pod.HasChange(service) {
+				t.Fatalf("unchanged service has change")
+			}
+			pod.Pod.ObjectMeta.Annotations[ConsulServiceAddress] = "10.0.0.1"
+			delete(pod.Pod.ObjectMeta.Annotations, ConsulServiceAddressOverride+"hw-service-name")
+			if !pod.HasChange(service) {
+				t.Fatalf("change of address not detected")
+			}
+		})
+	}
+}
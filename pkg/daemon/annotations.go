@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultAnnotationPrefix is the prefix the annotation names (and readiness
+// gate and condition types) are defined with; they are looked up under the
+// configured prefix instead
+const DefaultAnnotationPrefix = "katalog-sync.wish.com/"
+
+// validateAnnotationPrefix checks that prefix is a DNS subdomain followed by a slash
+func validateAnnotationPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	domain := strings.TrimSuffix(prefix, "/")
+	if domain == prefix {
+		return fmt.Errorf("Invalid annotation prefix %q: must end with /", prefix)
+	}
+	if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+		return fmt.Errorf("Invalid annotation prefix %q: %s", prefix, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// annotations looks up annotations under the configured prefix, so several
+// independent installations can run in the same cluster
+type annotations struct {
+	prefix string // DefaultAnnotationPrefix if empty
+	legacy bool   // use DefaultAnnotationPrefix for pods without annotations under prefix
+}
+
+// annotations returns the annotation settings of the config
+func (c *DaemonConfig) annotations() annotations {
+	return annotations{prefix: c.AnnotationPrefix, legacy: c.LegacyAnnotations}
+}
+
+// key returns the key of the annotation (or the readiness gate or condition
+// type) with the given name under the configured prefix
+func (a annotations) key(name string) string {
+	if a.prefix == "" {
+		return name
+	}
+	return a.prefix + strings.TrimPrefix(name, DefaultAnnotationPrefix)
+}
+
+// forPod returns the annotation settings for a pod with the annotations m. In
+// legacy mode the prefix is picked once per pod, so its annotations, readiness
+// gate and condition types are never mixed from both prefixes: the configured
+// prefix if any of its annotations use it, the default one otherwise.
+func (a annotations) forPod(m map[string]string) annotations {
+	if !a.legacy {
+		return a
+	}
+	for k := range m {
+		if strings.HasPrefix(k, a.prefix) {
+			return annotations{prefix: a.prefix}
+		}
+	}
+	return annotations{}
+}
+
+// lookup returns the value of the annotation with the given name
+func (a annotations) lookup(m map[string]string, name string) (string, bool) {
+	v, ok := m[a.forPod(m).key(name)]
+	return v, ok
+}
+
+// hasServices returns whether the k8s pod defines any services for us to sync
+func (a annotations) hasServices(pod corev1.Pod) bool {
+	_, namesOK := a.lookup(pod.ObjectMeta.Annotations, ConsulServiceNames)
+	_, servicesOK := a.lookup(pod.ObjectMeta.Annotations, ConsulServices)
+	return namesOK || servicesOK
+}
+
+// readinessGateType returns the condition type of our readiness gate on the
+// pod, and whether the pod has one
+func (a annotations) readinessGateType(pod *corev1.Pod) (string, bool) {
+	gateType := a.forPod(pod.ObjectMeta.Annotations).key(ReadinessGateType)
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == corev1.PodConditionType(gateType) {
+			return gateType, true
+		}
+	}
+	return gateType, false
+}
+
+// annotation returns the value of the annotation with the given name
+func (p *Pod) annotation(name string) (string, bool) {
+	return p.annotations.lookup(p.Pod.ObjectMeta.Annotations, name)
+}
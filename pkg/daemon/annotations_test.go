@@ -0,0 +1,97 @@
+package daemon
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestAnnotations(t *testing.T) {
+	m := map[string]string{
+		"katalog-sync.wish.com/service-port": "8080",
+		"katalog-sync.wish.com/service-tags": "a",
+		"dc2.example.com/service-tags":       "b",
+	}
+
+	tests := []struct {
+		name        string
+		annotations annotations
+		port        string
+		tags        string
+	}{
+		{
+			name:        "default prefix",
+			annotations: annotations{},
+			port:        "8080",
+			tags:        "a",
+		},
+		{
+			name:        "other prefix",
+			annotations: annotations{prefix: "dc2.example.com/"},
+			tags:        "b",
+		},
+		{
+			// The pod uses the prefix, so none of its default ones count
+			name:        "legacy",
+			annotations: annotations{prefix: "dc2.example.com/", legacy: true},
+			tags:        "b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port, _ := test.annotations.lookup(m, ConsulServicePort)
+			tags, _ := test.annotations.lookup(m, ConsulServiceTags)
+			if port != test.port || tags != test.tags {
+				t.Fatalf("expected port=%q tags=%q, got port=%q tags=%q", test.port, test.tags, port, tags)
+			}
+		})
+	}
+
+	// Pods not using the prefix are read under the default one in legacy mode
+	delete(m, "dc2.example.com/service-tags")
+	a := annotations{prefix: "dc2.example.com/", legacy: true}
+	if port, _ := a.lookup(m, ConsulServicePort); port != "8080" {
+		t.Fatalf("expected port=8080 under the default prefix, got %q", port)
+	}
+	if key := a.forPod(m).key(ConsulServicePort); key != ConsulServicePort {
+		t.Fatalf("expected the default prefix, got %s", key)
+	}
+}
+
+func TestAnnotationsReadinessGate(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{ReadinessGates: []corev1.PodReadinessGate{{ConditionType: ReadinessGateType}}}}
+
+	a := annotations{prefix: "dc2.example.com/"}
+	if gateType, ok := a.readinessGateType(pod); ok || gateType != "dc2.example.com/synced" {
+		t.Fatalf("readiness gate of another prefix treated as ours: %s", gateType)
+	}
+	a.legacy = true
+	if gateType, ok := a.readinessGateType(pod); !ok || gateType != ReadinessGateType {
+		t.Fatalf("legacy readiness gate not found: %s", gateType)
+	}
+	// Once the pod is annotated under the prefix its gate must be as well
+	pod.Annotations = map[string]string{"dc2.example.com/service-names": "a"}
+	if gateType, ok := a.readinessGateType(pod); ok || gateType != "dc2.example.com/synced" {
+		t.Fatalf("legacy readiness gate of a pod using the prefix treated as ours: %s", gateType)
+	}
+	pod.Spec.ReadinessGates = append(pod.Spec.ReadinessGates, corev1.PodReadinessGate{ConditionType: "dc2.example.com/synced"})
+	if gateType, ok := a.readinessGateType(pod); !ok || gateType != "dc2.example.com/synced" {
+		t.Fatalf("readiness gate of the prefix not found: %s", gateType)
+	}
+}
+
+func TestValidateAnnotationPrefix(t *testing.T) {
+	for prefix, valid := range map[string]bool{
+		"":                       true,
+		"katalog-sync.wish.com/": true,
+		"dc2.example.com/":       true,
+		"dc2.example.com":        false,
+		"DC2/":                   false,
+		"/":                      false,
+	} {
+		if err := validateAnnotationPrefix(prefix); (err == nil) != valid {
+			t.Errorf("expected %q valid=%v, got %v", prefix, valid, err)
+		}
+	}
+}
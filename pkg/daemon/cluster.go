@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+// validateClusterName checks that the cluster name can be used in service IDs
+func validateClusterName(clusterName string, inServiceID bool) error {
+	if !inServiceID {
+		return nil
+	}
+	if clusterName == "" {
+		return fmt.Errorf("the cluster name can only be put in service IDs if it is set")
+	}
+	// The service ID is used in API paths, and split on '_' by humans
+	if strings.ContainsAny(clusterName, "/_") {
+		return fmt.Errorf("invalid cluster name %q: must not contain '/' or '_'", clusterName)
+	}
+	return nil
+}
+
+// isSyncedService returns whether the service was registered by katalog-sync
+func isSyncedService(service *consulApi.AgentService) bool {
+	v, ok := service.Meta[ConsulSyncSourceName]
+	return ok && v == ConsulSyncSourceValue
+}
+
+// ownsService returns whether the service was registered by katalog-sync for
+// our cluster. Services registered before the cluster name was set (which
+// have none in their meta) are adopted as ours.
+func (d *Daemon) ownsService(service *consulApi.AgentService) bool {
+	if !isSyncedService(service) {
+		return false
+	}
+	clusterName, ok := service.Meta[ConsulK8sCluster]
+	return !ok || clusterName == d.c.ClusterName
+}
+
+// adoptLegacyServiceIDs makes the pod keep the legacy service IDs of its
+// services which are registered in the agent under those, instead of
+// re-registering them with the cluster name in the ID. It returns the names of
+// the services adopted.
+func (p *Pod) adoptLegacyServiceIDs(agentServices map[string]*consulApi.AgentService) []string {
+	if !p.ClusterNameInServiceID {
+		return nil
+	}
+	key := podCacheKey(p.ObjectMeta.Namespace, p.ObjectMeta.Name)
+
+	var adopted []string
+	for _, serviceName := range p.GetServiceNames() {
+		if _, ok := p.AdoptedServiceIDs[serviceName]; ok {
+			continue
+		}
+		if _, ok := agentServices[p.GetServiceID(serviceName)]; ok {
+			continue
+		}
+		service, ok := agentServices[p.legacyServiceID(serviceName)]
+		if !ok || !isSyncedService(service) || service.Meta[ConsulK8sLinkName] != key {
+			continue
+		}
+		if p.AdoptedServiceIDs == nil {
+			p.AdoptedServiceIDs = make(map[string]struct{})
+		}
+		p.AdoptedServiceIDs[serviceName] = struct{}{}
+		adopted = append(adopted, serviceName)
+	}
+	return adopted
+}
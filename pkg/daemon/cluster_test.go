@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"testing"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+)
+
+func TestDaemonClusterName(t *testing.T) {
+	const (
+		clusterServiceID  = "katalog-sync_east_hw-service-name_hw_hw-7df6995f69-96wth"
+		clusterServiceID2 = "katalog-sync_east_servicename2_hw_hw-7df6995f69-96wth"
+		legacyServiceID2  = "katalog-sync_servicename2_hw_hw-7df6995f69-96wth"
+	)
+
+	// One of the services was registered before the cluster name was set
+	legacyPod, err := NewPod(loadTestPod(t, "basic/working"), &DaemonConfig{})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	consul := consultest.New(testNodeName)
+	if err := consul.Agent().ServiceRegister(legacyPod.Registration("servicename2", consulApi.HealthPassing, "")); err != nil {
+		t.Fatalf("error registering service: %v", err)
+	}
+	// and another cluster registered a service in the same agent
+	foreign := &consulApi.AgentServiceRegistration{
+		ID:   "katalog-sync_west_hw-service-name_hw_gone",
+		Name: "hw-service-name",
+		Meta: map[string]string{
+			ConsulSyncSourceName: ConsulSyncSourceValue,
+			ConsulK8sLinkName:    "hw/gone",
+			ConsulK8sCluster:     "west",
+		},
+	}
+	if err := consul.Agent().ServiceRegister(foreign); err != nil {
+		t.Fatalf("error registering service: %v", err)
+	}
+
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	c := testDaemonConfig()
+	c.ClusterName = "east"
+	c.ClusterNameInServiceID = true
+	startTestDaemon(t, c, kubelet, consul)
+
+	services := consul.AgentServices()
+	for _, id := range []string{clusterServiceID, legacyServiceID2, foreign.ID} {
+		if _, ok := services[id]; !ok {
+			t.Fatalf("expected service %s, have %v", id, services)
+		}
+	}
+	if _, ok := services[clusterServiceID2]; ok || len(services) != 3 {
+		t.Fatalf("expected the legacy service to be adopted, have %v", services)
+	}
+	for _, id := range []string{clusterServiceID, legacyServiceID2} {
+		if cluster := services[id].Meta[ConsulK8sCluster]; cluster != "east" {
+			t.Fatalf("expected cluster meta on %s, have %q", id, cluster)
+		}
+	}
+
+	// Only our services are removed with the pod
+	kubelet.SetPods()
+	eventually(t, "services deregistered", func() bool {
+		services := consul.AgentServices()
+		_, ok := services[foreign.ID]
+		return len(services) == 1 && ok
+	})
+}
+
+func TestValidateClusterName(t *testing.T) {
+	tests := []struct {
+		clusterName string
+		inServiceID bool
+		err         bool
+	}{
+		{clusterName: "", inServiceID: false},
+		{clusterName: "east", inServiceID: true},
+		{clusterName: "us_east", inServiceID: false},
+		{clusterName: "", inServiceID: true, err: true},
+		{clusterName: "us_east", inServiceID: true, err: true},
+		{clusterName: "us/east", inServiceID: true, err: true},
+	}
+	for _, test := range tests {
+		if err := validateClusterName(test.clusterName, test.inServiceID); (err != nil) != test.err {
+			t.Errorf("%q (in service ID: %v): expected error=%v, got %v", test.clusterName, test.inServiceID, test.err, err)
+		}
+	}
+}
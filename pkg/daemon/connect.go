@@ -0,0 +1,215 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// connectProxySuffix is appended to the name and ID of a service to get the
+// name and ID of its connect sidecar proxy; this matches consul's own naming
+// of sidecar services
+const connectProxySuffix = "-sidecar-proxy"
+
+// validateConnect checks the connect annotations of all services of the pod
+func (p *Pod) validateConnect() error {
+	if name := p.ConnectProxyContainer(); name != "" {
+		if !p.hasContainer(name) {
+			return fmt.Errorf("Unable to find connect proxy container %s", name)
+		}
+	}
+	for _, serviceName := range p.GetServiceNames() {
+		native, err := p.getConnectNative(serviceName)
+		if err != nil {
+			return err
+		}
+		port, err := p.getConnectProxyPort(serviceName)
+		if err != nil {
+			return err
+		}
+		if native && port != 0 {
+			return fmt.Errorf("Service %s can't be connect native and have a connect proxy", serviceName)
+		}
+		if _, err := p.getConnectUpstreams(serviceName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pod) hasContainer(name string) bool {
+	for _, container := range p.Pod.Spec.Containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetConnectNative returns whether the given service natively supports connect
+func (p *Pod) GetConnectNative(n string) bool {
+	native, err := p.getConnectNative(n)
+	if err != nil {
+		logrus.Errorf("Unable to parse connect native flag for %s: %v", n, err)
+	}
+	return native
+}
+
+func (p *Pod) getConnectNative(n string) (bool, error) {
+	nativeStr, ok := p.serviceAnnotation(ConsulConnectNative, ConsulConnectNativeOverride, n)
+	if !ok {
+		return false, nil
+	}
+	return strconv.ParseBool(nativeStr)
+}
+
+// GetConnectProxyPort returns the port of the connect sidecar proxy for the
+// given service, or 0 if the service has no proxy
+func (p *Pod) GetConnectProxyPort(n string) int {
+	port, err := p.getConnectProxyPort(n)
+	if err != nil {
+		logrus.Errorf("Unable to parse connect proxy port for %s: %v", n, err)
+	}
+	return port
+}
+
+func (p *Pod) getConnectProxyPort(n string) (int, error) {
+	portStr, ok := p.serviceAnnotation(ConsulConnectProxyPort, ConsulConnectProxyPortOverride, n)
+	if !ok {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 0, err
+	}
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("Invalid connect proxy port %d", port)
+	}
+	return port, nil
+}
+
+// HasConnectProxy returns whether a connect sidecar proxy is defined for the given service
+func (p *Pod) HasConnectProxy(n string) bool {
+	return p.GetConnectProxyPort(n) != 0
+}
+
+// GetConnectUpstreams returns the upstreams of the connect sidecar proxy for the given service
+func (p *Pod) GetConnectUpstreams(n string) []consulApi.Upstream {
+	upstreams, err := p.getConnectUpstreams(n)
+	if err != nil {
+		logrus.Errorf("Unable to parse connect upstreams for %s: %v", n, err)
+	}
+	return upstreams
+}
+
+func (p *Pod) getConnectUpstreams(n string) ([]consulApi.Upstream, error) {
+	upstreamStr, ok := p.serviceAnnotation(ConsulConnectUpstreams, ConsulConnectUpstreamsOverride, n)
+	if !ok {
+		return nil, nil
+	}
+	return parseUpstreams(upstreamStr)
+}
+
+// parseUpstreams parses a comma-separated list of upstreams, each in the form
+// "service:localport" or "service:localport:datacenter". Upstreams are returned
+// ordered by service name.
+func parseUpstreams(s string) ([]consulApi.Upstream, error) {
+	var upstreams []consulApi.Upstream
+	for _, upstreamStr := range strings.Split(s, ",") {
+		upstreamStr = strings.TrimSpace(upstreamStr)
+		if upstreamStr == "" {
+			continue
+		}
+		parts := strings.Split(upstreamStr, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid upstream %q, must be service:port or service:port:datacenter", upstreamStr)
+		}
+		port, err := strconv.Atoi(parts[1])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("Invalid port in upstream %q", upstreamStr)
+		}
+		upstream := consulApi.Upstream{
+			DestinationType: consulApi.UpstreamDestTypeService,
+			DestinationName: parts[0],
+			LocalBindPort:   port,
+		}
+		if len(parts) == 3 {
+			upstream.Datacenter = parts[2]
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	sortUpstreams(upstreams)
+	return upstreams, nil
+}
+
+func sortUpstreams(upstreams []consulApi.Upstream) {
+	sort.Slice(upstreams, func(i, j int) bool {
+		if upstreams[i].DestinationName != upstreams[j].DestinationName {
+			return upstreams[i].DestinationName < upstreams[j].DestinationName
+		}
+		return upstreams[i].LocalBindPort < upstreams[j].LocalBindPort
+	})
+}
+
+// ConnectProxyContainer returns the name of the container running the connect
+// sidecar proxy, if there is one
+func (p *Pod) ConnectProxyContainer() string {
+	name, _ := p.annotation(ConsulConnectProxyContainer)
+	return name
+}
+
+// ConnectProxyReady returns whether the connect sidecar proxy of the pod is
+// ready. This is the readiness of the proxy container if one is defined,
+// otherwise the proxy is assumed to be ready.
+func (p *Pod) ConnectProxyReady() (bool, map[string]bool) {
+	name := p.ConnectProxyContainer()
+	if name == "" {
+		return true, nil
+	}
+	for _, containerStatus := range p.Pod.Status.ContainerStatuses {
+		if containerStatus.Name == name {
+			return containerStatus.Ready, map[string]bool{name: containerStatus.Ready}
+		}
+	}
+	return false, map[string]bool{name: false}
+}
+
+// GetConnectProxyServiceName returns the name of the connect sidecar proxy service for the given service
+func (p *Pod) GetConnectProxyServiceName(n string) string {
+	return n + connectProxySuffix
+}
+
+// GetConnectProxyServiceID returns the ID of the connect sidecar proxy service for the given service
+func (p *Pod) GetConnectProxyServiceID(n string) string {
+	return p.GetServiceID(n) + connectProxySuffix
+}
+
+// ConnectProxyRegistration returns the agent service definition of the connect
+// sidecar proxy for the given service with its check set to status/notes
+func (p *Pod) ConnectProxyRegistration(serviceName, status, notes string) *consulApi.AgentServiceRegistration {
+	// The proxy shares the service's metadata and tags
+	registration := p.Registration(serviceName, status, notes)
+	servicePort := registration.Port
+	registration.Kind = consulApi.ServiceKindConnectProxy
+	registration.ID = p.GetConnectProxyServiceID(serviceName)
+	registration.Name = p.GetConnectProxyServiceName(serviceName)
+	registration.Port = p.GetConnectProxyPort(serviceName)
+	registration.TaggedAddresses = p.GetTaggedAddresses(serviceName, registration.Port)
+	registration.Connect = nil
+	registration.Proxy = &consulApi.AgentServiceConnectProxyConfig{
+		DestinationServiceName: serviceName,
+		DestinationServiceID:   p.GetServiceID(serviceName),
+		LocalServiceAddress:    "127.0.0.1",
+		LocalServicePort:       servicePort,
+		Upstreams:              p.GetConnectUpstreams(serviceName),
+	}
+	registration.Check.CheckID = registration.ID
+	// Probe checks belong to the service, registering them with the proxy
+	// would move them over to it
+	registration.Checks = nil
+	return registration
+}
@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+// ConsulClientConfig holds the config options for connecting to the consul agent.
+// The env vars are the ones the consul CLI uses, so existing setups keep working.
+type ConsulClientConfig struct {
+	Address            string `long:"consul-address" env:"CONSUL_HTTP_ADDR" description:"address of the consul agent, as host:port, http(s)://host:port or unix:///path/to/socket" default:"127.0.0.1:8500"`
+	Token              string `long:"consul-token" env:"CONSUL_HTTP_TOKEN" description:"ACL token to use for requests to the consul agent"`
+	TokenFile          string `long:"consul-token-file" env:"CONSUL_HTTP_TOKEN_FILE" description:"file containing the ACL token to use, re-read whenever it changes; takes precedence over --consul-token"`
+	CAFile             string `long:"consul-ca-file" env:"CONSUL_CACERT" description:"CA certificate to verify the consul agent's TLS certificate with"`
+	CertFile           string `long:"consul-client-cert" env:"CONSUL_CLIENT_CERT" description:"client certificate for TLS connections to the consul agent"`
+	KeyFile            string `long:"consul-client-key" env:"CONSUL_CLIENT_KEY" description:"client key for TLS connections to the consul agent"`
+	TLSServerName      string `long:"consul-tls-server-name" env:"CONSUL_TLS_SERVER_NAME" description:"server name to verify the consul agent's TLS certificate against"`
+	InsecureSkipVerify bool   `long:"consul-insecure-skip-verify" env:"CONSUL_HTTP_SSL_VERIFY_SKIP" description:"skip verification of the consul agent's TLS certificate"`
+	Datacenter         string `long:"consul-datacenter" env:"CONSUL_DATACENTER" description:"consul datacenter, defaults to the agent's datacenter"`
+	Namespace          string `long:"consul-namespace" env:"CONSUL_NAMESPACE" description:"consul namespace to register services in (consul enterprise)"`
+	Partition          string `long:"consul-partition" env:"CONSUL_PARTITION" description:"consul admin partition to register services in (consul enterprise)"`
+}
+
+// NewConsulClient returns a new consul client based on the given config
+func NewConsulClient(c ConsulClientConfig) (*consulApi.Client, error) {
+	config := consulApi.DefaultConfig()
+	config.Datacenter = c.Datacenter
+	config.Namespace = c.Namespace
+	config.Token = c.Token
+	// We read the token file ourselves so rotated tokens are picked up
+	config.TokenFile = ""
+	if c.TokenFile != "" {
+		config.Token = ""
+	}
+	config.TLSConfig = consulApi.TLSConfig{
+		Address:            c.TLSServerName,
+		CAFile:             c.CAFile,
+		CertFile:           c.CertFile,
+		KeyFile:            c.KeyFile,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	transport := config.Transport
+	tlsConfig, err := consulApi.SetupTLSConfig(&config.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	// The consul client sets up its own http client for unix sockets, so we
+	// dial the socket ourselves to keep our transport
+	if path := strings.TrimPrefix(c.Address, "unix://"); path != c.Address {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		config.Address = "localhost"
+		config.Scheme = "http"
+	} else if c.Address != "" {
+		config.Address = c.Address
+	}
+
+	rt := &consulTransport{base: transport, partition: c.Partition}
+	if c.TokenFile != "" {
+		rt.tokenFile = &tokenFile{path: c.TokenFile}
+		// Fail early on an unreadable token file
+		if _, err := rt.tokenFile.Token(); err != nil {
+			return nil, err
+		}
+	}
+	config.HttpClient = &http.Client{Transport: rt}
+
+	return consulApi.NewClient(config)
+}
+
+// consulTransport adds the parts of the consul config to requests which the
+// consul client doesn't support itself
+type consulTransport struct {
+	base      http.RoundTripper
+	tokenFile *tokenFile
+	partition string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *consulTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request
+	req = req.Clone(req.Context())
+
+	if t.tokenFile != nil && req.Header.Get("X-Consul-Token") == "" {
+		token, err := t.tokenFile.Token()
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+	}
+
+	if t.partition != "" {
+		q := req.URL.Query()
+		if q.Get("partition") == "" {
+			q.Set("partition", t.partition)
+			req.URL.RawQuery = q.Encode()
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// tokenFile is a file containing an ACL token, which is re-read whenever the
+// file changes
+type tokenFile struct {
+	path string
+
+	l       sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+// Token returns the current content of the token file
+func (f *tokenFile) Token() (string, error) {
+	// Stat follows symlinks, so this also notices k8s secret volumes swapping
+	// their data directory
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("Error loading token file: %v", err)
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.token, nil
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("Error loading token file: %v", err)
+	}
+	f.token = strings.TrimSpace(string(b))
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return f.token, nil
+}
@@ -0,0 +1,118 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingAgent is a consul agent HTTP handler recording the token and
+// partition of the last request
+type recordingAgent struct {
+	l         sync.Mutex
+	token     string
+	partition string
+}
+
+func (a *recordingAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.l.Lock()
+	a.token = r.Header.Get("X-Consul-Token")
+	a.partition = r.URL.Query().Get("partition")
+	a.l.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+func (a *recordingAgent) last() (string, string) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	return a.token, a.partition
+}
+
+func TestConsulClientTokenFile(t *testing.T) {
+	agent := &recordingAgent{}
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "katalog-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("token1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewConsulClient(ConsulClientConfig{
+		Address:   srv.URL,
+		Token:     "ignored",
+		TokenFile: tokenPath,
+		Partition: "part1",
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	if _, err := client.Agent().Services(); err != nil {
+		t.Fatalf("error querying agent: %v", err)
+	}
+	if token, partition := agent.last(); token != "token1" || partition != "part1" {
+		t.Fatalf("wrong token or partition sent: %q %q", token, partition)
+	}
+
+	// A rotated token is picked up without recreating the client
+	if err := ioutil.WriteFile(tokenPath, []byte("token2-rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Agent().Services(); err != nil {
+		t.Fatalf("error querying agent: %v", err)
+	}
+	if token, _ := agent.last(); token != "token2-rotated" {
+		t.Fatalf("rotated token not used, sent %q", token)
+	}
+
+	// A missing token file is an error up front
+	if _, err := NewConsulClient(ConsulClientConfig{Address: srv.URL, TokenFile: filepath.Join(dir, "missing")}); err == nil {
+		t.Fatalf("expected error for missing token file")
+	}
+}
+
+func TestConsulClientUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katalog-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "consul.sock")
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("error listening on unix socket: %v", err)
+	}
+	agent := &recordingAgent{}
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: agent}}
+	srv.Start()
+	defer srv.Close()
+
+	client, err := NewConsulClient(ConsulClientConfig{Address: "unix://" + socketPath, Token: "token1"})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if _, err := client.Agent().Services(); err != nil {
+		t.Fatalf("error querying agent over unix socket: %v", err)
+	}
+	if token, _ := agent.last(); token != "token1" {
+		t.Fatalf("wrong token sent: %q", token)
+	}
+}
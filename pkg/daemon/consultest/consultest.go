@@ -0,0 +1,507 @@
+// Package consultest provides an in-memory fake of the consul agent and
+// catalog APIs katalog-sync uses, for testing the daemon without a consul.
+package consultest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+// serviceMaintenancePrefix is the CheckID prefix consul uses for a service's maintenance check
+const serviceMaintenancePrefix = "_service_maintenance:"
+
+// defaultWaitTime is how long blocking queries wait if the query doesn't specify a WaitTime
+const defaultWaitTime = 5 * time.Minute
+
+// Consul is a fake of a single consul agent and the catalog it syncs to. Changes
+// made through the agent become visible in the catalog after PropagationDelay;
+// check updates don't change the catalog, but still move its index along so
+// blocking queries waiting on a service's health wake up.
+type Consul struct {
+	// PropagationDelay is how long it takes for agent changes to show up in the catalog
+	PropagationDelay time.Duration
+
+	l        sync.Mutex
+	nodeName string
+	services map[string]*consulApi.AgentService // agent services
+	checks   map[string]*consulApi.AgentCheck   // agent checks
+	catalog  map[string]*consulApi.AgentService // services as seen by the catalog
+	errs     map[string]error                   // method name -> injected error
+
+	// catalog index and a channel closed (and replaced) whenever it changes
+	index    uint64
+	changeCh chan struct{}
+}
+
+// New returns a new empty fake consul with a node of the given name
+func New(nodeName string) *Consul {
+	return &Consul{
+		nodeName: nodeName,
+		services: make(map[string]*consulApi.AgentService),
+		checks:   make(map[string]*consulApi.AgentCheck),
+		catalog:  make(map[string]*consulApi.AgentService),
+		errs:     make(map[string]error),
+		index:    1,
+		changeCh: make(chan struct{}),
+	}
+}
+
+// Agent returns the fake's agent API
+func (c *Consul) Agent() *Agent { return &Agent{c: c} }
+
+// Catalog returns the fake's catalog API
+func (c *Consul) Catalog() *Catalog { return &Catalog{c: c} }
+
+// SetError makes all calls to the method of the given name (e.g.
+// "ServiceRegister") return err; a nil err clears the error.
+func (c *Consul) SetError(method string, err error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if err == nil {
+		delete(c.errs, method)
+	} else {
+		c.errs[method] = err
+	}
+}
+
+// AgentServices returns a copy of the services registered in the agent
+func (c *Consul) AgentServices() map[string]*consulApi.AgentService {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return copyServices(c.services)
+}
+
+// AgentChecks returns a copy of the checks registered in the agent
+func (c *Consul) AgentChecks() map[string]*consulApi.AgentCheck {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return copyChecks(c.checks)
+}
+
+// CatalogServices returns a copy of the services visible in the catalog
+func (c *Consul) CatalogServices() map[string]*consulApi.AgentService {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return copyServices(c.catalog)
+}
+
+// err returns the injected error for method; must be called with the lock held
+func (c *Consul) err(method string) error {
+	return c.errs[method]
+}
+
+// propagate copies the agent's state of service into the catalog after the
+// PropagationDelay; must be called with the lock held
+func (c *Consul) propagate(serviceID string) {
+	var service *consulApi.AgentService
+	if s, ok := c.services[serviceID]; ok {
+		service = copyService(s)
+	}
+
+	apply := func() {
+		if service == nil {
+			delete(c.catalog, serviceID)
+		} else {
+			c.catalog[serviceID] = service
+		}
+		c.index++
+		close(c.changeCh)
+		c.changeCh = make(chan struct{})
+	}
+
+	if c.PropagationDelay <= 0 {
+		apply()
+		return
+	}
+	time.AfterFunc(c.PropagationDelay, func() {
+		c.l.Lock()
+		defer c.l.Unlock()
+		apply()
+	})
+}
+
+// Agent is the fake of the consul agent API
+type Agent struct {
+	c *Consul
+}
+
+// NodeName returns the name of the fake's node
+func (a *Agent) NodeName() (string, error) {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("NodeName"); err != nil {
+		return "", err
+	}
+	return a.c.nodeName, nil
+}
+
+// Services returns the services registered in the agent
+func (a *Agent) Services() (map[string]*consulApi.AgentService, error) {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("Services"); err != nil {
+		return nil, err
+	}
+	return copyServices(a.c.services), nil
+}
+
+// Checks returns the checks registered in the agent
+func (a *Agent) Checks() (map[string]*consulApi.AgentCheck, error) {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("Checks"); err != nil {
+		return nil, err
+	}
+	return copyChecks(a.c.checks), nil
+}
+
+// AgentHealthServiceByID returns the aggregated status of a service's checks;
+// like consul an unknown service is critical
+func (a *Agent) AgentHealthServiceByID(serviceID string) (string, *consulApi.AgentServiceChecksInfo, error) {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("AgentHealthServiceByID"); err != nil {
+		return "", nil, err
+	}
+	service, ok := a.c.services[serviceID]
+	if !ok {
+		return consulApi.HealthCritical, nil, nil
+	}
+
+	info := &consulApi.AgentServiceChecksInfo{Service: copyService(service)}
+	for _, check := range a.c.checks {
+		if check.ServiceID != serviceID {
+			continue
+		}
+		info.Checks = append(info.Checks, &consulApi.HealthCheck{
+			Node:        a.c.nodeName,
+			CheckID:     check.CheckID,
+			Name:        check.Name,
+			Status:      check.Status,
+			Notes:       check.Notes,
+			Output:      check.Output,
+			ServiceID:   check.ServiceID,
+			ServiceName: check.ServiceName,
+			Type:        check.Type,
+		})
+	}
+	info.AggregatedStatus = info.Checks.AggregatedStatus()
+	// consul reports maintenance as critical through this API
+	if info.AggregatedStatus == consulApi.HealthMaint {
+		return consulApi.HealthCritical, info, nil
+	}
+	return info.AggregatedStatus, info, nil
+}
+
+// ServiceRegister registers (or updates) a service and its checks
+func (a *Agent) ServiceRegister(r *consulApi.AgentServiceRegistration) error {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("ServiceRegister"); err != nil {
+		return err
+	}
+	if r.Name == "" {
+		return fmt.Errorf("Missing service name")
+	}
+
+	service := &consulApi.AgentService{
+		Kind:              r.Kind,
+		ID:                r.ID,
+		Service:           r.Name,
+		Tags:              append([]string(nil), r.Tags...),
+		Meta:              copyMeta(r.Meta),
+		Port:              r.Port,
+		Address:           r.Address,
+		TaggedAddresses:   r.TaggedAddresses,
+		Weights:           consulApi.AgentWeights{Passing: 1, Warning: 1},
+		EnableTagOverride: r.EnableTagOverride,
+		Proxy:             r.Proxy,
+		Connect:           r.Connect,
+	}
+	if service.ID == "" {
+		service.ID = r.Name
+	}
+	if r.Weights != nil {
+		service.Weights = *r.Weights
+	}
+	if existing, ok := a.c.services[service.ID]; ok {
+		service.CreateIndex = existing.CreateIndex
+	} else {
+		service.CreateIndex = a.c.index
+	}
+	service.ModifyIndex = a.c.index
+	a.c.services[service.ID] = service
+
+	// Register the checks, consul numbers checks without an ID
+	var checks consulApi.AgentServiceChecks
+	if r.Check != nil {
+		checks = append(checks, r.Check)
+	}
+	checks = append(checks, r.Checks...)
+	for i, check := range checks {
+		checkID := check.CheckID
+		if checkID == "" {
+			checkID = "service:" + service.ID
+			if len(checks) > 1 {
+				checkID = fmt.Sprintf("%s:%d", checkID, i+1)
+			}
+		}
+		status := check.Status
+		if status == "" {
+			status = consulApi.HealthCritical
+		}
+		// Re-registering a check keeps its existing status, unless one is given
+		if existing, ok := a.c.checks[checkID]; ok && check.Status == "" {
+			status = existing.Status
+		}
+		a.c.checks[checkID] = &consulApi.AgentCheck{
+			Node:        a.c.nodeName,
+			CheckID:     checkID,
+			Name:        check.Name,
+			Status:      status,
+			Notes:       check.Notes,
+			ServiceID:   service.ID,
+			ServiceName: service.Service,
+			Type:        checkType(check),
+			Definition:  checkDefinition(check),
+		}
+	}
+
+	a.c.propagate(service.ID)
+	return nil
+}
+
+// ServiceDeregister removes a service and all of its checks
+func (a *Agent) ServiceDeregister(serviceID string) error {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("ServiceDeregister"); err != nil {
+		return err
+	}
+	if _, ok := a.c.services[serviceID]; !ok {
+		return fmt.Errorf("Unknown service ID %q", serviceID)
+	}
+	delete(a.c.services, serviceID)
+	for checkID, check := range a.c.checks {
+		if check.ServiceID == serviceID {
+			delete(a.c.checks, checkID)
+		}
+	}
+	a.c.propagate(serviceID)
+	return nil
+}
+
+// UpdateTTL sets the status and output of a TTL check
+func (a *Agent) UpdateTTL(checkID, output, status string) error {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("UpdateTTL"); err != nil {
+		return err
+	}
+	check, ok := a.c.checks[checkID]
+	if !ok {
+		return fmt.Errorf("Unknown check ID %q", checkID)
+	}
+	if check.Type != "ttl" {
+		return fmt.Errorf("Check %q is not a TTL check", checkID)
+	}
+	switch status {
+	case consulApi.HealthPassing, consulApi.HealthWarning, consulApi.HealthCritical:
+	default:
+		return fmt.Errorf("Unknown check status %q", status)
+	}
+	check.Status = status
+	check.Output = output
+	a.c.propagate(check.ServiceID)
+	return nil
+}
+
+// CheckDeregister removes a check
+func (a *Agent) CheckDeregister(checkID string) error {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("CheckDeregister"); err != nil {
+		return err
+	}
+	check, ok := a.c.checks[checkID]
+	if !ok {
+		return fmt.Errorf("Unknown check ID %q", checkID)
+	}
+	delete(a.c.checks, checkID)
+	a.c.propagate(check.ServiceID)
+	return nil
+}
+
+// EnableServiceMaintenance puts a service into maintenance mode
+func (a *Agent) EnableServiceMaintenance(serviceID, reason string) error {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("EnableServiceMaintenance"); err != nil {
+		return err
+	}
+	service, ok := a.c.services[serviceID]
+	if !ok {
+		return fmt.Errorf("Unknown service ID %q", serviceID)
+	}
+	checkID := serviceMaintenancePrefix + serviceID
+	a.c.checks[checkID] = &consulApi.AgentCheck{
+		Node:        a.c.nodeName,
+		CheckID:     checkID,
+		Name:        "Service Maintenance Mode",
+		Status:      consulApi.HealthMaint,
+		Notes:       reason,
+		ServiceID:   serviceID,
+		ServiceName: service.Service,
+		Type:        "maintenance",
+	}
+	a.c.propagate(serviceID)
+	return nil
+}
+
+// DisableServiceMaintenance takes a service out of maintenance mode
+func (a *Agent) DisableServiceMaintenance(serviceID string) error {
+	a.c.l.Lock()
+	defer a.c.l.Unlock()
+	if err := a.c.err("DisableServiceMaintenance"); err != nil {
+		return err
+	}
+	if _, ok := a.c.services[serviceID]; !ok {
+		return fmt.Errorf("Unknown service ID %q", serviceID)
+	}
+	delete(a.c.checks, serviceMaintenancePrefix+serviceID)
+	a.c.propagate(serviceID)
+	return nil
+}
+
+// Catalog is the fake of the consul catalog API
+type Catalog struct {
+	c *Consul
+}
+
+// Node returns the services the catalog has for the node. If q.WaitIndex is
+// set this blocks until the catalog index moves past it, the query's WaitTime
+// elapses or the query's context is done.
+func (cat *Catalog) Node(node string, q *consulApi.QueryOptions) (*consulApi.CatalogNode, *consulApi.QueryMeta, error) {
+	if q == nil {
+		q = &consulApi.QueryOptions{}
+	}
+
+	cat.c.l.Lock()
+	if err := cat.c.err("Node"); err != nil {
+		cat.c.l.Unlock()
+		return nil, nil, err
+	}
+	if q.WaitIndex > 0 && q.WaitIndex >= cat.c.index {
+		changeCh := cat.c.changeCh
+		cat.c.l.Unlock()
+
+		waitTime := q.WaitTime
+		if waitTime <= 0 {
+			waitTime = defaultWaitTime
+		}
+		timer := time.NewTimer(waitTime)
+		defer timer.Stop()
+		select {
+		case <-changeCh:
+		case <-timer.C:
+		case <-q.Context().Done():
+			return nil, nil, q.Context().Err()
+		}
+		cat.c.l.Lock()
+	}
+	defer cat.c.l.Unlock()
+
+	meta := &consulApi.QueryMeta{LastIndex: cat.c.index}
+	if node != cat.c.nodeName {
+		return nil, meta, nil
+	}
+	return &consulApi.CatalogNode{
+		Node:     &consulApi.Node{Node: cat.c.nodeName},
+		Services: copyServices(cat.c.catalog),
+	}, meta, nil
+}
+
+func checkType(check *consulApi.AgentServiceCheck) string {
+	switch {
+	case check.TTL != "":
+		return "ttl"
+	case check.HTTP != "":
+		return "http"
+	case check.TCP != "":
+		return "tcp"
+	case check.GRPC != "":
+		return "grpc"
+	case check.AliasService != "" || check.AliasNode != "":
+		return "alias"
+	case len(check.Args) > 0:
+		return "script"
+	}
+	return ""
+}
+
+func checkDefinition(check *consulApi.AgentServiceCheck) consulApi.HealthCheckDefinition {
+	def := consulApi.HealthCheckDefinition{
+		HTTP:          check.HTTP,
+		Header:        check.Header,
+		Method:        check.Method,
+		Body:          check.Body,
+		TLSServerName: check.TLSServerName,
+		TLSSkipVerify: check.TLSSkipVerify,
+		TCP:           check.TCP,
+	}
+	parse := func(s string) time.Duration {
+		d, _ := time.ParseDuration(s)
+		return d
+	}
+	def.IntervalDuration = parse(check.Interval)
+	def.TimeoutDuration = parse(check.Timeout)
+	def.DeregisterCriticalServiceAfterDuration = parse(check.DeregisterCriticalServiceAfter)
+	def.Interval = consulApi.ReadableDuration(def.IntervalDuration)
+	def.Timeout = consulApi.ReadableDuration(def.TimeoutDuration)
+	def.DeregisterCriticalServiceAfter = consulApi.ReadableDuration(def.DeregisterCriticalServiceAfterDuration)
+	return def
+}
+
+func copyMeta(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyService(s *consulApi.AgentService) *consulApi.AgentService {
+	c := *s
+	c.Tags = append([]string(nil), s.Tags...)
+	c.Meta = copyMeta(s.Meta)
+	return &c
+}
+
+func copyServices(services map[string]*consulApi.AgentService) map[string]*consulApi.AgentService {
+	c := make(map[string]*consulApi.AgentService, len(services))
+	for k, v := range services {
+		c[k] = copyService(v)
+	}
+	return c
+}
+
+func copyChecks(checks map[string]*consulApi.AgentCheck) map[string]*consulApi.AgentCheck {
+	c := make(map[string]*consulApi.AgentCheck, len(checks))
+	for k, v := range checks {
+		check := *v
+		c[k] = &check
+	}
+	return c
+}
+
+// IsMaintenanceCheck returns whether checkID is the maintenance check of a service
+func IsMaintenanceCheck(checkID string) bool {
+	return strings.HasPrefix(checkID, serviceMaintenancePrefix)
+}
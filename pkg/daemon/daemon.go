@@ -2,14 +2,16 @@ package daemon
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	consulApi "github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
 
 	katalogsync "github.com/wish/katalog-sync/proto"
 )
@@ -20,8 +22,29 @@ var (
 	ConsulK8sLinkName     = "external-k8s-link"
 	ConsulK8sNamespace    = "external-k8s-namespace"
 	ConsulK8sPod          = "external-k8s-pod"
+	ConsulK8sCluster      = "external-k8s-cluster"
 )
 
+// ShutdownPolicy options; these define what happens to our services in the
+// agent when the daemon stops
+const (
+	ShutdownPolicyNone        = "none"        // leave services as-is (e.g. for rolling upgrades of the daemon)
+	ShutdownPolicyCritical    = "critical"    // mark the services' checks as critical
+	ShutdownPolicyMaintenance = "maintenance" // put the services into maintenance mode
+	ShutdownPolicyDeregister  = "deregister"  // deregister all services katalog-sync owns
+)
+
+// consulServiceMaintenancePrefix is the prefix consul uses for the CheckID of
+// a service's maintenance check (the suffix being the service ID)
+const consulServiceMaintenancePrefix = "_service_maintenance:"
+
+// shutdownMaintenanceReason is the reason/output set on services by the
+// shutdown policy; this is how we find them again on startup
+const shutdownMaintenanceReason = "katalog-sync-daemon stopped"
+
+// ErrStopped is returned to sync requests made after the daemon has stopped
+var ErrStopped = errors.New("katalog-sync-daemon stopped")
+
 // Metrics
 var (
 	k8sSyncCount = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -40,6 +63,14 @@ var (
 		Name: "katalog_sync_consul_sync_duration_seconds",
 		Help: "Latency of sync process from kubelet",
 	}, []string{"status"})
+	syncGenerationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "katalog_sync_generation",
+		Help: "Generation of the most recently completed sync",
+	})
+	localPodsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "katalog_sync_local_pods",
+		Help: "How many pods are being synced from this node",
+	})
 )
 
 func init() {
@@ -48,81 +79,180 @@ func init() {
 		k8sSyncSummary,
 		consulSyncCount,
 		consulSyncSummary,
+		syncGenerationGauge,
+		localPodsGauge,
 	)
 }
 
 // DaemonConfig contains the configuration options for a katalog-sync-daemon
 type DaemonConfig struct {
-	MinSyncInterval     time.Duration `long:"min-sync-interval" env:"MIN_SYNC_INTERVAL" description:"minimum duration allowed for sync" default:"500ms"`
-	MaxSyncInterval     time.Duration `long:"max-sync-interval" env:"MAX_SYNC_INTERVAL" description:"maximum duration allowed for sync" default:"5s"`
-	DefaultSyncInterval time.Duration `long:"default-sync-interval" env:"DEFAULT_SYNC_INTERVAL" default:"1s"`
-	DefaultCheckTTL     time.Duration `long:"default-check-ttl" env:"DEFAULT_CHECK_TTL" default:"10s"`
-	SyncTTLBuffer       time.Duration `long:"sync-ttl-buffer-duration" env:"SYNC_TTL_BUFFER_DURATION" description:"how much time to ensure is between sync time and ttl" default:"10s"`
+	MinSyncInterval       time.Duration `long:"min-sync-interval" env:"MIN_SYNC_INTERVAL" description:"minimum duration allowed for sync" default:"500ms"`
+	MaxSyncInterval       time.Duration `long:"max-sync-interval" env:"MAX_SYNC_INTERVAL" description:"maximum duration allowed for sync" default:"5s"`
+	DefaultSyncInterval   time.Duration `long:"default-sync-interval" env:"DEFAULT_SYNC_INTERVAL" default:"1s"`
+	DefaultCheckTTL       time.Duration `long:"default-check-ttl" env:"DEFAULT_CHECK_TTL" default:"10s"`
+	SyncTTLBuffer         time.Duration `long:"sync-ttl-buffer-duration" env:"SYNC_TTL_BUFFER_DURATION" description:"how much time to ensure is between sync time and ttl" default:"10s"`
+	KubeletSyncInterval   time.Duration `long:"kubelet-sync-interval" env:"KUBELET_SYNC_INTERVAL" description:"how frequently to fetch pods from the kubelet" default:"1s"`
+	ShutdownPolicy        string        `long:"shutdown-policy" env:"SHUTDOWN_POLICY" description:"what to do with our agent services on shutdown" choice:"none" choice:"critical" choice:"maintenance" choice:"deregister" default:"none"`
+	DryRun                bool          `long:"dry-run" env:"DRY_RUN" description:"only log and export the sync plan, without making any changes to consul or k8s"`
+	DefaultServiceAddress string        `long:"default-service-address" env:"DEFAULT_SERVICE_ADDRESS" description:"address to register services with: podIP, hostIP, ipv4, ipv6 or a literal address" default:"podIP"`
+
+	DefaultDeregisterCriticalServiceAfter time.Duration `long:"default-deregister-critical-service-after" env:"DEFAULT_DEREGISTER_CRITICAL_SERVICE_AFTER" description:"have consul deregister services which have been critical this long, e.g. once the daemon is gone (0 disables)" default:"0s"`
+	ReapCriticalServices                  bool          `long:"reap-critical-services" env:"REAP_CRITICAL_SERVICES" description:"on startup deregister critical services of pods which no longer exist, regardless of the mass-deregistration guard"`
+
+	ClusterName            string `long:"cluster-name" env:"CLUSTER_NAME" description:"name of the k8s cluster, put into the service meta; services of other clusters are left alone"`
+	ClusterNameInServiceID bool   `long:"cluster-name-in-service-id" env:"CLUSTER_NAME_IN_SERVICE_ID" description:"include the cluster name in the IDs of newly registered services"`
+
+	MaxDeregisterCount    int           `long:"max-deregister-count" env:"MAX_DEREGISTER_COUNT" description:"hold back deregistrations if a sync would remove more than this many services (0 disables)" default:"0"`
+	MaxDeregisterPercent  int           `long:"max-deregister-percent" env:"MAX_DEREGISTER_PERCENT" description:"hold back deregistrations if a sync would remove more than this percentage of our services (0 disables)" default:"0"`
+	DeregisterGuardWindow time.Duration `long:"deregister-guard-window" env:"DEREGISTER_GUARD_WINDOW" description:"how long held back deregistrations have to stay planned before they are applied" default:"1m"`
+
+	AnnotationPrefix  string `long:"annotation-prefix" env:"ANNOTATION_PREFIX" description:"prefix of the annotations, readiness gate and condition types to use, to run multiple installations in a cluster" default:"katalog-sync.wish.com/"`
+	LegacyAnnotations bool   `long:"legacy-annotations" env:"LEGACY_ANNOTATIONS" description:"use the katalog-sync.wish.com/ prefix for annotations, readiness gates and conditions of pods without annotations under the configured prefix"`
+
+	Namespaces        []string `long:"namespace" env:"NAMESPACES" env-delim:"," description:"only sync pods in namespaces matching one of these glob patterns (repeatable, default: all)"`
+	ExcludeNamespaces []string `long:"exclude-namespace" env:"EXCLUDE_NAMESPACES" env-delim:"," description:"don't sync pods in namespaces matching any of these glob patterns (repeatable)"`
+	PodSelector       string   `long:"pod-selector" env:"POD_SELECTOR" description:"only sync pods matching this label selector, e.g. katalog-sync=enabled,tier!=sandbox"`
 }
 
 // NewDaemon is a helper function to return a new *Daemon
-func NewDaemon(c DaemonConfig, k8sClient Kubelet, consulClient *consulApi.Client) *Daemon {
+func NewDaemon(c DaemonConfig, k8sClient Kubelet, consulAgent ConsulAgent, consulCatalog ConsulCatalog) *Daemon {
 	return &Daemon{
-		c:            c,
-		k8sClient:    k8sClient,
-		consulClient: consulClient,
+		c:             c,
+		k8sClient:     k8sClient,
+		consulAgent:   consulAgent,
+		consulCatalog: consulCatalog,
 
-		localK8sState: make(map[string]*Pod),
-		syncCh:        make(chan chan error),
+		state:     newPodStore(),
+		syncCh:    make(chan *syncRequest),
+		configsCh: make(chan []PodConfig, 1),
+		startedCh: make(chan struct{}),
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
 	}
 }
 
+// SetK8sClientset has the daemon set the readiness gates of pods through
+// clientset; without one they can't be set. This must be called before Start
+func (d *Daemon) SetK8sClientset(clientset kubernetes.Interface) {
+	d.k8sClientset = clientset
+}
+
+// SetConfigReporter has the daemon report problems with the annotations of
+// pods to r after each fetch; this must be called before Start
+func (d *Daemon) SetConfigReporter(r ConfigReporter) {
+	d.configReporter = r
+}
+
 // Daemon is responsible for syncing state from k8s -> consul
 type Daemon struct {
 	c DaemonConfig
 
-	k8sClient    Kubelet
-	consulClient *consulApi.Client
+	k8sClient     Kubelet
+	consulAgent   ConsulAgent
+	consulCatalog ConsulCatalog
+	// sets the readiness gates of pods, nil if unavailable
+	k8sClientset kubernetes.Interface
+	// reports problems with the annotations of pods, nil if disabled
+	configReporter ConfigReporter
+	// the latest configs not yet picked up by reportConfigs
+	configsCh chan []PodConfig
+	// which pods to sync, set up in Start
+	selection *podSelection
 
-	// TODO: locks around this? or move everything through a channel
 	// Our local representation of what pods are running
-	localK8sState map[string]*Pod
+	state *podStore
+
+	syncCh chan *syncRequest
+
+	resultL    sync.RWMutex
+	lastResult SyncResult // result of the most recently completed sync
+
+	// the most recently calculated *SyncPlan
+	lastPlan atomic.Value
+
+	// mass-deregistration guard, only used by the sync loop
+	deregisterGuard deregisterGuard
 
-	syncCh chan chan error
+	// whether the initial sync ran, only used by Start and then the sync loop
+	warmStarted bool
+
+	stopOnce  sync.Once
+	startedCh chan struct{} // closed once Start launched the sync loop
+	stopCh    chan struct{} // closed to stop the sync loop
+	doneCh    chan struct{} // closed once the sync loop has stopped
 }
 
-func (d *Daemon) doSync(ctx context.Context) error {
-	ch := make(chan error, 1)
+// doSync triggers a sync of the pod stored under key and waits for it to
+// complete. The sync is guaranteed to have started after doSync was called,
+// and to include a fetch from the kubelet which did so as well; concurrent
+// requests may be coalesced into the same sync.
+func (d *Daemon) doSync(ctx context.Context, key string) (SyncResult, error) {
+	ch := make(chan SyncResult, 1)
 
 	// Trigger a sync
-	d.syncCh <- ch
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-ch:
-		return err
+		return SyncResult{}, ctx.Err()
+	case <-d.stopCh:
+		return SyncResult{}, ErrStopped
+	case d.syncCh <- &syncRequest{key: key, ch: ch}:
 	}
+
+	select {
+	case <-ctx.Done():
+		return SyncResult{}, ctx.Err()
+	case <-d.stopCh:
+		return SyncResult{}, ErrStopped
+	case result := <-ch:
+		return result, result.Err
+	}
+}
+
+// LastSync returns the result of the most recently completed sync
+func (d *Daemon) LastSync() SyncResult {
+	d.resultL.RLock()
+	defer d.resultL.RUnlock()
+	return d.lastResult
+}
+
+// completeSync records the result of a sync which started at the given time,
+// assigning it the next generation
+func (d *Daemon) completeSync(started time.Time, err error) SyncResult {
+	d.resultL.Lock()
+	defer d.resultL.Unlock()
+	d.lastResult = SyncResult{
+		Generation: d.lastResult.Generation + 1,
+		Started:    started,
+		Finished:   time.Now(),
+		Err:        err,
+	}
+	syncGenerationGauge.Set(float64(d.lastResult.Generation))
+	return d.lastResult
 }
 
 // Register handles a sidecar request for registration. This will block until
 // (1) the pod excluding the sidecar container is ready
 // (2) the service has been pushed to the agent services API
 // (3) the entry shows up in the catalog API (meaning it synced to the cluster)
+// The sidecar is only marked ready after a sync which started after the
+// request was made, and the result is from a sync which started after that.
 func (d *Daemon) Register(ctx context.Context, in *katalogsync.RegisterQuery) (*katalogsync.RegisterResult, error) {
-	if err := d.doSync(ctx); err != nil {
+	k := podCacheKey(in.Namespace, in.PodName)
+	if _, err := d.doSync(ctx, k); err != nil {
 		return nil, err
 	}
 
-	k := podCacheKey(in.Namespace, in.PodName)
-	pod, ok := d.localK8sState[k]
-	if !ok {
-		return nil, fmt.Errorf("Unable to find pod with katalog-sync annotation (%s): %s", ConsulServiceNames, k)
+	if err := d.setSidecarState(k, in.ContainerName, true); err != nil {
+		return nil, err
 	}
 
-	if pod.SidecarState == nil {
-		return nil, fmt.Errorf("Pod is missing annotation %s for sidecar", SidecarName)
+	if _, err := d.doSync(ctx, k); err != nil {
+		return nil, err
 	}
 
-	pod.SidecarState.SidecarName = in.ContainerName
-	pod.SidecarState.Ready = true
-
-	if err := d.doSync(ctx); err != nil {
-		return nil, err
+	pod, ok := d.state.Get(k)
+	if !ok {
+		return nil, fmt.Errorf("Unable to find pod with katalog-sync annotation (%s): %s", d.c.annotations().key(ConsulServiceNames), k)
 	}
 
 	if err := pod.SyncStatuses.GetError(); err != nil {
@@ -130,16 +260,16 @@ func (d *Daemon) Register(ctx context.Context, in *katalogsync.RegisterQuery) (*
 	}
 
 	// The goal here is to ensure that the registration has propogated to the rest of the cluster
-	nodeName, err := d.consulClient.Agent().NodeName()
+	nodeName, err := d.consulAgent.NodeName()
 	if err != nil {
 		return nil, err
 	}
 	opts := &consulApi.QueryOptions{AllowStale: true, UseCache: true}
 	if err := d.ConsulNodeDoUntil(ctx, nodeName, opts, func(node *consulApi.CatalogNode) bool {
 		synced := true
-		for _, serviceName := range pod.GetServiceNames() {
+		for _, serviceID := range pod.GetServiceIDs() {
 			// If the service exists, then we just need to update
-			if _, ok := node.Services[pod.GetServiceID(serviceName)]; !ok {
+			if _, ok := node.Services[serviceID]; !ok {
 				synced = false
 			}
 		}
@@ -158,24 +288,22 @@ func (d *Daemon) Register(ctx context.Context, in *katalogsync.RegisterQuery) (*
 // (2) the service has been removed from the agent services API
 // (3) the entry has been removed from the catalog API (meaning it synced to the cluster)
 func (d *Daemon) Deregister(ctx context.Context, in *katalogsync.DeregisterQuery) (*katalogsync.DeregisterResult, error) {
-	if err := d.doSync(ctx); err != nil {
+	k := podCacheKey(in.Namespace, in.PodName)
+	if _, err := d.doSync(ctx, k); err != nil {
 		return nil, err
 	}
 
-	k := podCacheKey(in.Namespace, in.PodName)
-	pod, ok := d.localK8sState[k]
-	if !ok {
-		return nil, fmt.Errorf("Unable to find pod with katalog-sync annotation (%s): %s", ConsulServiceNames, k)
+	if err := d.setSidecarState(k, "", false); err != nil {
+		return nil, err
 	}
 
-	if pod.SidecarState == nil {
-		return nil, fmt.Errorf("Pod is missing annotation %s for sidecar", SidecarName)
+	if _, err := d.doSync(ctx, k); err != nil {
+		return nil, err
 	}
 
-	pod.SidecarState.Ready = false
-
-	if err := d.doSync(ctx); err != nil {
-		return nil, err
+	pod, ok := d.state.Get(k)
+	if !ok {
+		return nil, fmt.Errorf("Unable to find pod with katalog-sync annotation (%s): %s", d.c.annotations().key(ConsulServiceNames), k)
 	}
 
 	if err := pod.SyncStatuses.GetError(); err != nil {
@@ -183,7 +311,7 @@ func (d *Daemon) Deregister(ctx context.Context, in *katalogsync.DeregisterQuery
 	}
 
 	// The goal here is to ensure that the deregistration has propogated to the rest of the cluster
-	nodeName, err := d.consulClient.Agent().NodeName()
+	nodeName, err := d.consulAgent.NodeName()
 	if err != nil {
 		return nil, err
 	}
@@ -192,17 +320,23 @@ func (d *Daemon) Deregister(ctx context.Context, in *katalogsync.DeregisterQuery
 	if err := d.ConsulNodeDoUntil(ctx, nodeName, opts, func(node *consulApi.CatalogNode) bool {
 		synced := true
 		for _, serviceName := range pod.GetServiceNames() {
-			// If the service exists, then we just need to update
-			if _, ok := node.Services[pod.GetServiceID(serviceName)]; ok {
-				status, _, err := d.consulClient.Agent().AgentHealthServiceByID(pod.GetServiceID(serviceName))
-				if err == nil {
-					// if health status is not fixed and is passing; not done
-					if pod.GetServiceHealth(serviceName, "") == "" && status == consulApi.HealthPassing {
+			serviceIDs := []string{pod.GetServiceID(serviceName)}
+			if pod.HasConnectProxy(serviceName) {
+				serviceIDs = append(serviceIDs, pod.GetConnectProxyServiceID(serviceName))
+			}
+			for _, serviceID := range serviceIDs {
+				// If the service exists, then we just need to update
+				if _, ok := node.Services[serviceID]; ok {
+					status, _, err := d.consulAgent.AgentHealthServiceByID(serviceID)
+					if err == nil {
+						// if health status is not fixed and is passing; not done
+						if pod.GetServiceHealth(serviceName, "") == "" && status == consulApi.HealthPassing {
+							synced = false
+						}
+					} else {
+						// if we got an error; assume it isn't synced
 						synced = false
 					}
-				} else {
-					// if we got an error; assume it isn't synced
-					synced = false
 				}
 			}
 		}
@@ -217,158 +351,603 @@ func (d *Daemon) Deregister(ctx context.Context, in *katalogsync.DeregisterQuery
 	return nil, fmt.Errorf("ready!: %v", pod.SyncStatuses.GetError())
 }
 
-func (d *Daemon) calculateSleepTime() time.Duration {
-	sleepDuration := d.c.MaxSyncInterval
-	for _, pod := range d.localK8sState {
-		if pod.SyncInterval < sleepDuration && pod.SyncInterval > d.c.MinSyncInterval {
-			sleepDuration = pod.SyncInterval
+// SetMaintenance handles a request to put the services of a pod (or a single
+// one of them) into or out of maintenance mode. This takes precedence over the
+// maintenance annotations and blocks until the change has been applied to the
+// agent.
+func (d *Daemon) SetMaintenance(ctx context.Context, in *katalogsync.SetMaintenanceQuery) (*katalogsync.SetMaintenanceResult, error) {
+	k := podCacheKey(in.Namespace, in.PodName)
+	var err error
+	found := d.state.Update(k, func(pod *Pod) {
+		if in.ServiceName != "" && !pod.HasServiceName(in.ServiceName) {
+			err = fmt.Errorf("Pod %s has no service %s", k, in.ServiceName)
+			return
 		}
+		pod.SetMaintenance(in.ServiceName, MaintenanceState{Enabled: in.Enable, Reason: in.Reason})
+	})
+	if !found {
+		return nil, fmt.Errorf("Unable to find pod with katalog-sync annotation (%s): %s", d.c.annotations().key(ConsulServiceNames), k)
 	}
-	return sleepDuration
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := d.doSync(ctx, k); err != nil {
+		return nil, err
+	}
+
+	pod, ok := d.state.Get(k)
+	if !ok {
+		return nil, fmt.Errorf("Unable to find pod with katalog-sync annotation (%s): %s", d.c.annotations().key(ConsulServiceNames), k)
+	}
+	if err := pod.SyncStatuses.GetError(); err != nil {
+		return nil, errors.Wrap(err, "Unable to sync status")
+	}
+
+	// The readiness gate reflects maintenance, so update it right away
+	if err := d.handleReadinessGate(k); err != nil {
+		logrus.Errorf("Error updating readiness gate of %s: %v", k, err)
+	}
+	return &katalogsync.SetMaintenanceResult{}, nil
 }
 
-// TODO: refactor into a start/stop/run job (so initial sync is done on start, and the rest in background goroutine)
+// setSidecarState updates the sidecar state of the pod stored under key. An
+// empty containerName leaves the sidecar's container name unchanged.
+func (d *Daemon) setSidecarState(key, containerName string, ready bool) error {
+	hasSidecar := false
+	sidecarKey := d.c.annotations().key(SidecarName)
+	found := d.state.Update(key, func(pod *Pod) {
+		if pod.SidecarState == nil {
+			sidecarKey = pod.annotations.key(SidecarName)
+			return
+		}
+		hasSidecar = true
+		if containerName != "" {
+			pod.SidecarState.SidecarName = containerName
+		}
+		pod.SidecarState.Ready = ready
+	})
+	if !found {
+		return fmt.Errorf("Unable to find pod with katalog-sync annotation (%s): %s", d.c.annotations().key(ConsulServiceNames), key)
+	}
+	if !hasSidecar {
+		return fmt.Errorf("Pod is missing annotation %s for sidecar", sidecarKey)
+	}
+	return nil
+}
+
+// podSyncInterval returns how frequently the given pod should be synced,
+// bounded by the daemon's MinSyncInterval and MaxSyncInterval
+func (d *Daemon) podSyncInterval(pod *Pod) time.Duration {
+	interval := pod.SyncInterval
+	if interval < d.c.MinSyncInterval {
+		interval = d.c.MinSyncInterval
+	}
+	if d.c.MaxSyncInterval > 0 && interval > d.c.MaxSyncInterval {
+		interval = d.c.MaxSyncInterval
+	}
+	return interval
+}
+
+// Start does the initial sync from the kubelet to consul and then starts the
+// sync loop in a background goroutine, which runs until Stop is called. Only
+// an invalid config fails the start; if the initial sync fails the sync loop
+// retries it.
+func (d *Daemon) Start(ctx context.Context) error {
+	if err := validateAddressSource(d.c.DefaultServiceAddress); err != nil {
+		return err
+	}
+	if err := validateClusterName(d.c.ClusterName, d.c.ClusterNameInServiceID); err != nil {
+		return err
+	}
+	if d.c.MaxDeregisterPercent < 0 || d.c.MaxDeregisterPercent > 100 {
+		return fmt.Errorf("max deregister percent must be between 0 and 100, is %d", d.c.MaxDeregisterPercent)
+	}
+	if after := d.c.DefaultDeregisterCriticalServiceAfter; after != 0 && after <= d.c.DefaultCheckTTL {
+		return fmt.Errorf("default deregister critical service after (%s) must be greater than the default check TTL (%s)", after, d.c.DefaultCheckTTL)
+	}
+	if err := validateAnnotationPrefix(d.c.AnnotationPrefix); err != nil {
+		return err
+	}
+	selection, err := newPodSelection(&d.c)
+	if err != nil {
+		return err
+	}
+	d.selection = selection
+
+	if d.configReporter != nil && !d.c.DryRun {
+		go d.reportConfigs()
+	}
+
+	// If a previous daemon put our services into maintenance on shutdown we
+	// need to bring them back before anything else
+	if err := d.clearShutdownMaintenance(); err != nil {
+		logrus.Errorf("Error clearing shutdown maintenance: %v", err)
+	}
+
+	// A failed initial sync is retried by the sync loop rather than failing
+	// the start, so a slow kubelet or agent during a rollout doesn't crash
+	// the daemon
+	lastFetch := time.Now()
+	if _, err := d.timedFetchK8s(ctx); err != nil {
+		logrus.Errorf("Initial sync from kubelet failed, retrying in %s: %v", d.c.KubeletSyncInterval, err)
+	} else {
+		d.initialSync()
+	}
+
+	close(d.startedCh)
+	go d.run(lastFetch)
+	return nil
+}
+
+// initialSync takes over what a previous daemon registered and then syncs all
+// pods to consul, once the pods have been fetched from the kubelet
+func (d *Daemon) initialSync() {
+	d.warmStarted = true
+	// Report (and reap) the services which were left critical, e.g. by a
+	// daemon which disappeared, before the first sync updates them
+	if err := d.reapCriticalServices(); err != nil {
+		logrus.Errorf("Error checking for critical services: %v", err)
+	}
+
+	// Take over what a previous daemon registered, before syncing over it
+	if err := d.warmStart(); err != nil {
+		logrus.Errorf("Error adopting services from the agent: %v", err)
+	}
+
+	started := time.Now()
+	err := d.timedSyncConsul(nil)
+	if err != nil {
+		logrus.Errorf("Initial sync to consul failed, retrying: %v", err)
+	}
+	d.completeSync(started, err)
+}
+
+// Stop stops the sync loop and then applies the configured ShutdownPolicy to
+// the services katalog-sync registered in the agent.
+func (d *Daemon) Stop(ctx context.Context) error {
+	d.stopOnce.Do(func() { close(d.stopCh) })
+	// Nothing to stop if Start failed
+	select {
+	case <-d.startedCh:
+	default:
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.doneCh:
+	}
+
+	return d.shutdown(ctx)
+}
+
+// Run starts the daemon and blocks until it has been stopped
 func (d *Daemon) Run() error {
+	if err := d.Start(context.Background()); err != nil {
+		return err
+	}
+	<-d.doneCh
+	return nil
+}
+
+// timedFetchK8s runs fetchK8s, recording metrics about the fetch
+func (d *Daemon) timedFetchK8s(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	changed, err := d.fetchK8s(ctx)
+	if err != nil {
+		k8sSyncCount.WithLabelValues("error").Inc()
+		k8sSyncSummary.WithLabelValues("error").Observe(time.Now().Sub(start).Seconds())
+		logrus.Errorf("Error fetching state from k8s: %v", err)
+	} else {
+		k8sSyncCount.WithLabelValues("success").Inc()
+		k8sSyncSummary.WithLabelValues("success").Observe(time.Now().Sub(start).Seconds())
+	}
+	return changed, err
+}
+
+// timedSyncConsul runs syncConsul, recording metrics about the sync
+func (d *Daemon) timedSyncConsul(keys map[string]struct{}) error {
+	start := time.Now()
+	err := d.syncConsul(keys)
+	if err != nil {
+		consulSyncCount.WithLabelValues("error").Inc()
+		consulSyncSummary.WithLabelValues("error").Observe(time.Now().Sub(start).Seconds())
+	} else {
+		consulSyncCount.WithLabelValues("success").Inc()
+		consulSyncSummary.WithLabelValues("success").Observe(time.Now().Sub(start).Seconds())
+	}
+	return err
+}
+
+// run is the background sync loop. Every pod is scheduled to be synced on its
+// own SyncInterval while fetches from the kubelet run on KubeletSyncInterval;
+// all work that is due at the same time is done in a single pass.
+func (d *Daemon) run(lastFetch time.Time) {
+	defer close(d.doneCh)
+
+	// Abort requests to the kubelet once we are stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	sched := newSchedule()
+	sched.Set(kubeletScheduleKey, lastFetch.Add(d.c.KubeletSyncInterval))
+	d.state.View(func(pods map[string]*Pod) {
+		for key, pod := range pods {
+			sched.Set(key, lastFetch.Add(d.podSyncInterval(pod)))
+		}
+	})
+
 	timer := time.NewTimer(0)
-	var lastRun time.Time
-
-	retChans := make([]chan error, 0)
-
-	doSync := func() error {
-		defer func() {
-			sleepTime := d.calculateSleepTime()
-			logrus.Infof("sleeping for %s", sleepTime)
-			timer = time.NewTimer(sleepTime)
-			lastRun = time.Now()
-		}()
-		// Load initial state from k8s
-		start := time.Now()
-		if err := d.fetchK8s(); err != nil {
-			k8sSyncCount.WithLabelValues("error").Inc()
-			k8sSyncSummary.WithLabelValues("error").Observe(time.Now().Sub(start).Seconds())
-			logrus.Errorf("Error fetching state from k8s: %v", err)
-		} else {
-			k8sSyncCount.WithLabelValues("success").Inc()
-			k8sSyncSummary.WithLabelValues("success").Observe(time.Now().Sub(start).Seconds())
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
 		}
+		if next, ok := sched.Next(); ok {
+			timer.Reset(time.Until(next))
+		}
+	}
+	resetTimer()
 
-		// Do initial sync
-		start = time.Now()
-		err := d.syncConsul()
-		if err != nil {
-			consulSyncCount.WithLabelValues("error").Inc()
-			consulSyncSummary.WithLabelValues("error").Observe(time.Now().Sub(start).Seconds())
-		} else {
-			consulSyncCount.WithLabelValues("success").Inc()
-			consulSyncSummary.WithLabelValues("success").Observe(time.Now().Sub(start).Seconds())
+	waiters := &syncWaiters{}
+
+	// Pod sources which push changes get a fetch as soon as a pod changed
+	var podChangesCh <-chan struct{}
+	if notifier, ok := d.k8sClient.(PodNotifier); ok {
+		podChangesCh = notifier.Changes()
+	}
+
+	// doSync does all the work that is currently due, returning the keys of
+	// the pods synced and whether the kubelet was fetched
+	doSync := func() (map[string]struct{}, bool, error) {
+		fetched := false
+		keys := make(map[string]struct{})
+		for _, key := range sched.PopDue(time.Now()) {
+			if key == kubeletScheduleKey {
+				// Load state from k8s; on error we still sync what we have to consul
+				changed, err := d.timedFetchK8s(ctx)
+				if err == nil && !d.warmStarted {
+					// The fetch in Start failed, so the initial sync is still due
+					d.initialSync()
+				}
+				fetched = true
+				lastFetch = time.Now()
+				sched.Set(kubeletScheduleKey, lastFetch.Add(d.c.KubeletSyncInterval))
+				// Any pods which changed (including new and removed ones) need a sync now
+				for _, k := range changed {
+					keys[k] = struct{}{}
+				}
+				continue
+			}
+			keys[key] = struct{}{}
 		}
-		return err
+		if len(keys) == 0 {
+			return keys, fetched, nil
+		}
+
+		err := d.timedSyncConsul(keys)
+
+		// Schedule the next sync of the pods we just synced
+		now := time.Now()
+		for key := range keys {
+			sched.Remove(key)
+		}
+		d.state.View(func(pods map[string]*Pod) {
+			for key := range keys {
+				if pod, ok := pods[key]; ok {
+					sched.Set(key, now.Add(d.podSyncInterval(pod)))
+				}
+			}
+		})
+		// Check on held back deregistrations once the guard's window passed
+		if until, ok := d.deregisterGuard.Until(d.c.DeregisterGuardWindow); ok {
+			sched.SetEarlier(deregisterGuardScheduleKey, until)
+		}
+		logrus.Debugf("Synced %d pods: %v", len(keys), err)
+		return keys, fetched, err
 	}
 
-	// Loop forever running the update job
+	// Loop until stopped running the update job
 	for {
 		select {
+		case <-d.stopCh:
+			timer.Stop()
+			// Stop any background waiters for pods
+			d.state.View(func(pods map[string]*Pod) {
+				for _, pod := range pods {
+					pod.Cancel()
+				}
+			})
+			return
+
 		// If the timer went off, then we need to do a sync
 		case <-timer.C:
 			start := time.Now()
-			err := doSync()
-			logrus.Infof("Sync completed in %s: %v", time.Now().Sub(start), err)
-			for _, ch := range retChans {
-				select {
-				case ch <- err:
-				default:
-				}
+			synced, fetched, err := doSync()
+			result := d.completeSync(start, err)
+			logrus.Debugf("Sync %d completed in %s: %v", result.Generation, result.Finished.Sub(start), err)
+			waiters.Complete(result, synced, fetched)
+			resetTimer()
+
+		// If we got a request on the syncCh then we need to add it to our
+		// list, and schedule the pod (and a kubelet fetch) to be synced
+		case req := <-d.syncCh:
+			waiters.Add(req)
+			due := lastFetch.Add(d.c.MinSyncInterval)
+			if now := time.Now(); due.Before(now) {
+				due = now
 			}
-			retChans = retChans[:]
-
-		// If we got a channel on the syncCh then we need to add it to our list
-		case ch := <-d.syncCh:
-			retChans = append(retChans, ch)
-			if time.Now().Sub(lastRun) > d.c.MinSyncInterval {
-				if !timer.Stop() {
-					<-timer.C
-				}
-				timer.Reset(0)
+			sched.SetEarlier(kubeletScheduleKey, due)
+			sched.Set(req.key, due)
+			resetTimer()
+
+		// If a pod changed fetch the pods now, which syncs the changed ones
+		case <-podChangesCh:
+			due := lastFetch.Add(d.c.MinSyncInterval)
+			if now := time.Now(); due.Before(now) {
+				due = now
 			}
+			sched.SetEarlier(kubeletScheduleKey, due)
+			resetTimer()
 		}
 	}
 }
 
-// fetchK8s is responsible for updating the local k8sState with what we pull
-// from our k8sClient
-func (d *Daemon) fetchK8s() error {
-	podList, err := d.k8sClient.GetPodList()
+// clearShutdownMaintenance takes any of our services out of the maintenance
+// mode which the "maintenance" ShutdownPolicy put them in.
+func (d *Daemon) clearShutdownMaintenance() error {
+	if d.c.DryRun {
+		return nil
+	}
+	checks, err := d.consulAgent.Checks()
+	if err != nil {
+		return err
+	}
+	services, err := d.consulAgent.Services()
 	if err != nil {
 		return err
 	}
 
-	// Add/Update the ones we have
-	newKeys := make(map[string]struct{})
-	for _, pod := range podList.Items {
-		// If the pod doesn't have a service-name defined, we don't touch it
-		if _, ok := pod.ObjectMeta.Annotations[ConsulServiceNames]; !ok {
+	for _, check := range checks {
+		if check.CheckID != consulServiceMaintenancePrefix+check.ServiceID || check.Notes != shutdownMaintenanceReason {
+			continue
+		}
+		if service, ok := services[check.ServiceID]; !ok || !d.ownsService(service) {
 			continue
 		}
+		if err := d.consulAgent.DisableServiceMaintenance(check.ServiceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdown applies the ShutdownPolicy to all services katalog-sync registered
+func (d *Daemon) shutdown(ctx context.Context) error {
+	if d.c.DryRun {
+		return nil
+	}
 
-		// If the pod isn't in the "Running" phase, we skip
-		if pod.Status.Phase != "Running" {
+	var apply func(service *consulApi.AgentService) error
+	switch d.c.ShutdownPolicy {
+	case "", ShutdownPolicyNone:
+		return nil
+	case ShutdownPolicyCritical:
+		apply = func(service *consulApi.AgentService) error {
+			return d.consulAgent.UpdateTTL(service.ID, shutdownMaintenanceReason, consulApi.HealthCritical)
+		}
+	case ShutdownPolicyMaintenance:
+		apply = func(service *consulApi.AgentService) error {
+			return d.consulAgent.EnableServiceMaintenance(service.ID, shutdownMaintenanceReason)
+		}
+	case ShutdownPolicyDeregister:
+		apply = func(service *consulApi.AgentService) error {
+			return d.consulAgent.ServiceDeregister(service.ID)
+		}
+	default:
+		return fmt.Errorf("unknown shutdown policy: %s", d.c.ShutdownPolicy)
+	}
+
+	consulServices, err := d.consulAgent.Services()
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, consulService := range consulServices {
+		// We skip all services we aren't syncing (in case others are also registering agent services)
+		if !d.ownsService(consulService) {
 			continue
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := apply(consulService); err != nil {
+			logrus.Errorf("Error applying shutdown policy %s to %s: %v", d.c.ShutdownPolicy, consulService.ID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
 
-		key := podCacheKey(pod.Namespace, pod.Name)
-		newKeys[key] = struct{}{}
-		if existingPod, ok := d.localK8sState[key]; ok {
-			existingPod.UpdatePod(pod)
-			existingPod.HandleReadinessGate()
-		} else {
-			p, err := NewPod(pod, &d.c)
-			if err != nil {
-				logrus.Errorf("error creating local state for pod: %v", err)
+// fetchK8s is responsible for updating the local k8sState with what we pull
+// from our k8sClient. It returns the keys of all pods which were added,
+// removed or changed.
+func (d *Daemon) fetchK8s(ctx context.Context) ([]string, error) {
+	podList, err := d.k8sClient.GetPodList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// keys of all the pods we are tracking after this fetch
+	var keys []string
+	var changed []string
+	var configs []PodConfig
+	d.state.Apply(func(pods map[string]*Pod) {
+		// Add/Update the ones we have
+		newKeys := make(map[string]struct{})
+		for _, pod := range podList.Items {
+			// If the pod doesn't define any services, we don't touch it
+			if !d.c.annotations().hasServices(pod) {
+				continue
+			}
+
+			// If the pod isn't in the "Running" phase, we skip
+			if pod.Status.Phase != "Running" {
+				continue
+			}
+
+			// Nor do we touch pods outside of the configured namespaces and selector
+			if !d.selection.Matches(&pod) {
+				continue
+			}
+
+			pod := pod
+			key := podCacheKey(pod.Namespace, pod.Name)
+			if existingPod, ok := pods[key]; ok {
+				if existingPod.UpdatePod(pod, &d.c) {
+					changed = append(changed, key)
+				}
+				if d.configReporter != nil {
+					configs = append(configs, PodConfig{Pod: &pod, Err: existingPod.ConfigError(&d.c)})
+				}
 			} else {
-				d.localK8sState[key] = p
+				p, err := NewPod(pod, &d.c)
+				if d.configReporter != nil {
+					config := PodConfig{Pod: &pod, Err: err}
+					if err == nil {
+						config.Err = p.ConfigError(&d.c)
+					}
+					configs = append(configs, config)
+				}
+				if err != nil {
+					logrus.Errorf("error creating local state for pod: %v", err)
+					continue
+				}
+				pods[key] = p
+				changed = append(changed, key)
 				// If there is an outstanding readinessGate we need to register a wait for remote syncing
-				if p.OutstandingReadinessGate {
-					go d.waitPod(p)
+				if p.OutstandingReadinessGate && !d.c.DryRun {
+					go d.waitPod(key, p)
 				}
-				// Create readiness gate
-				p.HandleReadinessGate()
+			}
+			newKeys[key] = struct{}{}
+			keys = append(keys, key)
+		}
+
+		// remove any local ones that don't exist anymore
+		for k, pod := range pods {
+			if _, ok := newKeys[k]; !ok {
+				pod.Cancel()
+				delete(pods, k)
+				changed = append(changed, k)
 			}
 		}
+	})
+	localPodsGauge.Set(float64(len(keys)))
+
+	// Readiness gates are handled outside of the store lock as they require
+	// calls to the k8s API
+	for _, key := range keys {
+		d.handleReadinessGate(key)
+	}
+	if d.configReporter != nil && !d.c.DryRun {
+		d.queueConfigs(configs)
 	}
 
-	// remove any local ones that don't exist anymore
-	for k, pod := range d.localK8sState {
-		if _, ok := newKeys[k]; !ok {
-			pod.Cancel()
-			delete(d.localK8sState, k)
+	return changed, nil
+}
+
+// queueConfigs hands configs to reportConfigs, replacing the configs it
+// hasn't picked up yet as they are outdated
+func (d *Daemon) queueConfigs(configs []PodConfig) {
+	for {
+		select {
+		case d.configsCh <- configs:
+			return
+		default:
+		}
+		select {
+		case <-d.configsCh:
+		default:
 		}
 	}
+}
 
-	return nil
+// reportConfigs reports the configs queued by fetchK8s until the daemon is
+// stopped, so slow calls to the apiserver don't hold up the sync loop
+func (d *Daemon) reportConfigs() {
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case configs := <-d.configsCh:
+			d.configReporter.ReportConfig(configs)
+		}
+	}
+}
+
+// handleReadinessGate updates the readiness gate for the pod stored under key
+func (d *Daemon) handleReadinessGate(key string) error {
+	if d.c.DryRun {
+		return nil
+	}
+	pod, ok := d.state.Get(key)
+	if !ok {
+		return nil
+	}
+	outstanding := pod.OutstandingReadinessGate
+	err := pod.HandleReadinessGate(d.k8sClientset)
+	// If the readiness gate was completed (or re-opened for maintenance),
+	// persist that so we can skip it on later passes
+	if pod.OutstandingReadinessGate != outstanding {
+		d.state.Update(key, func(p *Pod) {
+			p.OutstandingReadinessGate = pod.OutstandingReadinessGate
+		})
+	}
+	return err
 }
 
 // Background goroutine to wait for a pod to be ready in consul; once done set "InitialSyncDone"
-func (d *Daemon) waitPod(pod *Pod) {
+func (d *Daemon) waitPod(key string, livePod *Pod) {
 	syncedRemotely := false
-	changesCh := pod.WaitChanges()
+	changesCh := livePod.WaitChanges()
 	changesCh <- struct{}{} // Seed a single change
 	for {
 		// wait for a change in pod state or the pod to stop
 		select {
-		case <-pod.Ctx.Done():
+		case <-livePod.Ctx.Done():
 			return
 		case _, ok := <-changesCh:
 			// If the channel closed (we were too slow) we want to re-subscribe
 			if !ok {
-				changesCh = pod.WaitChanges()
+				changesCh = livePod.WaitChanges()
 				continue
 			}
 
 		}
+		pod, ok := d.state.Get(key)
+		if !ok {
+			return
+		}
+		// Pods adopted on a warm start were synced by a previous daemon
+		if pod.InitialSyncDone {
+			syncedRemotely = true
+		}
 		// If we haven't ensured the service is synced remotely; wait on that
 		if !syncedRemotely {
 			// The goal here is to ensure that the registration has propogated to the rest of the cluster
-			nodeName, err := d.consulClient.Agent().NodeName()
+			nodeName, err := d.consulAgent.NodeName()
 			if err != nil {
 				time.Sleep(time.Second) // TODO; exponential backoff
 				continue                // retry
@@ -377,9 +956,9 @@ func (d *Daemon) waitPod(pod *Pod) {
 			opts := &consulApi.QueryOptions{AllowStale: true, UseCache: true}
 			if err := d.ConsulNodeDoUntil(pod.Ctx, nodeName, opts, func(node *consulApi.CatalogNode) bool {
 				synced := true
-				for _, serviceName := range pod.GetServiceNames() {
+				for _, serviceID := range pod.GetServiceIDs() {
 					// If the service exists, then we just need to update
-					if _, ok := node.Services[pod.GetServiceID(serviceName)]; !ok {
+					if _, ok := node.Services[serviceID]; !ok {
 						synced = false
 					}
 				}
@@ -391,106 +970,98 @@ func (d *Daemon) waitPod(pod *Pod) {
 			syncedRemotely = true
 		}
 		if ready, _ := pod.Ready(); ready {
-			pod.InitialSyncDone = true
+			d.state.Update(key, func(p *Pod) {
+				p.InitialSyncDone = true
+			})
 			// trigger a handle of readiness gate to avoid the poll delay.
-			pod.HandleReadinessGate()
+			d.handleReadinessGate(key)
 			return
 		}
 	}
 }
 
-// syncConsul is responsible for syncing local state to consul
-func (d *Daemon) syncConsul() error {
+// syncConsul is responsible for syncing local state to consul. If keys is
+// non-nil only the pods with those keys are synced; services which don't
+// belong to any pod we know of are always cleaned up.
+func (d *Daemon) syncConsul(keys map[string]struct{}) error {
 	// Get services from consul
-	consulServices, err := d.consulClient.Agent().Services()
+	consulServices, err := d.consulAgent.Services()
 	if err != nil {
 		return err
 	}
-
-	// TODO: split out update, for now we'll just re-register it all
-	// Push/Update from local state
-	for _, pod := range d.localK8sState {
-		ready, containerReadiness := pod.Ready()
-
-		status := consulApi.HealthCritical
-		if ready {
-			status = consulApi.HealthPassing
+	consulChecks, err := d.consulAgent.Checks()
+	if err != nil {
+		return err
+	}
+	// Services of other clusters aren't ours to touch
+	owned := 0
+	for serviceID, consulService := range consulServices {
+		if !isSyncedService(consulService) {
+			continue
 		}
-
-		notesB, err := json.MarshalIndent(containerReadiness, "", "  ")
-		if err != nil {
-			panic(err)
+		if d.ownsService(consulService) {
+			owned++
+		} else {
+			delete(consulServices, serviceID)
 		}
+	}
+	now := time.Now()
+	d.criticalServices(consulServices, consulChecks)
 
-		for _, serviceName := range pod.GetServiceNames() {
-			// If the service exists, then we just need to update
-			if consulService, ok := consulServices[pod.GetServiceID(serviceName)]; ok && !pod.HasChange(consulService) {
-				// only call update if we are past halflife of last update
-				if pod.SyncStatuses.GetStatus(serviceName).LastUpdated.IsZero() || time.Now().Sub(pod.SyncStatuses.GetStatus(serviceName).LastUpdated) >= (pod.CheckTTL/2) {
-					// If the service already exists, just update the check
-					pod.SyncStatuses.GetStatus(serviceName).SetError(
-						d.consulClient.Agent().UpdateTTL(
-							pod.GetServiceID(serviceName), string(notesB), pod.GetServiceHealth(serviceName, status)))
-				}
-			} else {
-				// Define the base metadata that katalog-sync requires
-				meta := map[string]string{
-					"external-source":    "kubernetes",                                               // Define the source of this service; see https://github.com/hashicorp/consul/blob/fc1d9e5d78749edc55249e5e7c1a8f7a24add99d/website/source/docs/platform/k8s/service-sync.html.md#service-meta
-					ConsulSyncSourceName: ConsulSyncSourceValue,                                      // Mark this as katalog-sync so we know we generated this
-					ConsulK8sLinkName:    podCacheKey(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name), // which includes full path to this (ns, pod name, etc.)
-					ConsulK8sNamespace:   pod.ObjectMeta.Namespace,
-					ConsulK8sPod:         pod.ObjectMeta.Name,
-				}
-				// Add in any metadata that the pod annotations define
-				for k, v := range pod.GetServiceMeta(serviceName) {
-					if _, ok := meta[k]; !ok {
-						meta[k] = v
-					}
-				}
-				// Next we actually register the service with consul
-				pod.SyncStatuses.GetStatus(serviceName).SetError(d.consulClient.Agent().ServiceRegister(&consulApi.AgentServiceRegistration{
-					ID:      pod.GetServiceID(serviceName),
-					Name:    serviceName,
-					Port:    pod.GetPort(serviceName),
-					Address: pod.Status.PodIP,
-					Meta:    meta,
-					Tags:    pod.GetTags(serviceName),
-
-					Check: &consulApi.AgentServiceCheck{
-						CheckID: pod.GetServiceID(serviceName), // TODO: better name? -- the name cannot have `/` in it -- its used in the API query path
-						TTL:     pod.CheckTTL.String(),
-						Status:  pod.GetServiceHealth(serviceName, status), // Current status of check
-						Notes:   string(notesB),                            // Map of container->ready
-					},
-				}))
+	// Work off of a snapshot so RPC handlers aren't blocked on the sync
+	var localPods map[string]*Pod
+	if keys == nil {
+		localPods = d.state.Snapshot()
+	} else {
+		localPods = d.state.SnapshotKeys(keys)
+		// Only consider services belonging to the pods we are syncing, or
+		// to no pod at all
+		knownKeys := d.state.Keys()
+		for serviceID, consulService := range consulServices {
+			key := consulService.Meta[ConsulK8sLinkName]
+			if _, ok := keys[key]; ok {
+				continue
+			}
+			if _, ok := knownKeys[key]; ok {
+				delete(consulServices, serviceID)
 			}
 		}
 	}
 
-	// Delete old ones
-	for _, consulService := range consulServices {
-		// We skip all services we aren't syncing (in case others are also registering agent services)
-		if v, ok := consulService.Meta[ConsulSyncSourceName]; !ok || v != ConsulSyncSourceValue {
-			continue
-		}
-
-		// If the service exists, skip
-		if pod, ok := d.localK8sState[consulService.Meta[ConsulK8sLinkName]]; ok && pod.HasServiceName(consulService.Service) {
-			continue
+	// Keep syncing services registered before the cluster name was put in
+	// the service ID under their old ID, instead of re-registering them
+	for key, pod := range localPods {
+		if adopted := pod.adoptLegacyServiceIDs(consulServices); len(adopted) > 0 {
+			logrus.Infof("Adopted services %v of pod %s under their legacy service IDs", adopted, key)
+			d.state.Update(key, func(p *Pod) {
+				p.AdoptedServiceIDs = pod.AdoptedServiceIDs
+			})
 		}
+	}
 
-		if err := d.consulClient.Agent().ServiceDeregister(consulService.ID); err != nil {
-			return err
-		}
+	plan := PlanSync(localPods, consulServices, consulChecks, now)
+	d.guardDeregistrations(plan, owned, now)
+	d.lastPlan.Store(plan)
+	observePlan(plan, d.c.DryRun)
+	if d.c.DryRun {
+		return nil
 	}
 
-	return nil
+	return d.executePlan(plan)
+}
+
+// LastPlan returns the most recently calculated SyncPlan (nil if there hasn't been one)
+func (d *Daemon) LastPlan() *SyncPlan {
+	plan, _ := d.lastPlan.Load().(*SyncPlan)
+	return plan
 }
 
 type consulNodeFunc func(*consulApi.CatalogNode) bool
 
 // ConsulNodeDoUntil is a helper to wait until a change has propogated into the CatalogAPI
 func (d *Daemon) ConsulNodeDoUntil(ctx context.Context, nodeName string, opts *consulApi.QueryOptions, f consulNodeFunc) error {
+	// Ensure blocking queries are cancelled along with ctx
+	opts = opts.WithContext(ctx)
 	for {
 		// If the client is no longer waiting, lets stop checking
 		select {
@@ -498,11 +1069,15 @@ func (d *Daemon) ConsulNodeDoUntil(ctx context.Context, nodeName string, opts *c
 			return ctx.Err()
 		default:
 		}
-		node, m, err := d.consulClient.Catalog().Node(nodeName, opts)
+		node, m, err := d.consulCatalog.Node(nodeName, opts)
 		if err != nil {
 			return err
 		}
 		opts.WaitIndex = m.LastIndex
+		// If the node isn't in the catalog it has no services
+		if node == nil {
+			node = &consulApi.CatalogNode{}
+		}
 		if f(node) {
 			return nil
 		}
@@ -0,0 +1,451 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+	katalogsync "github.com/wish/katalog-sync/proto"
+	k8sApi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNodeName = "node1"
+	// IDs of the services of the basic/working and sidecar/working test pods
+	basicServiceID   = "katalog-sync_hw-service-name_hw_hw-7df6995f69-96wth"
+	sidecarServiceID = "katalog-sync_hw-service-name_hw_hw-6f596c7944-5q5t7"
+)
+
+func testDaemonConfig() DaemonConfig {
+	return DaemonConfig{
+		MinSyncInterval:     10 * time.Millisecond,
+		MaxSyncInterval:     100 * time.Millisecond,
+		DefaultSyncInterval: 50 * time.Millisecond,
+		KubeletSyncInterval: 20 * time.Millisecond,
+		// TTL checks are updated every half TTL, keep that short so readiness
+		// changes show up quickly (the TTL is raised for pods with a longer
+		// sync-interval annotation though)
+		DefaultCheckTTL: 100 * time.Millisecond,
+	}
+}
+
+// startTestDaemon starts a daemon syncing the kubelet into a fake consul,
+// stopping it when the test finishes
+func startTestDaemon(t *testing.T, c DaemonConfig, kubelet Kubelet, consul *consultest.Consul) *Daemon {
+	d := NewDaemon(c, kubelet, consul.Agent(), consul.Catalog())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("error starting daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		d.Stop(ctx)
+	})
+	return d
+}
+
+// checkStatus returns the status of the TTL check of the service, or "" if it doesn't exist
+func checkStatus(consul *consultest.Consul, serviceID string) string {
+	if check, ok := consul.AgentChecks()[serviceID]; ok {
+		return check.Status
+	}
+	return ""
+}
+
+// eventually fails the test if f doesn't return true within a few seconds
+func eventually(t *testing.T, msg string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDaemonSync(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	consul := consultest.New(testNodeName)
+
+	startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+
+	// Start does a full sync, so the services must be there already
+	services := consul.AgentServices()
+	if len(services) != 2 {
+		t.Fatalf("expected 2 services after start, have %d", len(services))
+	}
+	service, ok := services[basicServiceID]
+	if !ok {
+		t.Fatalf("service %s not registered", basicServiceID)
+	}
+	if service.Port != 8080 || service.Meta[ConsulSyncSourceName] != ConsulSyncSourceValue {
+		t.Fatalf("wrong service registered: %+v", service)
+	}
+	if s := checkStatus(consul, basicServiceID); s != consulApi.HealthPassing {
+		t.Fatalf("expected check to be passing, is %q", s)
+	}
+
+	// Services registered by others are left alone
+	if err := consul.Agent().ServiceRegister(&consulApi.AgentServiceRegistration{ID: "other", Name: "other"}); err != nil {
+		t.Fatalf("error registering service: %v", err)
+	}
+
+	// Removing the pod deregisters its services
+	kubelet.SetPods()
+	eventually(t, "services deregistered", func() bool {
+		services := consul.AgentServices()
+		_, ok := services["other"]
+		return len(services) == 1 && ok
+	})
+}
+
+func TestDaemonStartRetry(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	kubelet.SetError(fmt.Errorf("kubelet unavailable"))
+	consul := consultest.New(testNodeName)
+
+	// A failed initial sync doesn't fail the start, the sync loop retries it
+	startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+	if services := consul.AgentServices(); len(services) != 0 {
+		t.Fatalf("expected no services before the kubelet answered, have %d", len(services))
+	}
+	kubelet.SetError(nil)
+	eventually(t, "services registered", func() bool {
+		return len(consul.AgentServices()) == 2
+	})
+}
+
+func TestDaemonStopNotStarted(t *testing.T) {
+	consul := consultest.New(testNodeName)
+	c := testDaemonConfig()
+	c.MaxDeregisterPercent = 200
+	d := NewDaemon(c, &staticKubelet{}, consul.Agent(), consul.Catalog())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Start(ctx); err == nil {
+		t.Fatalf("expected the invalid config to fail the start")
+	}
+	// Stop returns right away, rather than waiting for the sync loop
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("error stopping daemon: %v", err)
+	}
+}
+
+func TestDaemonRegisterDeregister(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "sidecar/working"))
+	consul := consultest.New(testNodeName)
+	consul.PropagationDelay = 20 * time.Millisecond
+
+	d := startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The sidecar container is ready, so the pod starts out ready
+	if s := checkStatus(consul, sidecarServiceID); s != consulApi.HealthPassing {
+		t.Fatalf("expected check to be passing on start, is %q", s)
+	}
+
+	// Deregister only returns once the check is no longer passing; a service
+	// which hasn't reached the catalog yet counts as deregistered already
+	eventually(t, "service in catalog", func() bool {
+		_, ok := consul.CatalogServices()[sidecarServiceID]
+		return ok
+	})
+	if _, err := d.Deregister(ctx, &katalogsync.DeregisterQuery{Namespace: "hw", PodName: "hw-6f596c7944-5q5t7"}); err != nil {
+		t.Fatalf("error deregistering: %v", err)
+	}
+	if s := checkStatus(consul, sidecarServiceID); s != consulApi.HealthCritical {
+		t.Fatalf("expected check to be critical after deregister, is %q", s)
+	}
+
+	query := &katalogsync.RegisterQuery{Namespace: "hw", PodName: "hw-6f596c7944-5q5t7", ContainerName: "katalog-sync-sidecar"}
+	if _, err := d.Register(ctx, query); err != nil {
+		t.Fatalf("error registering: %v", err)
+	}
+	// Register only returns once the services are in the catalog
+	if _, ok := consul.CatalogServices()[sidecarServiceID]; !ok {
+		t.Fatalf("register returned before the service reached the catalog")
+	}
+	eventually(t, "check passing after register", func() bool {
+		return checkStatus(consul, sidecarServiceID) == consulApi.HealthPassing
+	})
+
+	// Requests for unknown pods fail
+	if _, err := d.Register(ctx, &katalogsync.RegisterQuery{Namespace: "hw", PodName: "missing"}); err == nil {
+		t.Fatalf("register of unknown pod succeeded")
+	}
+}
+
+func TestDaemonRegisterWithoutSidecar(t *testing.T) {
+	// The pod's annotations are under another prefix, without a sidecar
+	pod := loadTestPod(t, "basic/working")
+	annotations := make(map[string]string, len(pod.Annotations))
+	for k, v := range pod.Annotations {
+		annotations[strings.Replace(k, DefaultAnnotationPrefix, "katalog-sync.example.com/", 1)] = v
+	}
+	pod.Annotations = annotations
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(pod)
+	consul := consultest.New(testNodeName)
+	c := testDaemonConfig()
+	c.AnnotationPrefix = "katalog-sync.example.com/"
+
+	d := startTestDaemon(t, c, kubelet, consul)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := d.Register(ctx, &katalogsync.RegisterQuery{Namespace: pod.Namespace, PodName: pod.Name, ContainerName: "katalog-sync-sidecar"})
+	if err == nil || !strings.Contains(err.Error(), "katalog-sync.example.com/sidecar") {
+		t.Fatalf("expected an error naming the sidecar annotation under the prefix, got %v", err)
+	}
+}
+
+func TestDaemonReadinessGate(t *testing.T) {
+	pod := loadTestPod(t, "readinessGate/working")
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(pod)
+	consul := consultest.New(testNodeName)
+	clientset := fake.NewSimpleClientset(&pod)
+
+	d := NewDaemon(testDaemonConfig(), kubelet, consul.Agent(), consul.Catalog())
+	d.SetK8sClientset(clientset)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("error starting daemon: %v", err)
+	}
+	defer d.Stop(ctx)
+
+	// The readiness gate is set through the given clientset once the
+	// services reached the catalog
+	eventually(t, "readiness gate set", func() bool {
+		p, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		for _, condition := range p.Status.Conditions {
+			if condition.Type == ReadinessGateType {
+				return condition.Status == k8sApi.ConditionTrue
+			}
+		}
+		return false
+	})
+}
+
+func TestDaemonRegisterError(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "sidecar/working"))
+	consul := consultest.New(testNodeName)
+
+	d := startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+
+	// Wait for a failed check update to be recorded on the pod
+	consul.SetError("UpdateTTL", fmt.Errorf("agent unavailable"))
+	eventually(t, "sync error recorded", func() bool {
+		pod, _ := d.state.Get("hw/hw-6f596c7944-5q5t7")
+		return pod.SyncStatuses.GetError() != nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	query := &katalogsync.RegisterQuery{Namespace: "hw", PodName: "hw-6f596c7944-5q5t7", ContainerName: "katalog-sync-sidecar"}
+	_, err := d.Register(ctx, query)
+	if err == nil || !strings.Contains(err.Error(), "agent unavailable") {
+		t.Fatalf("expected agent error from register, got %v", err)
+	}
+
+	// Once the agent recovers so does the registration
+	consul.SetError("UpdateTTL", nil)
+	eventually(t, "sync error cleared", func() bool {
+		pod, _ := d.state.Get("hw/hw-6f596c7944-5q5t7")
+		return pod.SyncStatuses.GetError() == nil
+	})
+	if _, err := d.Register(ctx, query); err != nil {
+		t.Fatalf("error registering: %v", err)
+	}
+}
+
+func TestDaemonUnresolvablePort(t *testing.T) {
+	k8sPod := loadTestPod(t, "basic/working")
+	k8sPod.ObjectMeta.Annotations[ConsulServicePort] = "grpc"
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(k8sPod)
+	consul := consultest.New(testNodeName)
+
+	d := startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+
+	// Services whose port can't be resolved aren't registered, the error is
+	// recorded on the pod instead
+	if services := consul.AgentServices(); len(services) != 0 {
+		t.Fatalf("expected no services to be registered, have %d", len(services))
+	}
+	pod, _ := d.state.Get("hw/hw-7df6995f69-96wth")
+	if err := pod.SyncStatuses.GetError(); err == nil || !strings.Contains(err.Error(), `no container port named "grpc"`) {
+		t.Fatalf("expected port error recorded, got %v", err)
+	}
+
+	// Once the port resolves the services are registered
+	k8sPod = loadTestPod(t, "basic/working")
+	kubelet.SetPods(k8sPod)
+	eventually(t, "services registered", func() bool {
+		pod, _ := d.state.Get("hw/hw-7df6995f69-96wth")
+		return len(consul.AgentServices()) == 2 && pod.SyncStatuses.GetError() == nil
+	})
+}
+
+func TestDaemonPortResolvesAgain(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	consul := consultest.New(testNodeName)
+
+	// A long TTL, so the checks aren't updated on their own during the test
+	c := testDaemonConfig()
+	c.DefaultCheckTTL = time.Minute
+	d := startTestDaemon(t, c, kubelet, consul)
+
+	podError := func() error {
+		pod, _ := d.state.Get("hw/hw-7df6995f69-96wth")
+		return pod.SyncStatuses.GetError()
+	}
+
+	k8sPod := loadTestPod(t, "basic/working")
+	k8sPod.ObjectMeta.Annotations[ConsulServicePort] = "grpc"
+	kubelet.SetPods(k8sPod)
+	eventually(t, "port error recorded", func() bool { return podError() != nil })
+
+	// Fixing the port clears the error right away, the registered services
+	// only need their checks updated
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	eventually(t, "port error cleared", func() bool { return podError() == nil })
+	if services := consul.AgentServices(); len(services) != 2 {
+		t.Fatalf("expected 2 services, have %d", len(services))
+	}
+}
+
+func TestDaemonConcurrentRequests(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "sidecar/working"), loadTestPod(t, "basic/working"))
+	consul := consultest.New(testNodeName)
+
+	d := startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				var err error
+				if (i+j)%2 == 0 {
+					_, err = d.Register(ctx, &katalogsync.RegisterQuery{Namespace: "hw", PodName: "hw-6f596c7944-5q5t7", ContainerName: "katalog-sync-sidecar"})
+				} else {
+					_, err = d.Deregister(ctx, &katalogsync.DeregisterQuery{Namespace: "hw", PodName: "hw-6f596c7944-5q5t7"})
+				}
+				// Concurrent requests race each other for the sidecar state, so
+				// only the context running out is a failure
+				if ctx.Err() != nil {
+					t.Errorf("request didn't complete: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The pods not being hammered are unaffected
+	if s := checkStatus(consul, basicServiceID); s != consulApi.HealthPassing {
+		t.Fatalf("expected check to be passing, is %q", s)
+	}
+}
+
+func TestDaemonShutdownPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		check  func(t *testing.T, consul *consultest.Consul)
+	}{
+		{
+			policy: ShutdownPolicyNone,
+			check: func(t *testing.T, consul *consultest.Consul) {
+				if s := checkStatus(consul, basicServiceID); s != consulApi.HealthPassing {
+					t.Fatalf("expected check to be passing, is %q", s)
+				}
+			},
+		},
+		{
+			policy: ShutdownPolicyCritical,
+			check: func(t *testing.T, consul *consultest.Consul) {
+				if s := checkStatus(consul, basicServiceID); s != consulApi.HealthCritical {
+					t.Fatalf("expected check to be critical, is %q", s)
+				}
+			},
+		},
+		{
+			policy: ShutdownPolicyMaintenance,
+			check: func(t *testing.T, consul *consultest.Consul) {
+				check, ok := consul.AgentChecks()[consulServiceMaintenancePrefix+basicServiceID]
+				if !ok || check.Notes != shutdownMaintenanceReason {
+					t.Fatalf("expected service to be in maintenance, check: %+v", check)
+				}
+			},
+		},
+		{
+			policy: ShutdownPolicyDeregister,
+			check: func(t *testing.T, consul *consultest.Consul) {
+				if services := consul.AgentServices(); len(services) != 0 {
+					t.Fatalf("expected all services to be deregistered, have %d", len(services))
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			kubelet := &staticKubelet{}
+			kubelet.SetPods(loadTestPod(t, "basic/working"))
+			consul := consultest.New(testNodeName)
+
+			c := testDaemonConfig()
+			c.ShutdownPolicy = test.policy
+			d := NewDaemon(c, kubelet, consul.Agent(), consul.Catalog())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := d.Start(ctx); err != nil {
+				t.Fatalf("error starting daemon: %v", err)
+			}
+			if err := d.Stop(ctx); err != nil {
+				t.Fatalf("error stopping daemon: %v", err)
+			}
+			test.check(t, consul)
+
+			// Requests after stopping fail
+			if _, err := d.doSync(ctx, "hw/hw-7df6995f69-96wth"); err != ErrStopped {
+				t.Fatalf("expected ErrStopped, got %v", err)
+			}
+
+			// A restarted daemon takes the services out of maintenance again
+			if test.policy == ShutdownPolicyMaintenance {
+				startTestDaemon(t, c, kubelet, consul)
+				if _, ok := consul.AgentChecks()[consulServiceMaintenancePrefix+basicServiceID]; ok {
+					t.Fatalf("service still in maintenance after restart")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package daemon
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+// checkTypeTTL is the type the agent reports for TTL checks
+const checkTypeTTL = "ttl"
+
+// defaultWeights are the weights consul gives services registered without any
+var defaultWeights = consulApi.AgentWeights{Passing: 1, Warning: 1}
+
+// ttlCheckName returns the name of the TTL check of a service. The agent
+// doesn't return the TTL (or when to deregister critical services) of checks,
+// so we put it in the name to notice when it changes.
+func ttlCheckName(ttl, deregisterAfter time.Duration) string {
+	if deregisterAfter > 0 {
+		return fmt.Sprintf("katalog-sync readiness (ttl %s, deregister after %s)", ttl, deregisterAfter)
+	}
+	return fmt.Sprintf("katalog-sync readiness (ttl %s)", ttl)
+}
+
+// expectedRegistration returns the registration the pod defines for the
+// service with the given ID, nil if the pod doesn't define it
+func (p *Pod) expectedRegistration(serviceID string) *consulApi.AgentServiceRegistration {
+	for _, serviceName := range p.GetServiceNames() {
+		if p.GetServiceID(serviceName) == serviceID {
+			return p.Registration(serviceName, consulApi.HealthPassing, "")
+		}
+		if p.HasConnectProxy(serviceName) && p.GetConnectProxyServiceID(serviceName) == serviceID {
+			return p.ConnectProxyRegistration(serviceName, consulApi.HealthPassing, "")
+		}
+	}
+	return nil
+}
+
+// Diff returns the differences between the service registered in the agent
+// and what the pod defines for it, one "field: registered -> expected" entry
+// per differing field
+func (p *Pod) Diff(service *consulApi.AgentService) []string {
+	r := p.expectedRegistration(service.ID)
+	if r == nil {
+		return []string{"service: no longer defined"}
+	}
+	return registrationDiff(r, service)
+}
+
+// HasChange will return whether a change has been made that needs a full resync
+// if not then a simple TTL update will suffice
+func (p *Pod) HasChange(service *consulApi.AgentService) bool {
+	return len(p.Diff(service)) > 0
+}
+
+// registrationDiff compares a service registered in the agent to the
+// registration we'd make for it
+func registrationDiff(r *consulApi.AgentServiceRegistration, service *consulApi.AgentService) []string {
+	var diff []string
+	add := func(field string, registered, expected interface{}) {
+		diff = append(diff, fmt.Sprintf("%s: %v -> %v", field, registered, expected))
+	}
+
+	if service.Kind != r.Kind {
+		add("kind", service.Kind, r.Kind)
+	}
+	if service.Service != r.Name {
+		add("name", service.Service, r.Name)
+	}
+	if service.Port != r.Port {
+		add("port", service.Port, r.Port)
+	}
+	if service.Address != r.Address {
+		add("address", service.Address, r.Address)
+	}
+	if taggedAddressesChanged(service.TaggedAddresses, r.TaggedAddresses) {
+		add("tagged_addresses", service.TaggedAddresses, r.TaggedAddresses)
+	}
+	if !stringsEqual(service.Tags, r.Tags) {
+		add("tags", service.Tags, r.Tags)
+	}
+	if d := metaDiff(service.Meta, r.Meta); d != "" {
+		diff = append(diff, "meta: "+d)
+	}
+	weights := defaultWeights
+	if r.Weights != nil {
+		weights = *r.Weights
+	}
+	if service.Weights != weights {
+		add("weights", service.Weights, weights)
+	}
+	if service.EnableTagOverride != r.EnableTagOverride {
+		add("enable_tag_override", service.EnableTagOverride, r.EnableTagOverride)
+	}
+	native := service.Connect != nil && service.Connect.Native
+	expectedNative := r.Connect != nil && r.Connect.Native
+	if native != expectedNative {
+		add("connect_native", native, expectedNative)
+	}
+	if r.Proxy != nil {
+		diff = append(diff, proxyDiff(service.Proxy, r.Proxy)...)
+	}
+	return diff
+}
+
+// proxyDiff compares the registered connect proxy config to the expected one
+func proxyDiff(registered, expected *consulApi.AgentServiceConnectProxyConfig) []string {
+	if registered == nil {
+		return []string{"proxy: missing"}
+	}
+	var diff []string
+	if registered.DestinationServiceName != expected.DestinationServiceName {
+		diff = append(diff, fmt.Sprintf("proxy.destination_service_name: %s -> %s", registered.DestinationServiceName, expected.DestinationServiceName))
+	}
+	if registered.DestinationServiceID != expected.DestinationServiceID {
+		diff = append(diff, fmt.Sprintf("proxy.destination_service_id: %s -> %s", registered.DestinationServiceID, expected.DestinationServiceID))
+	}
+	if registered.LocalServiceAddress != expected.LocalServiceAddress {
+		diff = append(diff, fmt.Sprintf("proxy.local_service_address: %s -> %s", registered.LocalServiceAddress, expected.LocalServiceAddress))
+	}
+	if registered.LocalServicePort != expected.LocalServicePort {
+		diff = append(diff, fmt.Sprintf("proxy.local_service_port: %d -> %d", registered.LocalServicePort, expected.LocalServicePort))
+	}
+
+	upstreams := make([]string, 0, len(registered.Upstreams))
+	for _, upstream := range registered.Upstreams {
+		upstreams = append(upstreams, formatUpstream(upstream))
+	}
+	sort.Strings(upstreams)
+	expectedUpstreams := make([]string, 0, len(expected.Upstreams))
+	for _, upstream := range expected.Upstreams {
+		expectedUpstreams = append(expectedUpstreams, formatUpstream(upstream))
+	}
+	sort.Strings(expectedUpstreams)
+	if !stringsEqual(upstreams, expectedUpstreams) {
+		diff = append(diff, fmt.Sprintf("proxy.upstreams: %v -> %v", upstreams, expectedUpstreams))
+	}
+	return diff
+}
+
+// formatUpstream formats an upstream the way the connect-upstreams annotation does
+func formatUpstream(upstream consulApi.Upstream) string {
+	s := fmt.Sprintf("%s:%d", upstream.DestinationName, upstream.LocalBindPort)
+	if upstream.Datacenter != "" {
+		s += ":" + upstream.Datacenter
+	}
+	return s
+}
+
+// checkDiff compares the TTL check registered in the agent to the expected one
+func checkDiff(expected *consulApi.AgentServiceCheck, check *consulApi.AgentCheck) []string {
+	if check == nil {
+		return []string{"check: missing"}
+	}
+	var diff []string
+	if check.Type != checkTypeTTL {
+		diff = append(diff, fmt.Sprintf("check.type: %s -> %s", check.Type, checkTypeTTL))
+	}
+	if check.Name != expected.Name {
+		diff = append(diff, fmt.Sprintf("check.name: %s -> %s", check.Name, expected.Name))
+	}
+	return diff
+}
+
+// metaDiff describes the keys which differ between the registered and expected
+// meta, empty if they are the same
+func metaDiff(registered, expected map[string]string) string {
+	keys := make(map[string]struct{}, len(registered)+len(expected))
+	for k := range registered {
+		keys[k] = struct{}{}
+	}
+	for k := range expected {
+		keys[k] = struct{}{}
+	}
+	var changes []string
+	for k := range keys {
+		r, rOK := registered[k]
+		e, eOK := expected[k]
+		switch {
+		case !rOK:
+			changes = append(changes, fmt.Sprintf("+%s=%s", k, e))
+		case !eOK:
+			changes = append(changes, fmt.Sprintf("-%s=%s", k, r))
+		case r != e:
+			changes = append(changes, fmt.Sprintf("%s=%s -> %s", k, r, e))
+		}
+	}
+	sort.Strings(changes)
+	return strings.Join(changes, ", ")
+}
+
+// stringsEqual compares two string slices, treating nil and empty as equal
+func stringsEqual(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+)
+
+func TestDrift(t *testing.T) {
+	const key = "hw/hw-7df6995f69-96wth"
+	dc := &DaemonConfig{DefaultCheckTTL: 10 * time.Second}
+
+	tests := []struct {
+		name   string
+		modify func(r *consulApi.AgentServiceRegistration) // edit by hand in consul
+		pod    func(p *Pod)                                // edit of the pod
+		diff   []string
+	}{
+		{
+			name: "unchanged",
+		},
+		{
+			name:   "tags edited in consul",
+			modify: func(r *consulApi.AgentServiceRegistration) { r.Tags = []string{"a"} },
+			diff:   []string{"tags: [a] -> [a b]"},
+		},
+		{
+			name: "tags annotation changed",
+			pod:  func(p *Pod) { p.Pod.ObjectMeta.Annotations[ConsulServiceTags] = "a,b,c" },
+			diff: []string{"tags: [a b] -> [a b c]"},
+		},
+		{
+			name: "meta edited in consul",
+			modify: func(r *consulApi.AgentServiceRegistration) {
+				r.Meta["owner"] = "someone"
+				delete(r.Meta, ConsulK8sPod)
+				r.Meta[ConsulSyncSourceName] = "other"
+			},
+			diff: []string{"meta: +external-k8s-pod=hw-7df6995f69-96wth, -owner=someone, external-sync-source=other -> katalog-sync"},
+		},
+		{
+			name: "weights, name and tag override edited in consul",
+			modify: func(r *consulApi.AgentServiceRegistration) {
+				r.Name = "renamed"
+				r.Weights = &consulApi.AgentWeights{Passing: 10, Warning: 1}
+				r.EnableTagOverride = true
+			},
+			diff: []string{
+				"name: renamed -> hw-service-name",
+				"weights: {10 1} -> {1 1}",
+				"enable_tag_override: true -> false",
+			},
+		},
+		{
+			name: "check TTL changed",
+			pod: func(p *Pod) {
+				k8sPod := *p.Pod.DeepCopy()
+				k8sPod.ObjectMeta.Annotations[ConsulServiceCheckTTL] = "1m"
+				p.UpdatePod(k8sPod, dc)
+			},
+			diff: []string{"check.name: katalog-sync readiness (ttl 10s) -> katalog-sync readiness (ttl 1m0s)"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod, err := NewPod(loadTestPod(t, "basic/working"), dc)
+			if err != nil {
+				t.Fatalf("error creating pod: %v", err)
+			}
+			// only sync one of the services
+			pod.Pod.ObjectMeta.Annotations[ConsulServiceNames] = "hw-service-name"
+			pod.SyncStatuses.GetStatus("hw-service-name").LastUpdated = time.Now()
+
+			c := consultest.New("node")
+			r := pod.Registration("hw-service-name", consulApi.HealthPassing, "")
+			if test.modify != nil {
+				test.modify(r)
+			}
+			if err := c.Agent().ServiceRegister(r); err != nil {
+				t.Fatalf("error registering service: %v", err)
+			}
+			if test.pod != nil {
+				test.pod(pod)
+			}
+
+			services, checks := c.AgentServices(), c.AgentChecks()
+			plan := PlanSync(map[string]*Pod{key: pod}, services, checks, time.Now())
+
+			var diff []string
+			for _, action := range plan.Actions {
+				if action.Type == SyncActionReregister {
+					diff = append(diff, action.Diff...)
+				}
+			}
+			if !reflect.DeepEqual(diff, test.diff) {
+				t.Fatalf("Mismatch expected=%q actual=%q", test.diff, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	k8sApi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// ConfigValidConditionType is the pod condition reporting whether the
+// katalog-sync annotations of a pod are valid (under the default prefix)
+const ConfigValidConditionType = "katalog-sync.wish.com/config-valid"
+
+// Reasons of the events and conditions we put on pods
+const (
+	eventReasonInvalidConfig = "InvalidKatalogSyncConfig"
+	conditionReasonValid     = "Valid"
+	conditionReasonInvalid   = "InvalidAnnotations"
+)
+
+// EventReporterConfig holds the config options for reporting problems with
+// the annotations of pods in k8s
+type EventReporterConfig struct {
+	PodEvents            bool   `long:"pod-events" env:"POD_EVENTS" description:"emit k8s events on pods with invalid katalog-sync annotations"`
+	ConfigValidCondition bool   `long:"config-valid-condition" env:"CONFIG_VALID_CONDITION" description:"set the config-valid condition (under the annotation prefix) on pods with services"`
+	EventHost            string `long:"event-host" env:"EVENT_HOST" description:"host to report as the source of events, e.g. the node name"`
+}
+
+// Enabled returns whether anything should be reported
+func (c EventReporterConfig) Enabled() bool {
+	return c.PodEvents || c.ConfigValidCondition
+}
+
+// NewEventReporter returns a new EventReporter reporting through clientset,
+// with the condition type under the annotation prefix picked for each pod like
+// the daemon does
+func NewEventReporter(clientset kubernetes.Interface, c EventReporterConfig, annotationPrefix string, legacyAnnotations bool) *EventReporter {
+	// The broadcaster aggregates repeated events and rate-limits them per pod
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, k8sApi.EventSource{Component: "katalog-sync-daemon", Host: c.EventHost})
+	r := newEventReporter(clientset, recorder, c, annotations{prefix: annotationPrefix, legacy: legacyAnnotations})
+	r.stop = broadcaster.Shutdown
+	return r
+}
+
+// newEventReporter returns an EventReporter recording events with recorder
+// and patching pod conditions through clientset
+func newEventReporter(clientset kubernetes.Interface, recorder record.EventRecorder, c EventReporterConfig, a annotations) *EventReporter {
+	return &EventReporter{
+		c:           c,
+		annotations: a,
+		clientset:   clientset,
+		recorder:    recorder,
+		events:      make(map[types.UID]string),
+		conditions:  make(map[types.UID]string),
+		stop:        func() {},
+	}
+}
+
+// EventReporter is a ConfigReporter which emits k8s events on pods with
+// invalid annotations and optionally sets the ConfigValidConditionType
+// condition (under the annotation prefix) on pods. Each problem is only reported once per pod.
+type EventReporter struct {
+	c           EventReporterConfig
+	annotations annotations // where the condition type is put
+	clientset   kubernetes.Interface
+	recorder    record.EventRecorder
+	stop        func()
+
+	l sync.Mutex
+	// pod UID -> problem last reported for it, "" if none; tracked separately
+	// for events and conditions, as only setting the condition can fail
+	events     map[types.UID]string
+	conditions map[types.UID]string
+}
+
+// ReportConfig reports the problems which changed since the last call
+func (r *EventReporter) ReportConfig(configs []PodConfig) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	// Pods which are gone are forgotten
+	events := make(map[types.UID]string, len(configs))
+	conditions := make(map[types.UID]string, len(configs))
+	for _, config := range configs {
+		msg := ""
+		if config.Err != nil {
+			msg = config.Err.Error()
+		}
+
+		last, ok := r.events[config.Pod.UID]
+		events[config.Pod.UID] = msg
+		if r.c.PodEvents && config.Err != nil && (!ok || last != msg) {
+			r.recorder.Event(config.Pod, k8sApi.EventTypeWarning, eventReasonInvalidConfig, msg)
+		}
+
+		if !r.c.ConfigValidCondition {
+			continue
+		}
+		if last, ok := r.conditions[config.Pod.UID]; ok && last == msg {
+			conditions[config.Pod.UID] = msg
+			continue
+		}
+		if err := r.setCondition(config.Pod, config.Err); err != nil {
+			// try again on the next call
+			logrus.Errorf("Unable to set %s condition on %s: %v", r.conditionType(config.Pod), podCacheKey(config.Pod.Namespace, config.Pod.Name), err)
+			continue
+		}
+		conditions[config.Pod.UID] = msg
+	}
+	r.events = events
+	r.conditions = conditions
+}
+
+// conditionType returns the type of the config-valid condition of the pod
+func (r *EventReporter) conditionType(pod *k8sApi.Pod) string {
+	return r.annotations.forPod(pod.ObjectMeta.Annotations).key(ConfigValidConditionType)
+}
+
+// setCondition sets the config-valid condition of the pod, unless
+// it already is
+func (r *EventReporter) setCondition(pod *k8sApi.Pod, configErr error) error {
+	condition := k8sApi.PodCondition{
+		Type:    k8sApi.PodConditionType(r.conditionType(pod)),
+		Status:  k8sApi.ConditionTrue,
+		Reason:  conditionReasonValid,
+		Message: "katalog-sync annotations are valid",
+	}
+	if configErr != nil {
+		condition.Status = k8sApi.ConditionFalse
+		condition.Reason = conditionReasonInvalid
+		condition.Message = configErr.Error()
+	}
+
+	condition.LastTransitionTime = metav1.Now()
+	for _, existing := range pod.Status.Conditions {
+		if existing.Type != condition.Type || existing.Status != condition.Status {
+			continue
+		}
+		if existing.Message == condition.Message {
+			return nil
+		}
+		condition.LastTransitionTime = existing.LastTransitionTime
+	}
+
+	patch, err := buildPodConditionPatch(pod, condition)
+	if err != nil {
+		return err
+	}
+	if _, err := r.clientset.CoreV1().Pods(pod.Namespace).Patch(context.TODO(), pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status"); err != nil {
+		return fmt.Errorf("error patching pod: %v", err)
+	}
+	return nil
+}
+
+// Stop stops sending events
+func (r *EventReporter) Stop() {
+	r.stop()
+}
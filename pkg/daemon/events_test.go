@@ -0,0 +1,228 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+	k8sApi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+// configCondition returns the ConfigValidConditionType condition of the pod
+func configCondition(t *testing.T, clientset *fake.Clientset, pod *k8sApi.Pod) *k8sApi.PodCondition {
+	return podCondition(t, clientset, pod, ConfigValidConditionType)
+}
+
+// podCondition returns the condition of the pod with the given type
+func podCondition(t *testing.T, clientset *fake.Clientset, pod *k8sApi.Pod, conditionType string) *k8sApi.PodCondition {
+	p, err := clientset.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting pod: %v", err)
+	}
+	for _, condition := range p.Status.Conditions {
+		if condition.Type == k8sApi.PodConditionType(conditionType) {
+			return &condition
+		}
+	}
+	return nil
+}
+
+func TestEventReporter(t *testing.T) {
+	pod := loadTestPod(t, "basic/working")
+	clientset := fake.NewSimpleClientset(&pod)
+	recorder := record.NewFakeRecorder(10)
+	r := newEventReporter(clientset, recorder, EventReporterConfig{PodEvents: true, ConfigValidCondition: true}, annotations{})
+
+	// Problems are reported once
+	invalid := []PodConfig{{Pod: &pod, Err: fmt.Errorf("bad port")}}
+	r.ReportConfig(invalid)
+	r.ReportConfig(invalid)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+	}
+	if event := <-recorder.Events; event != "Warning InvalidKatalogSyncConfig bad port" {
+		t.Fatalf("unexpected event: %s", event)
+	}
+	if condition := configCondition(t, clientset, &pod); condition == nil || condition.Status != k8sApi.ConditionFalse || condition.Message != "bad port" {
+		t.Fatalf("unexpected condition: %+v", condition)
+	}
+
+	// Fixing the annotations sets the condition again, without an event
+	r.ReportConfig([]PodConfig{{Pod: &pod}})
+	if len(recorder.Events) != 0 {
+		t.Fatalf("unexpected event: %s", <-recorder.Events)
+	}
+	if condition := configCondition(t, clientset, &pod); condition == nil || condition.Status != k8sApi.ConditionTrue {
+		t.Fatalf("unexpected condition: %+v", condition)
+	}
+
+	// Pods which are gone are forgotten, so the problem is reported again
+	r.ReportConfig(nil)
+	r.ReportConfig(invalid)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+	}
+}
+
+func TestEventReporterConditionRetry(t *testing.T) {
+	pod := loadTestPod(t, "basic/working")
+	clientset := fake.NewSimpleClientset(&pod)
+	recorder := record.NewFakeRecorder(10)
+	r := newEventReporter(clientset, recorder, EventReporterConfig{PodEvents: true, ConfigValidCondition: true}, annotations{})
+
+	patches := 0
+	failing := true
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if failing {
+			return true, nil, fmt.Errorf("apiserver unavailable")
+		}
+		return false, nil, nil
+	})
+
+	// Setting the condition is retried, without emitting the event again
+	invalid := []PodConfig{{Pod: &pod, Err: fmt.Errorf("bad port")}}
+	r.ReportConfig(invalid)
+	r.ReportConfig(invalid)
+	if len(recorder.Events) != 1 || patches != 2 {
+		t.Fatalf("expected 1 event and 2 patches, got %d and %d", len(recorder.Events), patches)
+	}
+
+	failing = false
+	r.ReportConfig(invalid)
+	r.ReportConfig(invalid)
+	if len(recorder.Events) != 1 || patches != 3 {
+		t.Fatalf("expected 1 event and 3 patches, got %d and %d", len(recorder.Events), patches)
+	}
+	if condition := configCondition(t, clientset, &pod); condition == nil || condition.Status != k8sApi.ConditionFalse {
+		t.Fatalf("unexpected condition: %+v", condition)
+	}
+}
+
+func TestEventReporterLegacyConditionType(t *testing.T) {
+	// One pod still annotated under the default prefix, one moved already
+	legacy := loadTestPod(t, "basic/working")
+	moved := loadTestPod(t, "basic/working")
+	moved.Name, moved.UID = "moved", "moved"
+	moved.Annotations = map[string]string{"dc2.example.com/service-names": "a"}
+	clientset := fake.NewSimpleClientset(&legacy, &moved)
+	r := newEventReporter(clientset, record.NewFakeRecorder(10), EventReporterConfig{ConfigValidCondition: true}, annotations{prefix: "dc2.example.com/", legacy: true})
+
+	// The condition type follows the prefix picked for the pod
+	r.ReportConfig([]PodConfig{{Pod: &legacy}, {Pod: &moved}})
+	if podCondition(t, clientset, &legacy, ConfigValidConditionType) == nil || podCondition(t, clientset, &legacy, "dc2.example.com/config-valid") != nil {
+		t.Fatalf("expected the condition under the default prefix on the legacy pod")
+	}
+	if podCondition(t, clientset, &moved, "dc2.example.com/config-valid") == nil || podCondition(t, clientset, &moved, ConfigValidConditionType) != nil {
+		t.Fatalf("expected the condition under the prefix on the moved pod")
+	}
+}
+
+// recordingReporter is a ConfigReporter keeping the last reported configs
+type recordingReporter struct {
+	l       sync.Mutex
+	configs []PodConfig
+	calls   int
+}
+
+func (r *recordingReporter) ReportConfig(configs []PodConfig) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.configs = configs
+	r.calls++
+}
+
+func (r *recordingReporter) Configs() []PodConfig {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.configs
+}
+
+func (r *recordingReporter) Calls() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.calls
+}
+
+func TestDaemonConfigReporter(t *testing.T) {
+	valid := loadTestPod(t, "basic/working")
+	invalid := loadTestPod(t, "sidecar/working")
+	invalid.ObjectMeta.Annotations[SyncInterval] = "often"
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(valid, invalid)
+	consul := consultest.New(testNodeName)
+	reporter := &recordingReporter{}
+
+	d := NewDaemon(testDaemonConfig(), kubelet, consul.Agent(), consul.Catalog())
+	d.SetConfigReporter(reporter)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("error starting daemon: %v", err)
+	}
+	defer d.Stop(ctx)
+
+	// Pods rejected by NewPod are reported as well as the ones we sync
+	eventually(t, "configs reported", func() bool {
+		configs := reporter.Configs()
+		return len(configs) == 2 && configs[0].Err == nil && configs[1].Err != nil && strings.Contains(configs[1].Err.Error(), "often")
+	})
+
+	// Annotations changed after the pod was created are checked again
+	valid.ObjectMeta.Annotations[ConsulServiceHealth] = "fine"
+	kubelet.SetPods(valid, invalid)
+	eventually(t, "invalid health reported", func() bool {
+		configs := reporter.Configs()
+		return len(configs) == 2 && configs[0].Err != nil && strings.Contains(configs[0].Err.Error(), "fine")
+	})
+}
+
+// blockingReporter is a ConfigReporter blocking until it is released
+type blockingReporter struct {
+	recordingReporter
+	releaseCh chan struct{}
+}
+
+func (r *blockingReporter) ReportConfig(configs []PodConfig) {
+	<-r.releaseCh
+	r.recordingReporter.ReportConfig(configs)
+}
+
+func TestDaemonConfigReporterAsync(t *testing.T) {
+	pod := loadTestPod(t, "basic/working")
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(pod)
+	consul := consultest.New(testNodeName)
+	reporter := &blockingReporter{releaseCh: make(chan struct{})}
+
+	d := NewDaemon(testDaemonConfig(), kubelet, consul.Agent(), consul.Catalog())
+	d.SetConfigReporter(reporter)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("error starting daemon: %v", err)
+	}
+	defer d.Stop(ctx)
+
+	// A stuck reporter doesn't hold up the syncs
+	kubelet.SetPods()
+	eventually(t, "pod deregistered", func() bool {
+		services, _ := consul.Agent().Services()
+		return len(services) == 0
+	})
+
+	// Once it catches up the latest configs are reported
+	close(reporter.releaseCh)
+	eventually(t, "latest configs reported", func() bool {
+		return reporter.Calls() >= 2 && len(reporter.Configs()) == 0
+	})
+}
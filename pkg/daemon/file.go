@@ -0,0 +1,220 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	k8sApi "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// FilePodSourcePrefix is the prefix of pod sources reading pods from a file or directory
+const FilePodSourcePrefix = "file://"
+
+// FileClientConfig holds the config options for reading pods from disk
+type FileClientConfig struct {
+	PollInterval time.Duration `long:"file-poll-interval" env:"FILE_POLL_INTERVAL" description:"how frequently to check the pod file or directory for changes; changes are synced within this interval" default:"1s"`
+	HostIP       string        `long:"file-host-ip" env:"FILE_HOST_IP" description:"host IP of pods read from disk without a status, e.g. static pod manifests; such pods must use the host network"`
+}
+
+// NewFileClient returns a new FileClient reading the pods from the file or
+// directory at path
+func NewFileClient(path string, c FileClientConfig) (*FileClient, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &FileClient{
+		c:       c,
+		path:    path,
+		changes: make(chan struct{}, 1),
+	}, nil
+}
+
+// FileClient is a pod source reading a PodList (e.g. a dump of the kubelet's
+// /pods), a single pod or a directory of pod manifests (like the kubelet's
+// static pod directory) in JSON or YAML from disk. It implements the Kubelet
+// and PodNotifier interfaces.
+type FileClient struct {
+	c       FileClientConfig
+	path    string
+	changes chan struct{}
+}
+
+// Start polls the files for changes until stopCh is closed
+func (k *FileClient) Start(stopCh <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(k.c.PollInterval)
+		defer ticker.Stop()
+		last, _ := k.fingerprint()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			fingerprint, err := k.fingerprint()
+			if err != nil {
+				logrus.Errorf("Error checking %s for changes: %v", k.path, err)
+				continue
+			}
+			if fingerprint == last {
+				continue
+			}
+			last = fingerprint
+			// A pending notification covers this change as well
+			select {
+			case k.changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// Changes returns a channel signalled whenever the files changed
+func (k *FileClient) Changes() <-chan struct{} {
+	return k.changes
+}
+
+// files returns the files to read pods from
+func (k *FileClient) files() ([]string, error) {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{k.path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(k.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		// Skip hidden files, like the kubelet does for static pods
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".json", ".yaml", ".yml":
+			files = append(files, filepath.Join(k.path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// fingerprint returns a string which changes whenever the files do
+func (k *FileClient) fingerprint() (string, error) {
+	files, err := k.files()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// GetPodList returns the pods of all the files
+func (k *FileClient) GetPodList(ctx context.Context) (*k8sApi.PodList, error) {
+	files, err := k.files()
+	if err != nil {
+		return nil, err
+	}
+
+	podList := &k8sApi.PodList{}
+	for _, file := range files {
+		pods, err := k.readPods(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading pods from %s: %v", file, err)
+		}
+		podList.Items = append(podList.Items, pods...)
+	}
+	return podList, nil
+}
+
+// readPods reads a PodList or a single pod from file
+func (k *FileClient) readPods(file string) ([]k8sApi.Pod, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON
+	b, err = yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var typeMeta struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(b, &typeMeta); err != nil {
+		return nil, err
+	}
+
+	var pods []k8sApi.Pod
+	switch typeMeta.Kind {
+	case "PodList", "List":
+		var podList k8sApi.PodList
+		if err := json.Unmarshal(b, &podList); err != nil {
+			return nil, err
+		}
+		pods = podList.Items
+	case "Pod", "":
+		var pod k8sApi.Pod
+		if err := json.Unmarshal(b, &pod); err != nil {
+			return nil, err
+		}
+		pods = []k8sApi.Pod{pod}
+	default:
+		return nil, fmt.Errorf("unsupported kind %s", typeMeta.Kind)
+	}
+
+	for i := range pods {
+		if err := k.defaultPod(&pods[i]); err != nil {
+			return nil, err
+		}
+	}
+	return pods, nil
+}
+
+// defaultPod fills in what manifests don't define: pods without a status are
+// running with all of their containers ready, on the host IP. As the IP of a
+// pod outside of the host network is only known from its status, such pods
+// must have one.
+func (k *FileClient) defaultPod(pod *k8sApi.Pod) error {
+	if pod.Namespace == "" {
+		pod.Namespace = "default"
+	}
+	if pod.Status.Phase != "" {
+		return nil
+	}
+	if !pod.Spec.HostNetwork {
+		return fmt.Errorf("pod %s/%s has no status and doesn't use the host network, so its IP is unknown: add its status (e.g. from the mirror pod) with the podIP", pod.Namespace, pod.Name)
+	}
+
+	pod.Status.Phase = k8sApi.PodRunning
+	pod.Status.HostIP = k.c.HostIP
+	pod.Status.PodIP = k.c.HostIP
+	for _, container := range pod.Spec.Containers {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, k8sApi.ContainerStatus{
+			Name:  container.Name,
+			Ready: true,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	k8sApi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const staticPodManifest = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: etcd
+  namespace: kube-system
+  annotations:
+    katalog-sync.wish.com/service-names: etcd
+    katalog-sync.wish.com/service-port: "2379"
+spec:
+  hostNetwork: true
+  containers:
+  - name: etcd
+    image: etcd
+`
+
+func TestFileClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katalog-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A dump of the kubelet's /pods, a static pod manifest and files to skip
+	b, err := json.Marshal(k8sApi.PodList{
+		TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+		Items:    []k8sApi.Pod{loadTestPod(t, "basic/working"), loadTestPod(t, "sidecar/working")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"pods.json":    string(b),
+		"etcd.yaml":    staticPodManifest,
+		".hidden.yaml": "invalid",
+		"README.md":    "invalid",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := NewFileClient(dir, FileClientConfig{PollInterval: 10 * time.Millisecond, HostIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	podList, err := client.GetPodList(context.Background())
+	if err != nil {
+		t.Fatalf("error getting pods: %v", err)
+	}
+	if len(podList.Items) != 3 {
+		t.Fatalf("expected 3 pods, got %d", len(podList.Items))
+	}
+
+	// Pods without a status are running and ready on the host IP
+	etcd := podList.Items[0]
+	pod, err := NewPod(etcd, &DaemonConfig{DefaultServiceAddress: "podIP"})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	if ready, _ := pod.Ready(); etcd.Name != "etcd" || etcd.Status.Phase != k8sApi.PodRunning || !ready || pod.GetServiceAddress("etcd") != "10.0.0.1" {
+		t.Fatalf("unexpected static pod: %+v", etcd)
+	}
+	// Pods with a status are taken as-is
+	if podList.Items[1].Status.PodIP != loadTestPod(t, "basic/working").Status.PodIP {
+		t.Fatalf("unexpected pod: %+v", podList.Items[1])
+	}
+
+	// Changes to the files are signalled
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	client.Start(stopCh)
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-client.Changes():
+		t.Fatalf("change signalled without changes")
+	default:
+	}
+	if err := os.Remove(filepath.Join(dir, "etcd.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.Changes():
+	case <-time.After(time.Second):
+		t.Fatalf("change not signalled")
+	}
+	if podList, err := client.GetPodList(context.Background()); err != nil || len(podList.Items) != 2 {
+		t.Fatalf("expected 2 pods after removing the manifest, got %v: %v", podList, err)
+	}
+
+	// Pods without a status outside of the host network have no IP
+	noStatus := filepath.Join(dir, "no-status.yaml")
+	if err := ioutil.WriteFile(noStatus, []byte(strings.Replace(staticPodManifest, "hostNetwork: true", "hostNetwork: false", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetPodList(context.Background()); err == nil {
+		t.Fatalf("expected an error for a pod without a status outside of the host network")
+	}
+	if err := os.Remove(noStatus); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single file works as well
+	client, err = NewFileClient(filepath.Join(dir, "pods.json"), FileClientConfig{})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if podList, err := client.GetPodList(context.Background()); err != nil || len(podList.Items) != 2 {
+		t.Fatalf("expected 2 pods from the file, got %v: %v", podList, err)
+	}
+}
@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"time"
+)
+
+// SyncResult is the outcome of a single pass of the daemon's sync loop
+type SyncResult struct {
+	// Generation is a monotonically increasing number identifying the pass;
+	// 0 means no sync has completed yet
+	Generation uint64
+	Started    time.Time
+	Finished   time.Time
+	Err        error
+}
+
+// syncRequest is a request for an on-demand sync of a single pod
+type syncRequest struct {
+	key     string // key of the pod to sync
+	ch      chan SyncResult
+	fetched bool // whether the kubelet has been fetched since the request
+}
+
+// syncWaiters tracks the outstanding sync requests of the sync loop. Requests
+// are only ever added between passes, so any pass which completes a request
+// started after the request was made. syncWaiters is not safe for concurrent
+// use.
+type syncWaiters struct {
+	pending []*syncRequest
+}
+
+// Add adds a request to be completed by a later pass
+func (w *syncWaiters) Add(req *syncRequest) {
+	w.pending = append(w.pending, req)
+}
+
+// Len returns the number of outstanding requests
+func (w *syncWaiters) Len() int {
+	return len(w.pending)
+}
+
+// Complete notifies all requests which were satisfied by the pass described
+// by result; that is requests whose pod was synced in (or after) a pass which
+// fetched from the kubelet. Multiple requests for the same pod are coalesced
+// into the same pass.
+func (w *syncWaiters) Complete(result SyncResult, synced map[string]struct{}, fetched bool) {
+	pending := w.pending[:0]
+	for _, req := range w.pending {
+		req.fetched = req.fetched || fetched
+		if _, ok := synced[req.key]; ok && req.fetched {
+			req.ch <- result
+			continue
+		}
+		pending = append(pending, req)
+	}
+	// clear out the tail so we don't hold on to completed requests
+	for i := len(pending); i < len(w.pending); i++ {
+		w.pending[i] = nil
+	}
+	w.pending = pending
+}
@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSyncWaiters(t *testing.T) {
+	w := &syncWaiters{}
+	newRequest := func(key string) *syncRequest {
+		req := &syncRequest{key: key, ch: make(chan SyncResult, 1)}
+		w.Add(req)
+		return req
+	}
+	// result returns the generation the request was completed with, 0 if it is still pending
+	result := func(req *syncRequest) uint64 {
+		select {
+		case r := <-req.ch:
+			return r.Generation
+		default:
+			return 0
+		}
+	}
+	keys := func(keys ...string) map[string]struct{} {
+		m := make(map[string]struct{}, len(keys))
+		for _, k := range keys {
+			m[k] = struct{}{}
+		}
+		return m
+	}
+
+	a1 := newRequest("ns/a")
+	a2 := newRequest("ns/a")
+	b := newRequest("ns/b")
+
+	// A sync of a without a kubelet fetch doesn't satisfy anyone
+	w.Complete(SyncResult{Generation: 1}, keys("ns/a"), false)
+	if r := result(a1); r != 0 {
+		t.Fatalf("request completed without a fetch by generation %d", r)
+	}
+
+	// Both requests for a are coalesced into the same sync
+	w.Complete(SyncResult{Generation: 2}, keys("ns/a"), true)
+	if r1, r2 := result(a1), result(a2); r1 != 2 || r2 != 2 {
+		t.Fatalf("requests for a completed with generations %d %d", r1, r2)
+	}
+	if r := result(b); r != 0 {
+		t.Fatalf("request for b completed by a sync of a: %d", r)
+	}
+
+	// b has seen a fetch already, so a sync of b alone completes it
+	c := newRequest("ns/c")
+	w.Complete(SyncResult{Generation: 3, Err: fmt.Errorf("failed")}, keys("ns/b", "ns/c"), false)
+	if r := result(b); r != 3 {
+		t.Fatalf("request for b completed with generation %d", r)
+	}
+	if r := result(c); r != 0 {
+		t.Fatalf("request for c completed without a fetch by generation %d", r)
+	}
+	if w.Len() != 1 {
+		t.Fatalf("expected 1 pending request, have %d", w.Len())
+	}
+}
+
+func TestCompleteSync(t *testing.T) {
+	d := NewDaemon(DaemonConfig{}, nil, nil, nil)
+	if g := d.LastSync().Generation; g != 0 {
+		t.Fatalf("new daemon has generation %d", g)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		started := time.Now()
+		result := d.completeSync(started, nil)
+		if result.Generation != i || d.LastSync().Generation != i {
+			t.Fatalf("expected generation %d, got %d", i, result.Generation)
+		}
+		if result.Finished.Before(started) {
+			t.Fatalf("sync finished before it started")
+		}
+	}
+}
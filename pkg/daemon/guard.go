@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var heldDeregistrationsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "katalog_sync_held_deregistrations",
+	Help: "How many deregistrations are held back by the mass-deregistration guard",
+})
+
+func init() {
+	prometheus.MustRegister(heldDeregistrationsGauge)
+}
+
+// deregisterGuard holds back deregistrations if a sync would remove a large
+// part of our services at once (e.g. because the kubelet returned an empty or
+// truncated pod list), until they have been planned for a confirmation window
+type deregisterGuard struct {
+	since time.Time           // when we started holding
+	held  map[string]struct{} // IDs of the services held back
+}
+
+// Until returns when the deregistrations held back will be applied if they
+// stay planned, false if none are held
+func (g *deregisterGuard) Until(window time.Duration) (time.Time, bool) {
+	if g.held == nil {
+		return time.Time{}, false
+	}
+	return g.since.Add(window), true
+}
+
+// massDeregistration returns whether deregistering n of the owned services
+// exceeds the configured limits
+func (c *DaemonConfig) massDeregistration(n, owned int) bool {
+	if c.MaxDeregisterCount > 0 && n > c.MaxDeregisterCount {
+		return true
+	}
+	return c.MaxDeregisterPercent > 0 && owned > 0 && n*100 > c.MaxDeregisterPercent*owned
+}
+
+// guardDeregistrations moves the deregistrations out of the plan into its
+// held actions if there are too many of them, until the same services have
+// been planned to be deregistered for the DeregisterGuardWindow. New services
+// joining the deregistrations start the window over.
+func (d *Daemon) guardDeregistrations(plan *SyncPlan, owned int, now time.Time) {
+	var actions, deregistrations []SyncAction
+	for _, action := range plan.Actions {
+		if action.Type == SyncActionDeregister {
+			deregistrations = append(deregistrations, action)
+		} else {
+			actions = append(actions, action)
+		}
+	}
+
+	g := &d.deregisterGuard
+	if !d.c.massDeregistration(len(deregistrations), owned) {
+		if g.held != nil {
+			logrus.Infof("Mass deregistration no longer planned, releasing the guard")
+		}
+		g.held = nil
+		heldDeregistrationsGauge.Set(0)
+		return
+	}
+
+	ids := make(map[string]struct{}, len(deregistrations))
+	grown := g.held == nil
+	for _, action := range deregistrations {
+		ids[action.ServiceID] = struct{}{}
+		if _, ok := g.held[action.ServiceID]; !ok {
+			grown = true
+		}
+	}
+	if grown {
+		logrus.Warnf("Holding back deregistration of %d of %d services for %s", len(deregistrations), owned, d.c.DeregisterGuardWindow)
+		g.since = now
+	}
+	g.held = ids
+
+	if held := now.Sub(g.since); held >= d.c.DeregisterGuardWindow {
+		logrus.Warnf("Deregistering %d of %d services, which have been planned for %s", len(deregistrations), owned, held)
+		g.held = nil
+		heldDeregistrationsGauge.Set(0)
+		return
+	}
+
+	plan.Actions = actions
+	plan.Held = deregistrations
+	heldDeregistrationsGauge.Set(float64(len(deregistrations)))
+}
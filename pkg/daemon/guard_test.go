@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+)
+
+func TestGuardDeregistrations(t *testing.T) {
+	start := time.Now()
+	d := NewDaemon(DaemonConfig{MaxDeregisterPercent: 50, MaxDeregisterCount: 3, DeregisterGuardWindow: time.Minute}, nil, nil, nil)
+
+	// guard plans the deregistration of the given services out of owned,
+	// returning how many of them were held back
+	guard := func(offset time.Duration, owned int, serviceIDs ...string) int {
+		plan := &SyncPlan{Actions: []SyncAction{{Type: SyncActionUpdateTTL, ServiceID: "other"}}}
+		for _, serviceID := range serviceIDs {
+			plan.Actions = append(plan.Actions, SyncAction{Type: SyncActionDeregister, ServiceID: serviceID})
+		}
+		d.guardDeregistrations(plan, owned, start.Add(offset))
+		if len(plan.Actions)+len(plan.Held) != len(serviceIDs)+1 {
+			t.Fatalf("actions went missing: %v", plan)
+		}
+		return len(plan.Held)
+	}
+
+	tests := []struct {
+		name       string
+		offset     time.Duration
+		owned      int
+		serviceIDs []string
+		held       int
+	}{
+		{name: "below the limits", owned: 10, serviceIDs: []string{"a", "b"}},
+		{name: "percentage exceeded", owned: 4, serviceIDs: []string{"a", "b", "c"}, held: 3},
+		{name: "still held within the window", offset: 30 * time.Second, owned: 4, serviceIDs: []string{"a", "b", "c"}, held: 3},
+		{name: "fewer services stay held", offset: 40 * time.Second, owned: 4, serviceIDs: []string{"a", "b", "c"}, held: 3},
+		{name: "more services start the window over", offset: 50 * time.Second, owned: 10, serviceIDs: []string{"a", "b", "c", "d"}, held: 4},
+		{name: "window of the first services passed", offset: 90 * time.Second, owned: 10, serviceIDs: []string{"a", "b", "c", "d"}, held: 4},
+		{name: "stable for the window", offset: 110 * time.Second, owned: 10, serviceIDs: []string{"a", "b", "c", "d"}},
+		{name: "count exceeded", offset: 120 * time.Second, owned: 100, serviceIDs: []string{"a", "b", "c", "d"}, held: 4},
+		{name: "recovered", offset: 130 * time.Second, owned: 100},
+		{name: "held again from scratch", offset: 140 * time.Second, owned: 100, serviceIDs: []string{"a", "b", "c", "d"}, held: 4},
+	}
+	for _, test := range tests {
+		if held := guard(test.offset, test.owned, test.serviceIDs...); held != test.held {
+			t.Fatalf("%s: expected %d held, got %d", test.name, test.held, held)
+		}
+	}
+}
+
+func TestDaemonDeregisterGuard(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	consul := consultest.New(testNodeName)
+
+	c := testDaemonConfig()
+	c.MaxDeregisterPercent = 50
+	c.DeregisterGuardWindow = 200 * time.Millisecond
+	startTestDaemon(t, c, kubelet, consul)
+
+	// The kubelet briefly returns no pods
+	kubelet.SetPods()
+	time.Sleep(100 * time.Millisecond)
+	if services := consul.AgentServices(); len(services) != 2 {
+		t.Fatalf("expected services to be held, have %v", services)
+	}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	time.Sleep(200 * time.Millisecond)
+	if services := consul.AgentServices(); len(services) != 2 {
+		t.Fatalf("expected services to stay, have %v", services)
+	}
+
+	// Once the pods stay gone for the window they are deregistered
+	kubelet.SetPods()
+	eventually(t, "services deregistered", func() bool {
+		return len(consul.AgentServices()) == 0
+	})
+}
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	k8sApi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// InformerClientConfig holds the config options for watching pods through the apiserver
+type InformerClientConfig struct {
+	NodeName     string        `long:"node-name" env:"NODE_NAME" description:"name of the node the daemon runs on, to watch its pods through the apiserver"`
+	ResyncPeriod time.Duration `long:"informer-resync-period" env:"INFORMER_RESYNC_PERIOD" description:"how frequently the apiserver pod informer resyncs" default:"5m"`
+}
+
+// NewInformerClient returns a new InformerClient watching the pods of the
+// configured node through clientset
+func NewInformerClient(clientset kubernetes.Interface, c InformerClientConfig) (*InformerClient, error) {
+	if c.NodeName == "" {
+		return nil, fmt.Errorf("the node name is required to watch pods through the apiserver")
+	}
+	return newInformerClient(clientset, c), nil
+}
+
+// newInformerClient returns an InformerClient watching pods through clientset
+func newInformerClient(clientset kubernetes.Interface, c InformerClientConfig) *InformerClient {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, c.ResyncPeriod, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", c.NodeName).String()
+	}))
+	k := &InformerClient{
+		informer: factory.Core().V1().Pods().Informer(),
+		changes:  make(chan struct{}, 1),
+	}
+	notify := func(interface{}) {
+		// A pending notification covers this change as well
+		select {
+		case k.changes <- struct{}{}:
+		default:
+		}
+	}
+	k.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj interface{}) { notify(obj) },
+		DeleteFunc: notify,
+	})
+	return k
+}
+
+// InformerClient is a pod source backed by a shared informer on the apiserver
+// that implements the Kubelet and PodNotifier interfaces
+type InformerClient struct {
+	informer cache.SharedIndexInformer
+	changes  chan struct{}
+}
+
+// Start starts the informer and waits for its cache to fill, the informer
+// runs until stopCh is closed
+func (k *InformerClient) Start(stopCh <-chan struct{}) error {
+	go k.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, k.informer.HasSynced) {
+		return fmt.Errorf("pod informer cache didn't sync")
+	}
+	return nil
+}
+
+// GetPodList returns the list of pods of the node from the informer's cache
+func (k *InformerClient) GetPodList(ctx context.Context) (*k8sApi.PodList, error) {
+	if !k.informer.HasSynced() {
+		return nil, fmt.Errorf("pod informer cache not synced yet")
+	}
+	objs := k.informer.GetStore().List()
+	podList := &k8sApi.PodList{Items: make([]k8sApi.Pod, 0, len(objs))}
+	for _, obj := range objs {
+		if pod, ok := obj.(*k8sApi.Pod); ok {
+			podList.Items = append(podList.Items, *pod.DeepCopy())
+		}
+	}
+	return podList, nil
+}
+
+// Changes returns a channel signalled whenever a pod of the node changed
+func (k *InformerClient) Changes() <-chan struct{} {
+	return k.changes
+}
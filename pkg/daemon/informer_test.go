@@ -0,0 +1,44 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestInformerClient(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	informerClient := newInformerClient(clientset, InformerClientConfig{NodeName: testNodeName})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := informerClient.Start(stopCh); err != nil {
+		t.Fatalf("error starting informer: %v", err)
+	}
+
+	// Don't poll, so only the pushed changes sync pods
+	c := testDaemonConfig()
+	c.KubeletSyncInterval = time.Hour
+	consul := consultest.New(testNodeName)
+	startTestDaemon(t, c, informerClient, consul)
+
+	ctx := context.Background()
+	pod := loadTestPod(t, "basic/working")
+	if _, err := clientset.CoreV1().Pods(pod.Namespace).Create(ctx, &pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	eventually(t, "services registered", func() bool {
+		_, ok := consul.AgentServices()[basicServiceID]
+		return ok
+	})
+
+	if err := clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("error deleting pod: %v", err)
+	}
+	eventually(t, "services deregistered", func() bool {
+		return len(consul.AgentServices()) == 0
+	})
+}
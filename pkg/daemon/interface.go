@@ -1,25 +1,63 @@
 package daemon
 
 import (
+	"context"
+
 	consulApi "github.com/hashicorp/consul/api"
 	k8sApi "k8s.io/api/core/v1"
 )
 
 // Kubelet encapsulates the interface for kubelet interaction
 type Kubelet interface {
-	GetPodList() (*k8sApi.PodList, error)
+	GetPodList(ctx context.Context) (*k8sApi.PodList, error)
+}
+
+// PodNotifier is implemented by pod sources which push changes to pods; the
+// daemon fetches the pod list as soon as a change is signalled, instead of
+// waiting for the next poll
+type PodNotifier interface {
+	Changes() <-chan struct{}
+}
+
+// PodConfig is the result of checking the annotations of a pod
+type PodConfig struct {
+	Pod *k8sApi.Pod
+	Err error // problem with the annotations, nil if there is none
+}
+
+// ConfigReporter surfaces problems with the annotations of pods in k8s, so
+// they show up on the pods instead of only in our logs
+type ConfigReporter interface {
+	// ReportConfig is called with all pods defining services after each
+	// fetch, outside of the sync loop; if it falls behind only the latest
+	// fetch is reported
+	ReportConfig(configs []PodConfig)
 }
 
 // ConsulCatalog encapsulates the interface for interacting with the Catalog API
 type ConsulCatalog interface {
-	Services() (map[string]*consulApi.AgentService, error)
+	// Node returns the catalog entry for a node; setting WaitIndex in the
+	// QueryOptions makes this a blocking query
+	Node(node string, q *consulApi.QueryOptions) (*consulApi.CatalogNode, *consulApi.QueryMeta, error)
 }
 
 // ConsulAgent encapsulates the interface for interacting with the local agent
 // and service API
 type ConsulAgent interface {
-	UpdateTTL(checkID, output, status string) error
+	NodeName() (string, error)
 	Services() (map[string]*consulApi.AgentService, error)
-	ServiceDeregister(serviceID string) error
+	Checks() (map[string]*consulApi.AgentCheck, error)
+	AgentHealthServiceByID(serviceID string) (string, *consulApi.AgentServiceChecksInfo, error)
 	ServiceRegister(service *consulApi.AgentServiceRegistration) error
+	ServiceDeregister(serviceID string) error
+	UpdateTTL(checkID, output, status string) error
+	CheckDeregister(checkID string) error
+	EnableServiceMaintenance(serviceID, reason string) error
+	DisableServiceMaintenance(serviceID string) error
 }
+
+// Ensure the consul API client satisfies our interfaces
+var (
+	_ ConsulCatalog = &consulApi.Catalog{}
+	_ ConsulAgent   = &consulApi.Agent{}
+)
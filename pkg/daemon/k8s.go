@@ -1,35 +1,73 @@
 package daemon
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	k8sApi "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
+// NewInClusterClientset returns a client for the in-cluster apiserver, to be
+// shared by everything talking to it
+func NewInClusterClientset() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// kubeletErrorSnippetSize is how much of the body of an error response we put in the error
+const kubeletErrorSnippetSize = 512
+
 // KubeletClientConfig holds the config options for connecting to the kubelet API
 type KubeletClientConfig struct {
-	APIEndpoint        string `long:"kubelet-api" env:"KUBELET_API" description:"kubelet API endpoint" default:"http://localhost:10255/pods"`
-	InsecureSkipVerify bool   `long:"kubelet-api-insecure-skip-verify" env:"KUBELET_API_INSECURE_SKIP_VERIFY" description:"skip verification of TLS certificate from kubelet API"`
+	APIEndpoint        string        `long:"kubelet-api" env:"KUBELET_API" description:"kubelet API endpoint" default:"http://localhost:10255/pods"`
+	InsecureSkipVerify bool          `long:"kubelet-api-insecure-skip-verify" env:"KUBELET_API_INSECURE_SKIP_VERIFY" description:"skip verification of TLS certificate from kubelet API"`
+	Timeout            time.Duration `long:"kubelet-api-timeout" env:"KUBELET_API_TIMEOUT" description:"timeout of requests to the kubelet API" default:"10s"`
+	BearerTokenFile    string        `long:"kubelet-api-token-file" env:"KUBELET_API_TOKEN_FILE" description:"file containing the bearer token to authenticate to the kubelet API with (reloaded on change)"`
+	ClientCertFile     string        `long:"kubelet-api-client-cert" env:"KUBELET_API_CLIENT_CERT" description:"client certificate to authenticate to the kubelet API with"`
+	ClientKeyFile      string        `long:"kubelet-api-client-key" env:"KUBELET_API_CLIENT_KEY" description:"key of the client certificate"`
+	CAFile             string        `long:"kubelet-api-ca-file" env:"KUBELET_API_CA_FILE" description:"CA certificate to verify the kubelet API's certificate with"`
 }
 
 // NewKubeletClient returns a new KubeletClient based on the given config
 func NewKubeletClient(c KubeletClientConfig) (*KubeletClient, error) {
-	// creates the in-cluster config
+	if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+		return nil, fmt.Errorf("both the kubelet API client certificate and key are required")
+	}
+
+	// creates the in-cluster config, outside of a cluster we start out with
+	// plain HTTP(S)
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		if err == rest.ErrNotInCluster {
-			if c.InsecureSkipVerify {
-				tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-				return &KubeletClient{c: c, client: &http.Client{Transport: tr}}, nil
-			}
-
-			return &KubeletClient{c: c, client: http.DefaultClient}, nil
+		if err != rest.ErrNotInCluster {
+			return nil, err
 		}
-		return nil, err
+		config = &rest.Config{}
+	}
+
+	if c.BearerTokenFile != "" {
+		config.BearerToken = ""
+		config.BearerTokenFile = c.BearerTokenFile
+	}
+	if c.ClientCertFile != "" {
+		config.TLSClientConfig.CertData = nil
+		config.TLSClientConfig.CertFile = c.ClientCertFile
+		config.TLSClientConfig.KeyData = nil
+		config.TLSClientConfig.KeyFile = c.ClientKeyFile
+	}
+	if c.CAFile != "" {
+		config.TLSClientConfig.CAData = nil
+		config.TLSClientConfig.CAFile = c.CAFile
 	}
 	if c.InsecureSkipVerify {
 		config.TLSClientConfig.Insecure = true
@@ -51,9 +89,14 @@ type KubeletClient struct {
 }
 
 // GetPodList returns the list of pods the kubelet is managing
-func (k *KubeletClient) GetPodList() (*k8sApi.PodList, error) {
-	// k8s testing
-	req, err := http.NewRequest("GET", k.c.APIEndpoint, nil)
+func (k *KubeletClient) GetPodList(ctx context.Context) (*k8sApi.PodList, error) {
+	if k.c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", k.c.APIEndpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -64,13 +107,14 @@ func (k *KubeletClient) GetPodList() (*k8sApi.PodList, error) {
 	}
 	defer resp.Body.Close()
 
-	var podList k8sApi.PodList
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, kubeletErrorSnippetSize))
+		return nil, fmt.Errorf("kubelet API returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
 	}
-	if err := json.Unmarshal(b, &podList); err != nil {
-		return nil, err
+
+	var podList k8sApi.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&podList); err != nil {
+		return nil, fmt.Errorf("error decoding kubelet API response: %v", err)
 	}
 	return &podList, nil
 }
@@ -0,0 +1,221 @@
+package daemon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	k8sApi "k8s.io/api/core/v1"
+)
+
+// fakeKubelet is a kubelet /pods handler serving the given pods to requests
+// with the expected bearer token (if any)
+type fakeKubelet struct {
+	token string
+	pods  []k8sApi.Pod
+	delay time.Duration
+}
+
+func (k *fakeKubelet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if k.token != "" && r.Header.Get("Authorization") != "Bearer "+k.token {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("<html><body>Unauthorized</body></html>"))
+		return
+	}
+	select {
+	case <-time.After(k.delay):
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k8sApi.PodList{Items: k.pods})
+}
+
+// writeTestCert writes a self-signed certificate and its key for 127.0.0.1
+// into dir, returning their paths
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestKubeletClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katalog-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("token1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pods := []k8sApi.Pod{loadTestPod(t, "basic/working"), loadTestPod(t, "sidecar/working")}
+
+	tests := []struct {
+		name    string
+		kubelet *fakeKubelet
+		config  KubeletClientConfig
+		err     string
+	}{
+		{
+			name:    "plain",
+			kubelet: &fakeKubelet{pods: pods},
+		},
+		{
+			name:    "bearer token file",
+			kubelet: &fakeKubelet{token: "token1", pods: pods},
+			config:  KubeletClientConfig{BearerTokenFile: tokenPath},
+		},
+		{
+			name:    "unauthorized",
+			kubelet: &fakeKubelet{token: "token1", pods: pods},
+			err:     "kubelet API returned 401 Unauthorized: <html><body>Unauthorized</body></html>",
+		},
+		{
+			name:    "timeout",
+			kubelet: &fakeKubelet{pods: pods, delay: time.Second},
+			config:  KubeletClientConfig{Timeout: 50 * time.Millisecond},
+			err:     "context deadline exceeded",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(test.kubelet)
+			defer srv.Close()
+
+			test.config.APIEndpoint = srv.URL + "/pods"
+			client, err := NewKubeletClient(test.config)
+			if err != nil {
+				t.Fatalf("error creating client: %v", err)
+			}
+			podList, err := client.GetPodList(context.Background())
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error getting pods: %v", err)
+			}
+			if len(podList.Items) != len(pods) || podList.Items[0].Name != pods[0].Name {
+				t.Fatalf("unexpected pods: %v", podList.Items)
+			}
+		})
+	}
+}
+
+func TestKubeletClientTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katalog-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeTestCert(t, dir, "kubelet")
+	clientCert, clientKey := writeTestCert(t, dir, "katalog-sync")
+
+	// The kubelet only accepts our client certificate
+	clientCA, err := ioutil.ReadFile(clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCA)
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(&fakeKubelet{pods: []k8sApi.Pod{loadTestPod(t, "basic/working")}})
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		config KubeletClientConfig
+		err    bool
+	}{
+		{
+			name:   "client certificate",
+			config: KubeletClientConfig{CAFile: serverCert, ClientCertFile: clientCert, ClientKeyFile: clientKey},
+		},
+		{
+			name:   "no client certificate",
+			config: KubeletClientConfig{CAFile: serverCert},
+			err:    true,
+		},
+		{
+			name:   "unknown CA",
+			config: KubeletClientConfig{ClientCertFile: clientCert, ClientKeyFile: clientKey},
+			err:    true,
+		},
+		{
+			name:   "insecure",
+			config: KubeletClientConfig{InsecureSkipVerify: true, ClientCertFile: clientCert, ClientKeyFile: clientKey},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.APIEndpoint = srv.URL + "/pods"
+			client, err := NewKubeletClient(test.config)
+			if err != nil {
+				t.Fatalf("error creating client: %v", err)
+			}
+			_, err = client.GetPodList(context.Background())
+			if (err != nil) != test.err {
+				t.Fatalf("expected error=%v, got %v", test.err, err)
+			}
+		})
+	}
+
+	if _, err := NewKubeletClient(KubeletClientConfig{ClientCertFile: clientCert}); err == nil {
+		t.Fatalf("expected error for a client certificate without key")
+	}
+}
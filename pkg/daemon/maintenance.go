@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"strings"
+
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+// maintenanceReasonPrefix is prepended to the reason of all maintenance modes
+// katalog-sync enables, so we only ever disable the ones we enabled
+const maintenanceReasonPrefix = "katalog-sync: "
+
+// defaultMaintenanceReason is used if maintenance was requested without a reason
+const defaultMaintenanceReason = "maintenance requested"
+
+// MaintenanceState is a maintenance mode requested through the API
+type MaintenanceState struct {
+	Enabled bool
+	Reason  string
+}
+
+// maintenanceReason returns the reason to put in consul for a requested reason
+func maintenanceReason(reason string) string {
+	if reason == "" {
+		reason = defaultMaintenanceReason
+	}
+	return maintenanceReasonPrefix + reason
+}
+
+// GetMaintenance returns whether the given service should be in maintenance
+// mode, and the reason to put it in consul with. Maintenance requested through
+// the API takes precedence over the annotations; for both a service-specific
+// setting takes precedence over one for the whole pod.
+func (p *Pod) GetMaintenance(n string) (string, bool) {
+	for _, key := range []string{n, ""} {
+		if state, ok := p.MaintenanceOverrides[key]; ok {
+			return maintenanceReason(state.Reason), state.Enabled
+		}
+	}
+
+	value, ok := p.serviceAnnotation(ConsulMaintenance, ConsulMaintenanceOverride, n)
+	switch {
+	case !ok, value == "false":
+		return "", false
+	case value == "true":
+		return maintenanceReason(""), true
+	default:
+		return maintenanceReason(value), true
+	}
+}
+
+// InMaintenance returns the services of the pod which should be in maintenance
+// mode (service name -> reason)
+func (p *Pod) InMaintenance() map[string]string {
+	var services map[string]string
+	for _, serviceName := range p.GetServiceNames() {
+		if reason, ok := p.GetMaintenance(serviceName); ok {
+			if services == nil {
+				services = make(map[string]string)
+			}
+			services[serviceName] = strings.TrimPrefix(reason, maintenanceReasonPrefix)
+		}
+	}
+	return services
+}
+
+// SetMaintenance records maintenance requested through the API for the given
+// service, or for all services of the pod if n is empty (replacing any
+// service-specific requests)
+func (p *Pod) SetMaintenance(n string, state MaintenanceState) {
+	if n == "" || p.MaintenanceOverrides == nil {
+		p.MaintenanceOverrides = make(map[string]MaintenanceState)
+	}
+	p.MaintenanceOverrides[n] = state
+}
+
+// planMaintenance returns the actions required to bring the maintenance mode
+// of a service in the agent in line with what the pod requests
+func planMaintenance(action SyncAction, reason string, enabled bool, agentChecks map[string]*consulApi.AgentCheck) []SyncAction {
+	check, inMaintenance := agentChecks[consulServiceMaintenancePrefix+action.ServiceID]
+	// Maintenance modes someone else enabled are left alone
+	ours := inMaintenance && strings.HasPrefix(check.Notes, maintenanceReasonPrefix)
+
+	var actions []SyncAction
+	if inMaintenance && ours && (!enabled || check.Notes != reason) {
+		disable := action
+		disable.Type = SyncActionDisableMaintenance
+		disable.Reason = "maintenance no longer requested"
+		if enabled {
+			// consul doesn't update the reason of an existing maintenance mode
+			disable.Reason = "maintenance reason changed"
+		}
+		actions = append(actions, disable)
+		inMaintenance = false
+	}
+	if enabled && !inMaintenance {
+		enable := action
+		enable.Type = SyncActionEnableMaintenance
+		enable.Reason = "maintenance requested"
+		enable.MaintenanceReason = reason
+		actions = append(actions, enable)
+	}
+	return actions
+}
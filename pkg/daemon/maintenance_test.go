@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+	katalogsync "github.com/wish/katalog-sync/proto"
+)
+
+func TestPlanSyncMaintenance(t *testing.T) {
+	now := time.Now()
+	const key = "hw/hw-7df6995f69-96wth"
+
+	pod, err := NewPod(loadTestPod(t, "basic/working"), &DaemonConfig{DefaultCheckTTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	// only sync one of the services
+	pod.Pod.ObjectMeta.Annotations[ConsulServiceNames] = "hw-service-name"
+	pod.SyncStatuses.GetStatus("hw-service-name").LastUpdated = now
+
+	c := consultest.New("node")
+	if err := c.Agent().ServiceRegister(pod.Registration("hw-service-name", consulApi.HealthPassing, "")); err != nil {
+		t.Fatalf("error registering service: %v", err)
+	}
+
+	// apply executes the maintenance actions of the plan against the agent
+	apply := func(expected []SyncAction) {
+		t.Helper()
+		plan := PlanSync(map[string]*Pod{key: pod}, c.AgentServices(), c.AgentChecks(), now)
+		var actual []SyncAction
+		for _, action := range plan.Actions {
+			actual = append(actual, SyncAction{Type: action.Type, ServiceID: action.ServiceID, MaintenanceReason: action.MaintenanceReason})
+			switch action.Type {
+			case SyncActionEnableMaintenance:
+				err = c.Agent().EnableServiceMaintenance(action.ServiceID, action.MaintenanceReason)
+			case SyncActionDisableMaintenance:
+				err = c.Agent().DisableServiceMaintenance(action.ServiceID)
+			}
+			if err != nil {
+				t.Fatalf("error applying %s: %v", action.Type, err)
+			}
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("Mismatch expected=%v actual=%v", expected, actual)
+		}
+	}
+
+	apply(nil)
+
+	pod.Pod.ObjectMeta.Annotations[ConsulMaintenance] = "true"
+	apply([]SyncAction{{Type: SyncActionEnableMaintenance, ServiceID: basicServiceID, MaintenanceReason: "katalog-sync: maintenance requested"}})
+	apply(nil)
+
+	// consul doesn't update the reason in place
+	pod.Pod.ObjectMeta.Annotations[ConsulMaintenanceOverride+"hw-service-name"] = "migrating"
+	apply([]SyncAction{
+		{Type: SyncActionDisableMaintenance, ServiceID: basicServiceID},
+		{Type: SyncActionEnableMaintenance, ServiceID: basicServiceID, MaintenanceReason: "katalog-sync: migrating"},
+	})
+	if reasons := pod.InMaintenance(); !reflect.DeepEqual(reasons, map[string]string{"hw-service-name": "migrating"}) {
+		t.Fatalf("unexpected services in maintenance: %v", reasons)
+	}
+
+	// The API takes precedence over the annotations
+	pod.SetMaintenance("", MaintenanceState{Enabled: false})
+	apply([]SyncAction{{Type: SyncActionDisableMaintenance, ServiceID: basicServiceID}})
+	pod.MaintenanceOverrides = nil
+	delete(pod.Pod.ObjectMeta.Annotations, ConsulMaintenance)
+	delete(pod.Pod.ObjectMeta.Annotations, ConsulMaintenanceOverride+"hw-service-name")
+	apply(nil)
+
+	// Maintenance enabled by someone else is left alone
+	if err := c.Agent().EnableServiceMaintenance(basicServiceID, "operator"); err != nil {
+		t.Fatalf("error enabling maintenance: %v", err)
+	}
+	apply(nil)
+}
+
+func TestDaemonSetMaintenance(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	consul := consultest.New(testNodeName)
+
+	d := startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	maintenanceCheck := func() *consulApi.AgentCheck {
+		return consul.AgentChecks()[consulServiceMaintenancePrefix+basicServiceID]
+	}
+
+	query := &katalogsync.SetMaintenanceQuery{Namespace: "hw", PodName: "hw-7df6995f69-96wth", ServiceName: "hw-service-name", Enable: true, Reason: "draining"}
+	if _, err := d.SetMaintenance(ctx, query); err != nil {
+		t.Fatalf("error enabling maintenance: %v", err)
+	}
+	// SetMaintenance only returns once the agent has been updated
+	if check := maintenanceCheck(); check == nil || check.Notes != "katalog-sync: draining" {
+		t.Fatalf("expected service in maintenance, got %+v", check)
+	}
+
+	query.Enable = false
+	if _, err := d.SetMaintenance(ctx, query); err != nil {
+		t.Fatalf("error disabling maintenance: %v", err)
+	}
+	if check := maintenanceCheck(); check != nil {
+		t.Fatalf("expected service out of maintenance, got %+v", check)
+	}
+
+	// Requests for unknown pods or services fail
+	if _, err := d.SetMaintenance(ctx, &katalogsync.SetMaintenanceQuery{Namespace: "hw", PodName: "missing", Enable: true}); err == nil {
+		t.Fatalf("maintenance of unknown pod succeeded")
+	}
+	query.ServiceName = "missing"
+	if _, err := d.SetMaintenance(ctx, query); err == nil {
+		t.Fatalf("maintenance of unknown service succeeded")
+	}
+}
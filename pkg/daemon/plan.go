@@ -0,0 +1,337 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// SyncActionType is the type of change a SyncAction makes to the consul agent
+type SyncActionType string
+
+const (
+	SyncActionRegister   SyncActionType = "register"   // service doesn't exist in the agent
+	SyncActionReregister SyncActionType = "reregister" // service exists in the agent, but its definition changed
+	SyncActionUpdateTTL  SyncActionType = "update-ttl" // service is unchanged, only the check needs to be updated
+	SyncActionDeregister SyncActionType = "deregister" // service no longer exists in k8s
+
+	SyncActionDeregisterCheck SyncActionType = "deregister-check" // probe check no longer exists in k8s
+
+	SyncActionEnableMaintenance  SyncActionType = "enable-maintenance"  // service was put into maintenance
+	SyncActionDisableMaintenance SyncActionType = "disable-maintenance" // service was taken out of maintenance
+
+	SyncActionInvalid SyncActionType = "invalid" // service can't be synced, the reason is recorded as its sync error
+)
+
+// SyncActionTypes is the list of all SyncActionTypes
+var SyncActionTypes = []SyncActionType{
+	SyncActionRegister,
+	SyncActionReregister,
+	SyncActionUpdateTTL,
+	SyncActionDeregister,
+	SyncActionDeregisterCheck,
+	SyncActionEnableMaintenance,
+	SyncActionDisableMaintenance,
+	SyncActionInvalid,
+}
+
+var planActions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "katalog_sync_plan_actions",
+	Help: "How many actions the last sync plan contained, partitioned by action",
+}, []string{"action"})
+
+func init() {
+	prometheus.MustRegister(planActions)
+}
+
+// SyncAction is a single change to make to the consul agent
+type SyncAction struct {
+	Type        SyncActionType `json:"type"`
+	Reason      string         `json:"reason"`
+	PodKey      string         `json:"pod,omitempty"` // key of the pod this service belongs to; empty for deregistrations of services without a pod
+	ServiceName string         `json:"service_name"`
+	ServiceID   string         `json:"service_id"`
+	CheckID     string         `json:"check_id,omitempty"` // check to deregister
+	Diff        []string       `json:"diff,omitempty"`     // fields which differ between the agent and the pod for a re-registration
+
+	// Registration is the service definition to (re-)register
+	Registration *consulApi.AgentServiceRegistration `json:"registration,omitempty"`
+	// Output and Status of the check for a TTL update
+	Output string `json:"output,omitempty"`
+	Status string `json:"status,omitempty"`
+	// MaintenanceReason is the reason to enable maintenance mode with
+	MaintenanceReason string `json:"maintenance_reason,omitempty"`
+}
+
+func (a SyncAction) String() string {
+	if a.CheckID != "" {
+		return fmt.Sprintf("%s %s: %s", a.Type, a.CheckID, a.Reason)
+	}
+	return fmt.Sprintf("%s %s: %s", a.Type, a.ServiceID, a.Reason)
+}
+
+// SyncPlan is the ordered list of actions required to sync the local pod state
+// to the consul agent
+type SyncPlan struct {
+	Actions []SyncAction `json:"actions"`
+	// Held are the deregistrations held back by the mass-deregistration guard
+	Held []SyncAction `json:"held,omitempty"`
+}
+
+// Counts returns the number of actions in the plan for each SyncActionType
+func (p *SyncPlan) Counts() map[SyncActionType]int {
+	counts := make(map[SyncActionType]int, len(SyncActionTypes))
+	for _, actionType := range SyncActionTypes {
+		counts[actionType] = 0
+	}
+	for _, action := range p.Actions {
+		counts[action.Type]++
+	}
+	return counts
+}
+
+// PlanSync calculates the actions required to sync the given pods (pod key ->
+// pod) into an agent which currently has agentServices and agentChecks
+// registered. As it makes no calls and doesn't change the pods the result is
+// deterministic for a given input, and planning has no effect on the daemon.
+func PlanSync(pods map[string]*Pod, agentServices map[string]*consulApi.AgentService, agentChecks map[string]*consulApi.AgentCheck, now time.Time) *SyncPlan {
+	plan := &SyncPlan{}
+
+	podKeys := make([]string, 0, len(pods))
+	for key := range pods {
+		podKeys = append(podKeys, key)
+	}
+	sort.Strings(podKeys)
+
+	// Push/Update from local state
+	for _, key := range podKeys {
+		pod := pods[key]
+		ready, containerReadiness := pod.Ready()
+
+		status := consulApi.HealthCritical
+		if ready {
+			status = consulApi.HealthPassing
+		}
+
+		notesB, err := json.MarshalIndent(containerReadiness, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		// planService adds the action (if any) required to sync a single
+		// service of the pod to the plan
+		planService := func(serviceName, serviceID, maintenanceName, status, notes string, probeChecks []*consulApi.AgentServiceCheck, registration func() *consulApi.AgentServiceRegistration) {
+			// Re-registering doesn't remove checks, so probe checks which are
+			// no longer defined have to be removed on their own
+			for _, checkID := range staleProbeChecks(serviceID, probeChecks, agentChecks) {
+				plan.Actions = append(plan.Actions, SyncAction{
+					Type:        SyncActionDeregisterCheck,
+					Reason:      "probe check no longer defined",
+					PodKey:      key,
+					ServiceName: serviceName,
+					ServiceID:   serviceID,
+					CheckID:     checkID,
+				})
+			}
+
+			action := SyncAction{
+				PodKey:      key,
+				ServiceName: serviceName,
+				ServiceID:   serviceID,
+			}
+
+			consulService, ok := agentServices[serviceID]
+			var diff []string
+			if ok {
+				diff = pod.Diff(consulService)
+				diff = append(diff, checkDiff(registration().Check, agentChecks[serviceID])...)
+				diff = append(diff, probeChecksDiff(probeChecks, agentChecks)...)
+			}
+			switch {
+			case !ok:
+				action.Type = SyncActionRegister
+				action.Reason = "service not registered in agent"
+			case len(diff) > 0:
+				action.Type = SyncActionReregister
+				action.Reason = "service definition changed"
+				action.Diff = diff
+			default:
+				// If the service already exists, we only update the check once we
+				// are past halflife of last update, or to clear the error of the
+				// last sync (e.g. a port which couldn't be resolved)
+				syncStatus := pod.SyncStatuses.Lookup(serviceName)
+				lastUpdated := syncStatus.LastUpdated
+				switch {
+				case lastUpdated.IsZero():
+					action.Reason = "check not yet updated"
+				case syncStatus.LastError != nil:
+					action.Reason = fmt.Sprintf("last sync failed: %v", syncStatus.LastError)
+				case now.Sub(lastUpdated) >= pod.GetCheckTTL(serviceName)/2:
+					action.Reason = fmt.Sprintf("check last updated %s ago", now.Sub(lastUpdated))
+				}
+				if action.Reason != "" {
+					action.Type = SyncActionUpdateTTL
+					action.Output = notes
+					action.Status = status
+				}
+			}
+
+			if action.Type != "" {
+				if action.Type != SyncActionUpdateTTL {
+					action.Registration = registration()
+				}
+				plan.Actions = append(plan.Actions, action)
+			}
+
+			reason, enabled := pod.GetMaintenance(maintenanceName)
+			plan.Actions = append(plan.Actions, planMaintenance(SyncAction{
+				PodKey:      key,
+				ServiceName: serviceName,
+				ServiceID:   serviceID,
+			}, reason, enabled, agentChecks)...)
+		}
+
+		for _, serviceName := range pod.GetServiceNames() {
+			serviceName := serviceName
+			// Services are left as they are in the agent until their port
+			// can be resolved again, rather than registering a wrong one
+			if _, err := pod.GetPort(serviceName); err != nil {
+				plan.Actions = append(plan.Actions, SyncAction{
+					Type:        SyncActionInvalid,
+					Reason:      err.Error(),
+					PodKey:      key,
+					ServiceName: serviceName,
+					ServiceID:   pod.GetServiceID(serviceName),
+				})
+				continue
+			}
+			planService(serviceName, pod.GetServiceID(serviceName), serviceName, pod.GetServiceHealth(serviceName, status), string(notesB), pod.GetProbeChecks(serviceName), func() *consulApi.AgentServiceRegistration {
+				return pod.Registration(serviceName, status, string(notesB))
+			})
+
+			if !pod.HasConnectProxy(serviceName) {
+				continue
+			}
+			// The proxy is only passing if it and the service behind it are
+			proxyStatus := status
+			proxyReady, proxyReadiness := pod.ConnectProxyReady()
+			if !proxyReady {
+				proxyStatus = consulApi.HealthCritical
+			}
+			proxyNotesB, err := json.MarshalIndent(proxyReadiness, "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			planService(pod.GetConnectProxyServiceName(serviceName), pod.GetConnectProxyServiceID(serviceName), serviceName, pod.GetServiceHealth(serviceName, proxyStatus), string(proxyNotesB), nil, func() *consulApi.AgentServiceRegistration {
+				return pod.ConnectProxyRegistration(serviceName, proxyStatus, string(proxyNotesB))
+			})
+		}
+	}
+
+	// Delete old ones
+	serviceIDs := make([]string, 0, len(agentServices))
+	for serviceID := range agentServices {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Strings(serviceIDs)
+
+	for _, serviceID := range serviceIDs {
+		consulService := agentServices[serviceID]
+		// We skip all services we aren't syncing (in case others are also registering agent services)
+		if !isSyncedService(consulService) {
+			continue
+		}
+
+		action := SyncAction{
+			Type:        SyncActionDeregister,
+			ServiceName: consulService.Service,
+			ServiceID:   consulService.ID,
+		}
+
+		key := consulService.Meta[ConsulK8sLinkName]
+		pod, ok := pods[key]
+		switch {
+		case !ok:
+			action.Reason = fmt.Sprintf("pod %s no longer exists", key)
+		case !pod.HasServiceID(consulService.ID):
+			action.PodKey = key
+			action.Reason = fmt.Sprintf("service no longer defined on pod %s", key)
+		default:
+			// If the service exists, skip
+			continue
+		}
+		plan.Actions = append(plan.Actions, action)
+	}
+
+	return plan
+}
+
+// observePlan exports metrics about (and, if requested, logs) the given plan
+func observePlan(plan *SyncPlan, log bool) {
+	for actionType, count := range plan.Counts() {
+		planActions.WithLabelValues(string(actionType)).Set(float64(count))
+	}
+	if log {
+		for _, action := range plan.Actions {
+			logrus.Infof("planned: %s", action)
+		}
+		for _, action := range plan.Held {
+			logrus.Infof("held: %s", action)
+		}
+	}
+}
+
+// executePlan applies the actions of a SyncPlan to the consul agent,
+// recording the result of each action in the pod's SyncStatuses
+func (d *Daemon) executePlan(plan *SyncPlan) error {
+	for _, action := range plan.Actions {
+		var err error
+		switch action.Type {
+		case SyncActionRegister, SyncActionReregister:
+			err = d.consulAgent.ServiceRegister(action.Registration)
+		case SyncActionUpdateTTL:
+			err = d.consulAgent.UpdateTTL(action.ServiceID, action.Output, action.Status)
+		case SyncActionDeregisterCheck:
+			err = d.consulAgent.CheckDeregister(action.CheckID)
+		case SyncActionEnableMaintenance:
+			err = d.consulAgent.EnableServiceMaintenance(action.ServiceID, action.MaintenanceReason)
+		case SyncActionDisableMaintenance:
+			err = d.consulAgent.DisableServiceMaintenance(action.ServiceID)
+		case SyncActionInvalid:
+			err = errors.New(action.Reason)
+		case SyncActionDeregister:
+			if err := d.consulAgent.ServiceDeregister(action.ServiceID); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("unknown sync action: %s", action.Type)
+		}
+
+		if action.Type == SyncActionReregister {
+			logrus.Infof("re-registered %s: %s: %v", action.ServiceID, strings.Join(action.Diff, "; "), err)
+		}
+		logrus.Debugf("executed: %s: %v", action, err)
+		d.state.Update(action.PodKey, func(p *Pod) {
+			status := p.SyncStatuses.GetStatus(action.ServiceName)
+			switch action.Type {
+			case SyncActionRegister, SyncActionReregister, SyncActionUpdateTTL:
+				status.SetError(err)
+			default:
+				// Only updates of the check count towards LastUpdated, which
+				// schedules the next TTL update
+				if err != nil {
+					status.LastError = err
+				}
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package daemon
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+)
+
+// planSummary is the part of a SyncAction we compare in tests
+type planSummary struct {
+	Type      SyncActionType
+	ServiceID string
+}
+
+func TestPlanSync(t *testing.T) {
+	now := time.Now()
+
+	newPod := func(t *testing.T, lastUpdated time.Time) *Pod {
+		pod, err := NewPod(loadTestPod(t, "basic/working"), &DaemonConfig{DefaultCheckTTL: 10 * time.Second})
+		if err != nil {
+			t.Fatalf("error creating pod: %v", err)
+		}
+		if !lastUpdated.IsZero() {
+			for _, serviceName := range pod.GetServiceNames() {
+				pod.SyncStatuses.GetStatus(serviceName).LastUpdated = lastUpdated
+			}
+		}
+		return pod
+	}
+	// agent returns a consul agent with the pod's services registered in it
+	agent := func(t *testing.T, pod *Pod) *consultest.Consul {
+		c := consultest.New("node")
+		for _, serviceName := range pod.GetServiceNames() {
+			if err := c.Agent().ServiceRegister(pod.Registration(serviceName, consulApi.HealthPassing, "")); err != nil {
+				t.Fatalf("error registering service: %v", err)
+			}
+		}
+		return c
+	}
+
+	const (
+		serviceID  = "katalog-sync_hw-service-name_hw_hw-7df6995f69-96wth"
+		serviceID2 = "katalog-sync_servicename2_hw_hw-7df6995f69-96wth"
+	)
+
+	tests := []struct {
+		name     string
+		pods     func(t *testing.T) map[string]*Pod
+		consul   func(t *testing.T) *consultest.Consul
+		expected []planSummary
+	}{
+		{
+			name:   "empty",
+			pods:   func(t *testing.T) map[string]*Pod { return nil },
+			consul: func(t *testing.T) *consultest.Consul { return consultest.New("node") },
+		},
+		{
+			name: "new pod",
+			pods: func(t *testing.T) map[string]*Pod {
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": newPod(t, time.Time{})}
+			},
+			consul: func(t *testing.T) *consultest.Consul { return consultest.New("node") },
+			expected: []planSummary{
+				{SyncActionRegister, serviceID},
+				{SyncActionRegister, serviceID2},
+			},
+		},
+		{
+			name: "existing services never updated",
+			pods: func(t *testing.T) map[string]*Pod {
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": newPod(t, time.Time{})}
+			},
+			consul: func(t *testing.T) *consultest.Consul { return agent(t, newPod(t, time.Time{})) },
+			expected: []planSummary{
+				{SyncActionUpdateTTL, serviceID},
+				{SyncActionUpdateTTL, serviceID2},
+			},
+		},
+		{
+			name: "existing services recently updated",
+			pods: func(t *testing.T) map[string]*Pod {
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": newPod(t, now.Add(-time.Second))}
+			},
+			consul: func(t *testing.T) *consultest.Consul { return agent(t, newPod(t, time.Time{})) },
+		},
+		{
+			name: "existing services past halflife",
+			pods: func(t *testing.T) map[string]*Pod {
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": newPod(t, now.Add(-time.Minute))}
+			},
+			consul: func(t *testing.T) *consultest.Consul { return agent(t, newPod(t, time.Time{})) },
+			expected: []planSummary{
+				{SyncActionUpdateTTL, serviceID},
+				{SyncActionUpdateTTL, serviceID2},
+			},
+		},
+		{
+			name: "changed port",
+			pods: func(t *testing.T) map[string]*Pod {
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": newPod(t, now)}
+			},
+			consul: func(t *testing.T) *consultest.Consul {
+				pod := newPod(t, time.Time{})
+				c := agent(t, pod)
+				r := pod.Registration("servicename2", consulApi.HealthPassing, "")
+				r.Port = 1234
+				if err := c.Agent().ServiceRegister(r); err != nil {
+					t.Fatalf("error registering service: %v", err)
+				}
+				return c
+			},
+			expected: []planSummary{
+				{SyncActionReregister, serviceID2},
+			},
+		},
+		{
+			name: "removed pod",
+			pods: func(t *testing.T) map[string]*Pod { return nil },
+			consul: func(t *testing.T) *consultest.Consul {
+				c := agent(t, newPod(t, time.Time{}))
+				// services not owned by katalog-sync must be left alone
+				if err := c.Agent().ServiceRegister(&consulApi.AgentServiceRegistration{ID: "other", Name: "other"}); err != nil {
+					t.Fatalf("error registering service: %v", err)
+				}
+				return c
+			},
+			expected: []planSummary{
+				{SyncActionDeregister, serviceID},
+				{SyncActionDeregister, serviceID2},
+			},
+		},
+		{
+			name: "removed service name",
+			pods: func(t *testing.T) map[string]*Pod {
+				pod := newPod(t, now)
+				pod.Pod.ObjectMeta.Annotations[ConsulServiceNames] = "hw-service-name"
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": pod}
+			},
+			consul: func(t *testing.T) *consultest.Consul { return agent(t, newPod(t, time.Time{})) },
+			expected: []planSummary{
+				{SyncActionDeregister, serviceID2},
+			},
+		},
+		{
+			name: "unresolvable port",
+			pods: func(t *testing.T) map[string]*Pod {
+				pod := newPod(t, now)
+				pod.Pod.ObjectMeta.Annotations[ConsulServicePortOverride+"servicename2"] = "grpc"
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": pod}
+			},
+			// the registered service is left alone
+			consul: func(t *testing.T) *consultest.Consul { return agent(t, newPod(t, time.Time{})) },
+			expected: []planSummary{
+				{SyncActionInvalid, serviceID2},
+			},
+		},
+		{
+			name: "last sync failed",
+			pods: func(t *testing.T) map[string]*Pod {
+				pod := newPod(t, now)
+				pod.SyncStatuses.GetStatus("servicename2").LastError = fmt.Errorf("Unable to resolve port of servicename2")
+				return map[string]*Pod{"hw/hw-7df6995f69-96wth": pod}
+			},
+			consul: func(t *testing.T) *consultest.Consul { return agent(t, newPod(t, time.Time{})) },
+			expected: []planSummary{
+				{SyncActionUpdateTTL, serviceID2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := test.consul(t)
+			plan := PlanSync(test.pods(t), c.AgentServices(), c.AgentChecks(), now)
+			var actual []planSummary
+			for _, action := range plan.Actions {
+				if action.Reason == "" {
+					t.Errorf("action without reason: %v", action)
+				}
+				actual = append(actual, planSummary{action.Type, action.ServiceID})
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("Mismatch expected=%v actual=%v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPlanSyncNoSideEffects(t *testing.T) {
+	pod, err := NewPod(loadTestPod(t, "connect/working"), &DaemonConfig{DefaultCheckTTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	snap := pod.Snapshot()
+
+	c := consultest.New("node")
+	for _, serviceName := range pod.GetServiceNames() {
+		if err := c.Agent().ServiceRegister(pod.Registration(serviceName, consulApi.HealthPassing, "")); err != nil {
+			t.Fatalf("error registering service: %v", err)
+		}
+	}
+	PlanSync(map[string]*Pod{"hw/hw-7df6995f69-96wth": pod}, c.AgentServices(), c.AgentChecks(), time.Now())
+	if !reflect.DeepEqual(pod.SyncStatuses, snap.SyncStatuses) {
+		t.Fatalf("planning changed the sync statuses: %v", pod.SyncStatuses)
+	}
+}
+
+func TestPlanSyncConnect(t *testing.T) {
+	now := time.Now()
+	const (
+		key            = "hw/hw-7df6995f69-96wth"
+		serviceID      = "katalog-sync_hw-service-name_hw_hw-7df6995f69-96wth"
+		proxyServiceID = "katalog-sync_hw-service-name_hw_hw-7df6995f69-96wth-sidecar-proxy"
+		serviceID2     = "katalog-sync_servicename2_hw_hw-7df6995f69-96wth"
+	)
+
+	pod, err := NewPod(loadTestPod(t, "connect/working"), &DaemonConfig{DefaultCheckTTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+
+	plan := PlanSync(map[string]*Pod{key: pod}, nil, nil, now)
+	c := consultest.New("node")
+	var actual []planSummary
+	for _, action := range plan.Actions {
+		actual = append(actual, planSummary{action.Type, action.ServiceID})
+		if err := c.Agent().ServiceRegister(action.Registration); err != nil {
+			t.Fatalf("error registering service: %v", err)
+		}
+	}
+	services, checks := c.AgentServices(), c.AgentChecks()
+	expected := []planSummary{
+		{SyncActionRegister, serviceID},
+		{SyncActionRegister, proxyServiceID},
+		{SyncActionRegister, serviceID2},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Mismatch expected=%v actual=%v", expected, actual)
+	}
+
+	// The proxy container isn't ready, so neither is the proxy; the service itself is
+	for _, action := range plan.Actions {
+		status := action.Registration.Check.Status
+		if action.ServiceID == proxyServiceID && status != consulApi.HealthCritical {
+			t.Fatalf("expected proxy to be critical, is %s", status)
+		}
+		if action.ServiceID != proxyServiceID && status != consulApi.HealthPassing {
+			t.Fatalf("expected %s to be passing, is %s", action.ServiceID, status)
+		}
+	}
+	if r := services[serviceID2]; r.Connect == nil || !r.Connect.Native {
+		t.Fatalf("expected %s to be connect native", serviceID2)
+	}
+
+	// Once registered, nothing changes
+	for _, status := range []string{"hw-service-name", "hw-service-name-sidecar-proxy", "servicename2"} {
+		pod.SyncStatuses.GetStatus(status).LastUpdated = now
+	}
+	if plan := PlanSync(map[string]*Pod{key: pod}, services, checks, now); len(plan.Actions) != 0 {
+		t.Fatalf("expected no actions, got %v", plan.Actions)
+	}
+
+	// Changing the upstreams re-registers the proxy
+	pod.Pod.ObjectMeta.Annotations[ConsulConnectUpstreams] = "db:9191"
+	plan = PlanSync(map[string]*Pod{key: pod}, services, checks, now)
+	if len(plan.Actions) != 1 || plan.Actions[0].Type != SyncActionReregister || plan.Actions[0].ServiceID != proxyServiceID {
+		t.Fatalf("expected reregister of proxy, got %v", plan.Actions)
+	}
+
+	// Removing the proxy deregisters it
+	delete(pod.Pod.ObjectMeta.Annotations, ConsulConnectProxyPortOverride+"hw-service-name")
+	plan = PlanSync(map[string]*Pod{key: pod}, services, checks, now)
+	if len(plan.Actions) != 1 || plan.Actions[0].Type != SyncActionDeregister || plan.Actions[0].ServiceID != proxyServiceID {
+		t.Fatalf("expected deregister of proxy, got %v", plan.Actions)
+	}
+}
+
+func TestPlanSyncConnectProbeChecks(t *testing.T) {
+	now := time.Now()
+	const (
+		key            = "hw/hw-7df6995f69-96wth"
+		serviceID      = "katalog-sync_hw-service-name_hw_hw-7df6995f69-96wth"
+		proxyServiceID = serviceID + "-sidecar-proxy"
+		readinessID    = serviceID + ":probe:hw:readiness"
+	)
+
+	k8sPod := loadTestPod(t, "connect/working")
+	k8sPod.ObjectMeta.Annotations[ConsulProbeChecks] = "readiness"
+	pod, err := NewPod(k8sPod, &DaemonConfig{DefaultCheckTTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+
+	plan := PlanSync(map[string]*Pod{key: pod}, nil, nil, now)
+	c := consultest.New("node")
+	for _, action := range plan.Actions {
+		if action.ServiceID == proxyServiceID && len(action.Registration.Checks) != 0 {
+			t.Fatalf("expected no probe checks on the proxy, got %v", action.Registration.Checks)
+		}
+		if err := c.Agent().ServiceRegister(action.Registration); err != nil {
+			t.Fatalf("error registering service: %v", err)
+		}
+	}
+	services, checks := c.AgentServices(), c.AgentChecks()
+	if check := checks[readinessID]; check == nil || check.ServiceID != serviceID {
+		t.Fatalf("expected readiness check on %s, got %+v", serviceID, check)
+	}
+
+	// Once registered, nothing changes
+	for _, status := range []string{"hw-service-name", "hw-service-name-sidecar-proxy", "servicename2"} {
+		pod.SyncStatuses.GetStatus(status).LastUpdated = now
+	}
+	if plan := PlanSync(map[string]*Pod{key: pod}, services, checks, now); len(plan.Actions) != 0 {
+		t.Fatalf("expected no actions, got %v", plan.Actions)
+	}
+}
+
+func TestPlanSyncProbeChecks(t *testing.T) {
+	now := time.Now()
+	const (
+		key           = "hw/hw-7df6995f69-96wth"
+		serviceID     = "katalog-sync_hw-service-name_hw_hw-7df6995f69-96wth"
+		serviceID2    = "katalog-sync_servicename2_hw_hw-7df6995f69-96wth"
+		readinessID   = serviceID + ":probe:hw:readiness"
+		livenessID    = serviceID + ":probe:hw:liveness"
+		livenessID2   = serviceID2 + ":probe:hw:liveness"
+		readinessNote = "readiness probe of container hw: GET http://10.1.1.140:8080/ready every 5s, timeout 1s"
+	)
+
+	k8sPod := loadTestPod(t, "basic/working")
+	k8sPod.ObjectMeta.Annotations[ConsulProbeChecks] = "readiness,liveness"
+	pod, err := NewPod(k8sPod, &DaemonConfig{DefaultCheckTTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+
+	// Register the services and their checks in the agent
+	plan := PlanSync(map[string]*Pod{key: pod}, nil, nil, now)
+	c := consultest.New("node")
+	for _, action := range plan.Actions {
+		for _, check := range action.Registration.Checks {
+			if check.Status != consulApi.HealthPassing {
+				t.Fatalf("expected probe check %s to start passing, is %s", check.CheckID, check.Status)
+			}
+		}
+		if err := c.Agent().ServiceRegister(action.Registration); err != nil {
+			t.Fatalf("error registering service: %v", err)
+		}
+	}
+	services, checks := c.AgentServices(), c.AgentChecks()
+	if len(checks) != 6 {
+		t.Fatalf("expected 2 TTL and 4 probe checks, got %v", checks)
+	}
+	if checks[readinessID] == nil || checks[readinessID].Notes != readinessNote {
+		t.Fatalf("unexpected readiness check: %+v", checks[readinessID])
+	}
+	for _, serviceName := range pod.GetServiceNames() {
+		pod.SyncStatuses.GetStatus(serviceName).LastUpdated = now
+	}
+	if plan := PlanSync(map[string]*Pod{key: pod}, services, checks, now); len(plan.Actions) != 0 {
+		t.Fatalf("expected no actions, got %v", plan.Actions)
+	}
+
+	// A changed probe check re-registers the service
+	checks[readinessID].Notes = "outdated"
+	plan = PlanSync(map[string]*Pod{key: pod}, services, checks, now)
+	if len(plan.Actions) != 1 || plan.Actions[0].Type != SyncActionReregister || plan.Actions[0].ServiceID != serviceID {
+		t.Fatalf("expected reregister of %s, got %v", serviceID, plan.Actions)
+	}
+	checks[readinessID].Notes = readinessNote
+
+	// Dropping the liveness probe checks deregisters them
+	pod.Pod.ObjectMeta.Annotations[ConsulProbeChecks] = "readiness"
+	plan = PlanSync(map[string]*Pod{key: pod}, services, checks, now)
+	var actual []SyncAction
+	for _, action := range plan.Actions {
+		actual = append(actual, SyncAction{Type: action.Type, ServiceID: action.ServiceID, CheckID: action.CheckID})
+	}
+	expected := []SyncAction{
+		{Type: SyncActionDeregisterCheck, ServiceID: serviceID, CheckID: livenessID},
+		{Type: SyncActionDeregisterCheck, ServiceID: serviceID2, CheckID: livenessID2},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Mismatch expected=%v actual=%v", expected, actual)
+	}
+}
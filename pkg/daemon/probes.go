@@ -0,0 +1,317 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Probe types which can be turned into consul checks
+const (
+	ProbeReadiness = "readiness"
+	ProbeLiveness  = "liveness"
+)
+
+// grpcHealthProbe is the binary of https://github.com/grpc-ecosystem/grpc-health-probe;
+// exec probes running it are turned into consul gRPC checks
+const grpcHealthProbe = "grpc_health_probe"
+
+// probeCheckIDInfix separates the service ID from the probe in the CheckIDs of
+// probe checks (serviceID:probe:container:probeType)
+const probeCheckIDInfix = ":probe:"
+
+// k8s defaults for probes which don't set a period/timeout
+const (
+	defaultProbePeriod  = 10 * time.Second
+	defaultProbeTimeout = time.Second
+)
+
+// validateProbeChecks checks the probe check annotations of all services of the pod
+func (p *Pod) validateProbeChecks() error {
+	for _, serviceName := range p.GetServiceNames() {
+		if _, err := p.getProbeTypes(serviceName); err != nil {
+			return err
+		}
+		if _, _, err := p.getProbeCheckTimings(serviceName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getProbeTypes returns the probe types to create consul checks from for the given service
+func (p *Pod) getProbeTypes(n string) ([]string, error) {
+	typesStr, ok := p.serviceAnnotation(ConsulProbeChecks, ConsulProbeChecksOverride, n)
+	if !ok || typesStr == "" {
+		return nil, nil
+	}
+	var types []string
+	for _, probeType := range strings.Split(typesStr, ",") {
+		probeType = strings.TrimSpace(probeType)
+		switch probeType {
+		case ProbeReadiness, ProbeLiveness:
+			types = append(types, probeType)
+		default:
+			return nil, fmt.Errorf("Unknown probe type %q, must be %s or %s", probeType, ProbeReadiness, ProbeLiveness)
+		}
+	}
+	return types, nil
+}
+
+// getProbeCheckTimings returns the interval and timeout overrides for the
+// probe checks of the given service, 0 if the probe's should be used
+func (p *Pod) getProbeCheckTimings(n string) (interval, timeout time.Duration, err error) {
+	if intervalStr, ok := p.serviceAnnotation(ConsulProbeCheckInterval, ConsulProbeCheckIntervalOverride, n); ok {
+		if interval, err = time.ParseDuration(intervalStr); err != nil {
+			return 0, 0, err
+		}
+	}
+	if timeoutStr, ok := p.serviceAnnotation(ConsulProbeCheckTimeout, ConsulProbeCheckTimeoutOverride, n); ok {
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+			return 0, 0, err
+		}
+	}
+	return interval, timeout, nil
+}
+
+// GetProbeChecks returns the consul checks for the given service derived from
+// the probes of the pod's containers. Probes are only turned into checks if
+// the service opts in through the probe-checks annotation; the katalog-sync
+// sidecar, the connect proxy and excluded containers are skipped.
+func (p *Pod) GetProbeChecks(n string) []*consulApi.AgentServiceCheck {
+	probeTypes, err := p.getProbeTypes(n)
+	if err != nil {
+		logrus.Errorf("Unable to parse probe checks for %s: %v", n, err)
+		return nil
+	}
+	if len(probeTypes) == 0 {
+		return nil
+	}
+	interval, timeout, err := p.getProbeCheckTimings(n)
+	if err != nil {
+		logrus.Errorf("Unable to parse probe check timings for %s: %v", n, err)
+		return nil
+	}
+
+	excludeContainers := p.ContainerExclusion()
+	var checks []*consulApi.AgentServiceCheck
+	for _, container := range p.Pod.Spec.Containers {
+		if _, ok := excludeContainers[container.Name]; ok {
+			continue
+		}
+		if p.SidecarState != nil && container.Name == p.SidecarState.SidecarName {
+			continue
+		}
+		if container.Name == p.ConnectProxyContainer() {
+			continue
+		}
+
+		for _, probeType := range probeTypes {
+			probe := container.ReadinessProbe
+			if probeType == ProbeLiveness {
+				probe = container.LivenessProbe
+			}
+			if probe == nil {
+				continue
+			}
+			check := p.probeCheck(container, probe)
+			if check == nil {
+				continue
+			}
+
+			checkInterval := time.Duration(probe.PeriodSeconds) * time.Second
+			if interval > 0 {
+				checkInterval = interval
+			} else if checkInterval <= 0 {
+				checkInterval = defaultProbePeriod
+			}
+			checkTimeout := time.Duration(probe.TimeoutSeconds) * time.Second
+			if timeout > 0 {
+				checkTimeout = timeout
+			} else if checkTimeout <= 0 {
+				checkTimeout = defaultProbeTimeout
+			}
+
+			check.CheckID = p.GetServiceID(n) + probeCheckIDInfix + container.Name + ":" + probeType
+			check.Name = fmt.Sprintf("%s %s probe", container.Name, probeType)
+			check.Interval = checkInterval.String()
+			check.Timeout = checkTimeout.String()
+			check.Notes = fmt.Sprintf("%s probe of container %s: %s every %s, timeout %s", probeType, container.Name, check.Notes, check.Interval, check.Timeout)
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+// probeCheck translates the handler of a probe into a consul check against the
+// pod IP. The check's Notes are set to a description of its target; nil is
+// returned for probes which can't be translated.
+func (p *Pod) probeCheck(container corev1.Container, probe *corev1.Probe) *consulApi.AgentServiceCheck {
+	switch {
+	case probe.HTTPGet != nil:
+		port, ok := containerPort(container, probe.HTTPGet.Port)
+		if !ok {
+			return nil
+		}
+		host := probe.HTTPGet.Host
+		if host == "" {
+			host = p.Status.PodIP
+		}
+		scheme := strings.ToLower(string(probe.HTTPGet.Scheme))
+		if scheme == "" {
+			scheme = "http"
+		}
+		probePath := probe.HTTPGet.Path
+		if !strings.HasPrefix(probePath, "/") {
+			probePath = "/" + probePath
+		}
+		url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), probePath)
+
+		check := &consulApi.AgentServiceCheck{
+			HTTP:   url,
+			Method: "GET",
+			// like the kubelet we don't verify certificates of probes
+			TLSSkipVerify: scheme == "https",
+			Notes:         "GET " + url,
+		}
+		for _, header := range probe.HTTPGet.HTTPHeaders {
+			if check.Header == nil {
+				check.Header = make(map[string][]string)
+			}
+			check.Header[header.Name] = append(check.Header[header.Name], header.Value)
+		}
+		return check
+
+	case probe.TCPSocket != nil:
+		port, ok := containerPort(container, probe.TCPSocket.Port)
+		if !ok {
+			return nil
+		}
+		host := probe.TCPSocket.Host
+		if host == "" {
+			host = p.Status.PodIP
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		return &consulApi.AgentServiceCheck{TCP: addr, Notes: "TCP " + addr}
+
+	case probe.Exec != nil:
+		port, service, useTLS, ok := parseGRPCHealthProbe(probe.Exec.Command)
+		if !ok {
+			return nil
+		}
+		target := net.JoinHostPort(p.Status.PodIP, strconv.Itoa(port))
+		if service != "" {
+			target += "/" + service
+		}
+		return &consulApi.AgentServiceCheck{GRPC: target, GRPCUseTLS: useTLS, Notes: "gRPC " + target}
+	}
+	return nil
+}
+
+// containerPort resolves a (possibly named) probe port of the container
+func containerPort(container corev1.Container, port intstr.IntOrString) (int, bool) {
+	if port.Type == intstr.Int {
+		return port.IntValue(), port.IntValue() > 0
+	}
+	for _, containerPort := range container.Ports {
+		if containerPort.Name == port.StrVal {
+			return int(containerPort.ContainerPort), true
+		}
+	}
+	if p, err := strconv.Atoi(port.StrVal); err == nil && p > 0 {
+		return p, true
+	}
+	return 0, false
+}
+
+// parseGRPCHealthProbe parses the port, service and TLS flag of a
+// grpc_health_probe command line. ok is false if the command isn't a
+// grpc_health_probe invocation with an -addr.
+func parseGRPCHealthProbe(command []string) (port int, service string, useTLS, ok bool) {
+	if len(command) == 0 || path.Base(command[0]) != grpcHealthProbe {
+		return 0, "", false, false
+	}
+
+	var addr string
+	args := command[1:]
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimLeft(args[i], "-")
+		name, value := arg, ""
+		hasValue := false
+		if idx := strings.Index(arg, "="); idx >= 0 {
+			name, value, hasValue = arg[:idx], arg[idx+1:], true
+		}
+		switch name {
+		case "addr", "service":
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if name == "addr" {
+				addr = value
+			} else {
+				service = value
+			}
+		case "tls":
+			useTLS = !hasValue || value == "true"
+		}
+	}
+
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, "", false, false
+	}
+	port, err = strconv.Atoi(portStr)
+	if err != nil || port <= 0 {
+		return 0, "", false, false
+	}
+	return port, service, useTLS, true
+}
+
+// probeChecksDiff returns the expected probe checks of a service which are
+// missing from or differ from the agent's checks
+func probeChecksDiff(expected []*consulApi.AgentServiceCheck, agentChecks map[string]*consulApi.AgentCheck) []string {
+	var diff []string
+	for _, check := range expected {
+		agentCheck, ok := agentChecks[check.CheckID]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("probe check %s: missing", check.CheckID))
+			continue
+		}
+		// The agent doesn't return all of the check definition (e.g. for
+		// gRPC), so we compare the description we put in the notes
+		if agentCheck.Notes != check.Notes {
+			diff = append(diff, fmt.Sprintf("probe check %s: %s -> %s", check.CheckID, agentCheck.Notes, check.Notes))
+		}
+	}
+	return diff
+}
+
+// staleProbeChecks returns the IDs of probe checks of the service in the agent
+// which are no longer expected, ordered by ID
+func staleProbeChecks(serviceID string, expected []*consulApi.AgentServiceCheck, agentChecks map[string]*consulApi.AgentCheck) []string {
+	expectedIDs := make(map[string]struct{}, len(expected))
+	for _, check := range expected {
+		expectedIDs[check.CheckID] = struct{}{}
+	}
+	var stale []string
+	for checkID, check := range agentChecks {
+		if check.ServiceID != serviceID || !strings.HasPrefix(checkID, serviceID+probeCheckIDInfix) {
+			continue
+		}
+		if _, ok := expectedIDs[checkID]; !ok {
+			stale = append(stale, checkID)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
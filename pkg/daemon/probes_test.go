@@ -0,0 +1,177 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+
+	consulApi "github.com/hashicorp/consul/api"
+	k8sApi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestProbeChecks(t *testing.T) {
+	const checkIDPrefix = "katalog-sync_hw-service-name_hw_hw-7df6995f69-96wth:probe:hw:"
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		modify      func(c *k8sApi.Container)
+		err         bool
+		checks      []*consulApi.AgentServiceCheck
+	}{
+		{
+			name: "not opted in",
+		},
+		{
+			name:        "readiness",
+			annotations: map[string]string{ConsulProbeChecks: "readiness"},
+			checks: []*consulApi.AgentServiceCheck{
+				{
+					CheckID:  checkIDPrefix + "readiness",
+					Name:     "hw readiness probe",
+					HTTP:     "http://10.1.1.140:8080/ready",
+					Method:   "GET",
+					Interval: "5s",
+					Timeout:  "1s",
+					Notes:    "readiness probe of container hw: GET http://10.1.1.140:8080/ready every 5s, timeout 1s",
+				},
+			},
+		},
+		{
+			name: "readiness and liveness with overrides",
+			annotations: map[string]string{
+				ConsulProbeChecks: "readiness",
+				ConsulProbeChecksOverride + "hw-service-name": "readiness, liveness",
+				ConsulProbeCheckInterval:                      "30s",
+			},
+			checks: []*consulApi.AgentServiceCheck{
+				{
+					CheckID:  checkIDPrefix + "readiness",
+					Name:     "hw readiness probe",
+					HTTP:     "http://10.1.1.140:8080/ready",
+					Method:   "GET",
+					Interval: "30s",
+					Timeout:  "1s",
+					Notes:    "readiness probe of container hw: GET http://10.1.1.140:8080/ready every 30s, timeout 1s",
+				},
+				{
+					CheckID:  checkIDPrefix + "liveness",
+					Name:     "hw liveness probe",
+					HTTP:     "http://10.1.1.140:8080/live",
+					Method:   "GET",
+					Interval: "30s",
+					Timeout:  "1s",
+					Notes:    "liveness probe of container hw: GET http://10.1.1.140:8080/live every 30s, timeout 1s",
+				},
+			},
+		},
+		{
+			name:        "https with named port and headers",
+			annotations: map[string]string{ConsulProbeChecks: "readiness"},
+			modify: func(c *k8sApi.Container) {
+				c.Ports[0].Name = "https"
+				c.ReadinessProbe.HTTPGet.Port = intstr.FromString("https")
+				c.ReadinessProbe.HTTPGet.Scheme = k8sApi.URISchemeHTTPS
+				c.ReadinessProbe.HTTPGet.HTTPHeaders = []k8sApi.HTTPHeader{{Name: "X-Probe", Value: "1"}}
+				c.ReadinessProbe.PeriodSeconds = 0
+				c.ReadinessProbe.TimeoutSeconds = 0
+			},
+			checks: []*consulApi.AgentServiceCheck{
+				{
+					CheckID:       checkIDPrefix + "readiness",
+					Name:          "hw readiness probe",
+					HTTP:          "https://10.1.1.140:8080/ready",
+					Header:        map[string][]string{"X-Probe": {"1"}},
+					Method:        "GET",
+					TLSSkipVerify: true,
+					Interval:      "10s",
+					Timeout:       "1s",
+					Notes:         "readiness probe of container hw: GET https://10.1.1.140:8080/ready every 10s, timeout 1s",
+				},
+			},
+		},
+		{
+			name:        "tcp",
+			annotations: map[string]string{ConsulProbeChecks: "readiness", ConsulProbeCheckTimeout: "3s"},
+			modify: func(c *k8sApi.Container) {
+				c.ReadinessProbe.Handler = k8sApi.Handler{TCPSocket: &k8sApi.TCPSocketAction{Port: intstr.FromInt(9090)}}
+			},
+			checks: []*consulApi.AgentServiceCheck{
+				{
+					CheckID:  checkIDPrefix + "readiness",
+					Name:     "hw readiness probe",
+					TCP:      "10.1.1.140:9090",
+					Interval: "5s",
+					Timeout:  "3s",
+					Notes:    "readiness probe of container hw: TCP 10.1.1.140:9090 every 5s, timeout 3s",
+				},
+			},
+		},
+		{
+			name:        "grpc_health_probe",
+			annotations: map[string]string{ConsulProbeChecks: "readiness"},
+			modify: func(c *k8sApi.Container) {
+				c.ReadinessProbe.Handler = k8sApi.Handler{Exec: &k8sApi.ExecAction{
+					Command: []string{"/bin/grpc_health_probe", "-addr=:5000", "-service", "hw.Health", "-tls"},
+				}}
+			},
+			checks: []*consulApi.AgentServiceCheck{
+				{
+					CheckID:    checkIDPrefix + "readiness",
+					Name:       "hw readiness probe",
+					GRPC:       "10.1.1.140:5000/hw.Health",
+					GRPCUseTLS: true,
+					Interval:   "5s",
+					Timeout:    "1s",
+					Notes:      "readiness probe of container hw: gRPC 10.1.1.140:5000/hw.Health every 5s, timeout 1s",
+				},
+			},
+		},
+		{
+			name:        "other exec probes are skipped",
+			annotations: map[string]string{ConsulProbeChecks: "readiness"},
+			modify: func(c *k8sApi.Container) {
+				c.ReadinessProbe.Handler = k8sApi.Handler{Exec: &k8sApi.ExecAction{Command: []string{"cat", "/tmp/ready"}}}
+			},
+		},
+		{
+			name:        "excluded containers are skipped",
+			annotations: map[string]string{ConsulProbeChecks: "readiness", ContainerExclusion: "hw"},
+		},
+		{
+			name:        "invalid probe type",
+			annotations: map[string]string{ConsulProbeChecks: "startup"},
+			err:         true,
+		},
+		{
+			name:        "invalid interval",
+			annotations: map[string]string{ConsulProbeChecks: "readiness", ConsulProbeCheckInterval: "often"},
+			err:         true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k8sPod := loadTestPod(t, "basic/working")
+			for k, v := range test.annotations {
+				k8sPod.ObjectMeta.Annotations[k] = v
+			}
+			if test.modify != nil {
+				test.modify(&k8sPod.Spec.Containers[0])
+			}
+
+			pod, err := NewPod(k8sPod, &DaemonConfig{})
+			if (err != nil) != test.err {
+				t.Fatalf("expected error=%v, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			checks := pod.GetProbeChecks("hw-service-name")
+			if !reflect.DeepEqual(checks, test.checks) {
+				t.Fatalf("Mismatch expected=%+v actual=%+v", test.checks, checks)
+			}
+		})
+	}
+}
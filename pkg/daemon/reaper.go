@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"sort"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var criticalServicesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "katalog_sync_critical_services",
+	Help: "How many services katalog-sync registered are critical in the agent",
+})
+
+func init() {
+	prometheus.MustRegister(criticalServicesGauge)
+}
+
+// criticalServices returns the services katalog-sync owns whose TTL check is
+// critical, ordered by ID
+func (d *Daemon) criticalServices(agentServices map[string]*consulApi.AgentService, agentChecks map[string]*consulApi.AgentCheck) []*consulApi.AgentService {
+	var critical []*consulApi.AgentService
+	for serviceID, service := range agentServices {
+		if !d.ownsService(service) {
+			continue
+		}
+		// The TTL check has the ID of the service
+		if check, ok := agentChecks[serviceID]; ok && check.Status == consulApi.HealthCritical {
+			critical = append(critical, service)
+		}
+	}
+
+	sort.Slice(critical, func(i, j int) bool { return critical[i].ID < critical[j].ID })
+	criticalServicesGauge.Set(float64(len(critical)))
+	return critical
+}
+
+// reapCriticalServices logs the services katalog-sync owns which are critical
+// in the agent, e.g. left behind by a daemon which disappeared. With
+// ReapCriticalServices those of pods which no longer exist are deregistered,
+// ahead of the first sync and its mass-deregistration guard; they serve no
+// traffic anyway. The services of pods which still exist are left alone, they
+// are critical because their pod isn't ready.
+func (d *Daemon) reapCriticalServices() error {
+	services, err := d.consulAgent.Services()
+	if err != nil {
+		return err
+	}
+	checks, err := d.consulAgent.Checks()
+	if err != nil {
+		return err
+	}
+
+	podKeys := d.state.Keys()
+	for _, service := range d.criticalServices(services, checks) {
+		key := service.Meta[ConsulK8sLinkName]
+		_, exists := podKeys[key]
+		logrus.Warnf("Service %s of pod %s is critical: %s", service.ID, key, checks[service.ID].Output)
+		if exists || !d.c.ReapCriticalServices || d.c.DryRun {
+			continue
+		}
+		if err := d.consulAgent.ServiceDeregister(service.ID); err != nil {
+			return err
+		}
+		logrus.Infof("Reaped critical service %s of pod %s which no longer exists", service.ID, key)
+	}
+	return nil
+}
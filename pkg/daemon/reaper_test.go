@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+)
+
+func TestDeregisterCriticalServiceAfter(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		dflt        time.Duration
+		err         bool
+		after       string
+		checkName   string
+	}{
+		{
+			name:      "disabled",
+			checkName: "katalog-sync readiness (ttl 20s)",
+		},
+		{
+			name:      "default",
+			dflt:      time.Minute,
+			after:     "1m0s",
+			checkName: "katalog-sync readiness (ttl 20s, deregister after 1m0s)",
+		},
+		{
+			name:        "default raised above a longer check TTL",
+			annotations: map[string]string{ConsulServiceCheckTTL: "2m"},
+			dflt:        time.Minute,
+			after:       "2m10s",
+			checkName:   "katalog-sync readiness (ttl 2m0s, deregister after 2m10s)",
+		},
+		{
+			name:        "annotation",
+			annotations: map[string]string{ConsulDeregisterCriticalServiceAfter: "1h"},
+			dflt:        time.Minute,
+			after:       "1h0m0s",
+			checkName:   "katalog-sync readiness (ttl 20s, deregister after 1h0m0s)",
+		},
+		{
+			name:        "annotation disables the default",
+			annotations: map[string]string{ConsulDeregisterCriticalServiceAfter: "0s"},
+			dflt:        time.Minute,
+			checkName:   "katalog-sync readiness (ttl 20s)",
+		},
+		{
+			name:        "annotation not above the check TTL",
+			annotations: map[string]string{ConsulDeregisterCriticalServiceAfter: "20s"},
+			err:         true,
+		},
+		{
+			name:        "invalid annotation",
+			annotations: map[string]string{ConsulDeregisterCriticalServiceAfter: "soon"},
+			err:         true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k8sPod := loadTestPod(t, "basic/working")
+			for k, v := range test.annotations {
+				k8sPod.ObjectMeta.Annotations[k] = v
+			}
+
+			pod, err := NewPod(k8sPod, &DaemonConfig{
+				DefaultCheckTTL:                       20 * time.Second,
+				SyncTTLBuffer:                         10 * time.Second,
+				DefaultDeregisterCriticalServiceAfter: test.dflt,
+			})
+			if (err != nil) != test.err {
+				t.Fatalf("expected error=%v, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			check := pod.Registration("hw-service-name", consulApi.HealthPassing, "").Check
+			if check.DeregisterCriticalServiceAfter != test.after || check.Name != test.checkName {
+				t.Fatalf("Mismatch expected=%q/%q actual=%q/%q", test.after, test.checkName, check.DeregisterCriticalServiceAfter, check.Name)
+			}
+		})
+	}
+}
+
+func TestDaemonReapCriticalServices(t *testing.T) {
+	const orphanID = "katalog-sync_gone_hw_gone-pod"
+
+	// The pod which still exists isn't ready
+	k8sPod := loadTestPod(t, "basic/working")
+	k8sPod.Status.ContainerStatuses[0].Ready = false
+	pod, err := NewPod(k8sPod, &DaemonConfig{DefaultCheckTTL: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(k8sPod)
+
+	// A previous daemon left critical services of that pod and of one which
+	// is gone behind
+	consul := consultest.New(testNodeName)
+	register := func(r *consulApi.AgentServiceRegistration) {
+		if err := consul.Agent().ServiceRegister(r); err != nil {
+			t.Fatalf("error registering service: %v", err)
+		}
+	}
+	for _, serviceName := range pod.GetServiceNames() {
+		register(pod.Registration(serviceName, consulApi.HealthCritical, ""))
+	}
+	register(&consulApi.AgentServiceRegistration{
+		ID:   orphanID,
+		Name: "gone",
+		Meta: map[string]string{ConsulSyncSourceName: ConsulSyncSourceValue, ConsulK8sLinkName: "hw/gone-pod"},
+		Check: &consulApi.AgentServiceCheck{
+			CheckID: orphanID,
+			TTL:     "10s",
+			Status:  consulApi.HealthCritical,
+		},
+	})
+
+	// The guard holds back any deregistration by the sync, so only the reaper
+	// can remove the orphan
+	c := testDaemonConfig()
+	c.MaxDeregisterPercent = 1
+	c.DeregisterGuardWindow = time.Hour
+	c.ReapCriticalServices = true
+	startTestDaemon(t, c, kubelet, consul)
+
+	services := consul.AgentServices()
+	if _, ok := services[orphanID]; ok {
+		t.Fatalf("expected orphaned critical service to be reaped")
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected the services of the pod which isn't ready to stay, have %v", services)
+	}
+	if s := checkStatus(consul, basicServiceID); s != consulApi.HealthCritical {
+		t.Fatalf("expected check to be critical, is %q", s)
+	}
+}
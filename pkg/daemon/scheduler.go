@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"container/heap"
+	"time"
+)
+
+// kubeletScheduleKey is the schedule key for fetches from the kubelet. As pod
+// keys always contain a "/" this can't collide with a pod.
+const kubeletScheduleKey = "kubelet"
+
+// deregisterGuardScheduleKey is the schedule key for re-syncing the
+// deregistrations held back by the mass-deregistration guard once its window
+// has passed. Syncing it only syncs the services which don't belong to a pod.
+const deregisterGuardScheduleKey = "deregister-guard"
+
+// scheduleItem is a single entry in the schedule
+type scheduleItem struct {
+	key   string
+	due   time.Time
+	index int // index in the heap
+}
+
+// scheduleHeap implements heap.Interface ordered by due time
+type scheduleHeap []*scheduleItem
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	item := x.(*scheduleItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// schedule is a priority queue of the sync work the daemon has to do, keyed
+// on the time each key (pod or kubelet fetch) is next due. A key is in the
+// schedule at most once. schedule is not safe for concurrent use.
+type schedule struct {
+	h     scheduleHeap
+	items map[string]*scheduleItem
+}
+
+func newSchedule() *schedule {
+	return &schedule{items: make(map[string]*scheduleItem)}
+}
+
+// Set schedules key to be due at the given time, replacing any existing entry
+func (s *schedule) Set(key string, due time.Time) {
+	if item, ok := s.items[key]; ok {
+		item.due = due
+		heap.Fix(&s.h, item.index)
+		return
+	}
+	item := &scheduleItem{key: key, due: due}
+	s.items[key] = item
+	heap.Push(&s.h, item)
+}
+
+// SetEarlier schedules key to be due at the given time, unless it is already
+// due before then
+func (s *schedule) SetEarlier(key string, due time.Time) {
+	if item, ok := s.items[key]; ok && item.due.Before(due) {
+		return
+	}
+	s.Set(key, due)
+}
+
+// Remove removes key from the schedule
+func (s *schedule) Remove(key string) {
+	item, ok := s.items[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&s.h, item.index)
+	delete(s.items, key)
+}
+
+// Next returns the time the next key is due, false if the schedule is empty
+func (s *schedule) Next() (time.Time, bool) {
+	if len(s.h) == 0 {
+		return time.Time{}, false
+	}
+	return s.h[0].due, true
+}
+
+// PopDue removes and returns all keys that are due at (or before) now
+func (s *schedule) PopDue(now time.Time) []string {
+	var keys []string
+	for len(s.h) > 0 && !s.h[0].due.After(now) {
+		item := heap.Pop(&s.h).(*scheduleItem)
+		delete(s.items, item.key)
+		keys = append(keys, item.key)
+	}
+	return keys
+}
@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	s := newSchedule()
+	if _, ok := s.Next(); ok {
+		t.Fatalf("empty schedule has a next item")
+	}
+
+	s.Set("a", at(3))
+	s.Set("b", at(1))
+	s.Set("c", at(2))
+	s.Set(kubeletScheduleKey, at(5))
+
+	if next, _ := s.Next(); !next.Equal(at(1)) {
+		t.Fatalf("wrong next due time: %v", next)
+	}
+
+	// Rescheduling replaces the existing entry
+	s.Set("b", at(4))
+	// SetEarlier only moves entries forward
+	s.SetEarlier("a", at(10))
+	s.SetEarlier("c", at(0))
+	s.Remove("missing")
+
+	if keys := s.PopDue(at(0)); !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Fatalf("wrong due keys: %v", keys)
+	}
+	if keys := s.PopDue(at(3)); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Fatalf("wrong due keys: %v", keys)
+	}
+
+	s.Remove("b")
+	if keys := s.PopDue(at(10)); !reflect.DeepEqual(keys, []string{kubeletScheduleKey}) {
+		t.Fatalf("wrong due keys: %v", keys)
+	}
+	if _, ok := s.Next(); ok {
+		t.Fatalf("schedule should be empty")
+	}
+}
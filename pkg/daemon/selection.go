@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// podSelection decides which pods of the node the daemon syncs
+type podSelection struct {
+	namespaces        []string // namespace patterns pods must match one of, all if empty
+	excludeNamespaces []string // namespace patterns pods must match none of
+	selector          labels.Selector
+}
+
+// newPodSelection returns the pod selection the config defines
+func newPodSelection(c *DaemonConfig) (*podSelection, error) {
+	for _, pattern := range append(append([]string{}, c.Namespaces...), c.ExcludeNamespaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern %q: %v", pattern, err)
+		}
+	}
+	selector, err := labels.Parse(c.PodSelector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pod selector %q: %v", c.PodSelector, err)
+	}
+	return &podSelection{
+		namespaces:        c.Namespaces,
+		excludeNamespaces: c.ExcludeNamespaces,
+		selector:          selector,
+	}, nil
+}
+
+// Matches returns whether the pod should be synced
+func (s *podSelection) Matches(pod *corev1.Pod) bool {
+	if s == nil {
+		return true
+	}
+	if len(s.namespaces) > 0 && !matchNamespace(s.namespaces, pod.Namespace) {
+		return false
+	}
+	if matchNamespace(s.excludeNamespaces, pod.Namespace) {
+		return false
+	}
+	return s.selector.Matches(labels.Set(pod.ObjectMeta.Labels))
+}
+
+// matchNamespace returns whether the namespace matches any of the patterns
+func matchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		// patterns were validated in newPodSelection
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"testing"
+
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodSelection(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       DaemonConfig
+		matches map[string]bool // namespace -> whether a pod labeled tier=web in it matches
+		err     bool
+	}{
+		{
+			name:    "everything",
+			matches: map[string]bool{"default": true, "sandbox-1": true},
+		},
+		{
+			name:    "namespaces",
+			c:       DaemonConfig{Namespaces: []string{"canary", "canary-*"}},
+			matches: map[string]bool{"canary": true, "canary-eu": true, "default": false},
+		},
+		{
+			name:    "excluded namespaces",
+			c:       DaemonConfig{Namespaces: []string{"*"}, ExcludeNamespaces: []string{"sandbox-*"}},
+			matches: map[string]bool{"default": true, "sandbox-1": false},
+		},
+		{
+			name:    "selector",
+			c:       DaemonConfig{PodSelector: "tier in (web, api)"},
+			matches: map[string]bool{"default": true},
+		},
+		{
+			name:    "selector not matching",
+			c:       DaemonConfig{PodSelector: "tier!=web"},
+			matches: map[string]bool{"default": false},
+		},
+		{
+			name: "invalid pattern",
+			c:    DaemonConfig{ExcludeNamespaces: []string{"sandbox-["}},
+			err:  true,
+		},
+		{
+			name: "invalid selector",
+			c:    DaemonConfig{PodSelector: "tier in web"},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := newPodSelection(&test.c)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error=%v, got %v", test.err, err)
+			}
+			for namespace, matches := range test.matches {
+				pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Labels: map[string]string{"tier": "web"}}}
+				if s.Matches(pod) != matches {
+					t.Errorf("expected pod in %s matches=%v", namespace, matches)
+				}
+			}
+		})
+	}
+}
+
+func TestDaemonPodSelection(t *testing.T) {
+	canary := loadTestPod(t, "basic/working")
+	canary.Namespace = "canary"
+	sandbox := loadTestPod(t, "sidecar/working")
+	sandbox.Namespace = "sandbox"
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(canary, sandbox)
+	consul := consultest.New(testNodeName)
+
+	c := testDaemonConfig()
+	c.ExcludeNamespaces = []string{"sandbox*"}
+	c.PodSelector = "app=hw"
+	startTestDaemon(t, c, kubelet, consul)
+
+	services := consul.AgentServices()
+	if len(services) != 2 {
+		t.Fatalf("expected the 2 services of the canary pod, have %d", len(services))
+	}
+	for _, service := range services {
+		if service.Meta[ConsulK8sNamespace] != "canary" {
+			t.Fatalf("service of excluded pod registered: %+v", service)
+		}
+	}
+
+	// Pods which no longer match are deregistered
+	canary.ObjectMeta.Labels["app"] = "other"
+	kubelet.SetPods(canary, sandbox)
+	eventually(t, "services deregistered", func() bool {
+		return len(consul.AgentServices()) == 0
+	})
+}
@@ -0,0 +1,160 @@
+package daemon
+
+import (
+	"fmt"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"sigs.k8s.io/yaml"
+)
+
+// ServiceSpec is the definition of a service in the services annotation. Any
+// field set here takes precedence over the legacy per-field annotations, which
+// still apply to the fields left unset.
+type ServiceSpec struct {
+	Name        string            `json:"name"`
+	Port        int               `json:"port,omitempty"`         // port to register the service with
+	PortName    string            `json:"port_name,omitempty"`    // name of a container port to register the service with
+	Tags        []string          `json:"tags,omitempty"`         // tags of the service, [] for none
+	Meta        map[string]string `json:"meta,omitempty"`         // meta of the service, {} for none
+	Health      string            `json:"health,omitempty"`       // health status override (passing/warning/critical)
+	Weights     *ServiceWeights   `json:"weights,omitempty"`      // weights in DNS/SRV answers
+	CheckTTL    string            `json:"check_ttl,omitempty"`    // TTL of the service's check
+	AddressMode string            `json:"address_mode,omitempty"` // address source (podIP/hostIP/ipv4/ipv6) or a literal address
+}
+
+// ServiceWeights are the weights of a service in the services annotation,
+// both default to 1
+type ServiceWeights struct {
+	Passing *int `json:"passing,omitempty"`
+	Warning *int `json:"warning,omitempty"`
+}
+
+// parseServiceSpecs parses the JSON or YAML list of service definitions of the
+// services annotation, rejecting unknown fields
+func (a annotations) parseServiceSpecs(value string) ([]ServiceSpec, error) {
+	var specs []ServiceSpec
+	if err := yaml.UnmarshalStrict([]byte(value), &specs); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", a.key(ConsulServices), err)
+	}
+	return specs, nil
+}
+
+// serviceSpecs returns the services defined in the services annotation. It
+// is parsed by configure, so if the annotation became invalid the last valid
+// definitions are kept.
+func (p *Pod) serviceSpecs() []ServiceSpec {
+	return p.services
+}
+
+// serviceSpec returns the definition of the given service in the services
+// annotation, nil if it isn't defined there
+func (p *Pod) serviceSpec(n string) *ServiceSpec {
+	specs := p.serviceSpecs()
+	for i := range specs {
+		if specs[i].Name == n {
+			return &specs[i]
+		}
+	}
+	return nil
+}
+
+// validateServiceSpecs parses and checks the services annotation, returning
+// the services it defines and the largest check TTL among them
+func (p *Pod) validateServiceSpecs(minCheckTTL time.Duration) ([]ServiceSpec, time.Duration, error) {
+	value, ok := p.annotation(ConsulServices)
+	if !ok {
+		return nil, 0, nil
+	}
+	specs, err := p.annotations.parseServiceSpecs(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	name := p.annotations.key(ConsulServices)
+	if len(specs) == 0 {
+		return nil, 0, fmt.Errorf("%s must define at least one service", name)
+	}
+
+	var maxCheckTTL time.Duration
+	names := make(map[string]struct{}, len(specs))
+	for i, spec := range specs {
+		if err := spec.validate(p, minCheckTTL); err != nil {
+			return nil, 0, fmt.Errorf("%s: service %d (%s): %v", name, i, spec.Name, err)
+		}
+		if _, ok := names[spec.Name]; ok {
+			return nil, 0, fmt.Errorf("%s: service %d (%s): duplicate service name", name, i, spec.Name)
+		}
+		names[spec.Name] = struct{}{}
+		if checkTTL, _ := time.ParseDuration(spec.CheckTTL); checkTTL > maxCheckTTL {
+			maxCheckTTL = checkTTL
+		}
+	}
+	return specs, maxCheckTTL, nil
+}
+
+// validate checks the fields of a service definition
+func (s *ServiceSpec) validate(p *Pod, minCheckTTL time.Duration) error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Port != 0 && s.PortName != "" {
+		return fmt.Errorf("only one of port and port_name may be set")
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid port %d: must be between 1 and 65535, or 0 for unset", s.Port)
+	}
+	if s.PortName != "" {
+		if _, err := p.namedPort(s.PortName); err != nil {
+			return err
+		}
+	}
+	switch s.Health {
+	case "", consulApi.HealthPassing, consulApi.HealthWarning, consulApi.HealthCritical:
+	default:
+		return fmt.Errorf("invalid health %q: must be one of %s, %s or %s", s.Health, consulApi.HealthPassing, consulApi.HealthWarning, consulApi.HealthCritical)
+	}
+	if s.Weights != nil {
+		if s.Weights.Passing != nil && *s.Weights.Passing < 1 {
+			return fmt.Errorf("invalid passing weight %d: must be at least 1", *s.Weights.Passing)
+		}
+		if s.Weights.Warning != nil && *s.Weights.Warning < 0 {
+			return fmt.Errorf("invalid warning weight %d: must not be negative", *s.Weights.Warning)
+		}
+	}
+	if s.CheckTTL != "" {
+		checkTTL, err := time.ParseDuration(s.CheckTTL)
+		if err != nil {
+			return fmt.Errorf("invalid check_ttl %q: %v", s.CheckTTL, err)
+		}
+		// The check must not expire between two syncs
+		if checkTTL < minCheckTTL {
+			return fmt.Errorf("invalid check_ttl %s: must be at least %s (sync interval + buffer)", checkTTL, minCheckTTL)
+		}
+	}
+	if err := validateAddressSource(s.AddressMode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// weights returns the consul weights of the service definition
+func (w *ServiceWeights) weights() *consulApi.AgentWeights {
+	weights := &consulApi.AgentWeights{Passing: 1, Warning: 1}
+	if w.Passing != nil {
+		weights.Passing = *w.Passing
+	}
+	if w.Warning != nil {
+		weights.Warning = *w.Warning
+	}
+	return weights
+}
+
+// GetCheckTTL returns the TTL of the check of the given service
+func (p *Pod) GetCheckTTL(n string) time.Duration {
+	if spec := p.serviceSpec(n); spec != nil && spec.CheckTTL != "" {
+		if checkTTL, err := time.ParseDuration(spec.CheckTTL); err == nil {
+			return checkTTL
+		}
+	}
+	return p.CheckTTL
+}
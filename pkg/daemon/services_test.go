@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+func TestServiceSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		services string
+		err      string
+	}{
+		{
+			name:     "unknown field",
+			services: "- name: hw-service-name\n  prot: 8080",
+			err:      `Unable to parse katalog-sync.wish.com/services: error unmarshaling JSON: while decoding JSON: json: unknown field "prot"`,
+		},
+		{
+			name:     "not a list",
+			services: "name: hw-service-name",
+			err:      "Unable to parse katalog-sync.wish.com/services: error unmarshaling JSON: while decoding JSON: json: cannot unmarshal object into Go value of type []daemon.ServiceSpec",
+		},
+		{
+			name:     "empty",
+			services: "[]",
+			err:      "katalog-sync.wish.com/services must define at least one service",
+		},
+		{
+			name:     "missing name",
+			services: `[{"port": 80}]`,
+			err:      "katalog-sync.wish.com/services: service 0 (): name is required",
+		},
+		{
+			name:     "duplicate name",
+			services: `[{"name": "a"}, {"name": "a"}]`,
+			err:      "katalog-sync.wish.com/services: service 1 (a): duplicate service name",
+		},
+		{
+			name:     "port and port name",
+			services: `[{"name": "a", "port": 80, "port_name": "http"}]`,
+			err:      "katalog-sync.wish.com/services: service 0 (a): only one of port and port_name may be set",
+		},
+		{
+			name:     "invalid port",
+			services: `[{"name": "a", "port": 70000}]`,
+			err:      "katalog-sync.wish.com/services: service 0 (a): invalid port 70000: must be between 1 and 65535, or 0 for unset",
+		},
+		{
+			name:     "unknown port name",
+			services: `[{"name": "a", "port_name": "grpc"}]`,
+			err:      `katalog-sync.wish.com/services: service 0 (a): no container port named "grpc"`,
+		},
+		{
+			name:     "invalid health",
+			services: `[{"name": "a", "health": "ok"}]`,
+			err:      `katalog-sync.wish.com/services: service 0 (a): invalid health "ok": must be one of passing, warning or critical`,
+		},
+		{
+			name:     "invalid weight",
+			services: `[{"name": "a", "weights": {"passing": 0}}]`,
+			err:      "katalog-sync.wish.com/services: service 0 (a): invalid passing weight 0: must be at least 1",
+		},
+		{
+			name:     "check TTL too short",
+			services: `[{"name": "a", "check_ttl": "1s"}]`,
+			err:      "katalog-sync.wish.com/services: service 0 (a): invalid check_ttl 1s: must be at least 7s (sync interval + buffer)",
+		},
+		{
+			name:     "invalid address mode",
+			services: `[{"name": "a", "address_mode": "nodeIP!"}]`,
+			err:      `katalog-sync.wish.com/services: service 0 (a): Invalid service address "nodeIP!": must be one of podIP, hostIP, ipv4, ipv6 or an IP or hostname`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k8sPod := loadTestPod(t, "basic/working")
+			k8sPod.ObjectMeta.Annotations[ConsulServices] = test.services
+			k8sPod.Spec.Containers[0].Ports[0].Name = "http"
+
+			_, err := NewPod(k8sPod, &DaemonConfig{SyncTTLBuffer: 5 * time.Second})
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestServiceSpecPrecedence(t *testing.T) {
+	k8sPod := loadTestPod(t, "basic/working")
+	k8sPod.ObjectMeta.Annotations[ConsulServiceHealth] = consulApi.HealthWarning
+	k8sPod.ObjectMeta.Annotations[ConsulServiceAddress] = AddressSourceHostIP
+	k8sPod.ObjectMeta.Annotations[ConsulDeregisterCriticalServiceAfter] = "1m"
+	k8sPod.ObjectMeta.Annotations[ConsulServices] = `
+- name: hw-service-name
+  health: critical
+  check_ttl: 30s
+  address_mode: 10.0.0.1
+- name: servicename2
+`
+
+	pod, err := NewPod(k8sPod, &DaemonConfig{DefaultCheckTTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+
+	// Fields set in the services annotation win over the legacy annotations
+	r := pod.Registration("hw-service-name", consulApi.HealthPassing, "")
+	if r.Check.Status != consulApi.HealthCritical || r.Check.TTL != "30s" || r.Address != "10.0.0.1" {
+		t.Fatalf("unexpected registration: %+v %+v", r, r.Check)
+	}
+	// Unset fields fall back to them
+	r = pod.Registration("servicename2", consulApi.HealthPassing, "")
+	if r.Check.Status != consulApi.HealthWarning || r.Check.TTL != "10s" || r.Address != k8sPod.Status.HostIP {
+		t.Fatalf("unexpected registration: %+v %+v", r, r.Check)
+	}
+
+	// Deregistering critical services must wait for the longest check TTL
+	k8sPod.ObjectMeta.Annotations[ConsulDeregisterCriticalServiceAfter] = "20s"
+	if _, err := NewPod(k8sPod, &DaemonConfig{DefaultCheckTTL: 10 * time.Second}); err == nil {
+		t.Fatalf("expected an error for deregistering before the check TTL")
+	}
+}
+
+func TestServiceSpecsUpdate(t *testing.T) {
+	dc := &DaemonConfig{DefaultCheckTTL: 10 * time.Second}
+	k8sPod := loadTestPod(t, "basic/working")
+	delete(k8sPod.ObjectMeta.Annotations, ConsulServiceNames)
+	k8sPod.ObjectMeta.Annotations[ConsulServices] = "- name: hw-service-name\n"
+	pod, err := NewPod(k8sPod, dc)
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+
+	// Changes to the annotation are picked up
+	k8sPod = *pod.Pod.DeepCopy()
+	k8sPod.ObjectMeta.Annotations[ConsulServices] = "- name: hw-service-name\n- name: servicename2\n"
+	pod.UpdatePod(k8sPod, dc)
+	if names := pod.GetServiceNames(); !reflect.DeepEqual(names, []string{"hw-service-name", "servicename2"}) {
+		t.Fatalf("unexpected service names %v", names)
+	}
+
+	// If it becomes invalid the last valid services are kept
+	k8sPod = *pod.Pod.DeepCopy()
+	k8sPod.ObjectMeta.Annotations[ConsulServices] = "- name: [invalid"
+	pod.UpdatePod(k8sPod, dc)
+	if names := pod.GetServiceNames(); !reflect.DeepEqual(names, []string{"hw-service-name", "servicename2"}) {
+		t.Fatalf("unexpected service names %v", names)
+	}
+	if err := pod.ConfigError(dc); err == nil {
+		t.Fatalf("expected the invalid annotation to be reported")
+	}
+	key := podCacheKey(pod.Namespace, pod.Name)
+	plan := PlanSync(map[string]*Pod{key: pod}, nil, nil, time.Now())
+	var serviceIDs []string
+	for _, action := range plan.Actions {
+		serviceIDs = append(serviceIDs, action.ServiceID)
+	}
+	expected := []string{basicServiceID, "katalog-sync_servicename2_hw_hw-7df6995f69-96wth"}
+	if !reflect.DeepEqual(serviceIDs, expected) {
+		t.Fatalf("Mismatch expected=%v actual=%v", expected, serviceIDs)
+	}
+}
@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"sync"
+)
+
+// podStore owns the daemon's local representation of the pods running on this
+// node. All mutations are serialized through the store's lock, and readers
+// (RPC handlers, metrics, readiness gates) are handed snapshots which they can
+// use without holding any lock.
+type podStore struct {
+	l    sync.RWMutex
+	pods map[string]*Pod
+}
+
+func newPodStore() *podStore {
+	return &podStore{pods: make(map[string]*Pod)}
+}
+
+// Get returns a snapshot of the pod stored under key
+func (s *podStore) Get(key string) (*Pod, bool) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	pod, ok := s.pods[key]
+	if !ok {
+		return nil, false
+	}
+	return pod.Snapshot(), true
+}
+
+// Snapshot returns a snapshot of all pods in the store (key -> pod)
+func (s *podStore) Snapshot() map[string]*Pod {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	pods := make(map[string]*Pod, len(s.pods))
+	for k, pod := range s.pods {
+		pods[k] = pod.Snapshot()
+	}
+	return pods
+}
+
+// SnapshotKeys returns a snapshot of the pods in the store with the given keys
+func (s *podStore) SnapshotKeys(keys map[string]struct{}) map[string]*Pod {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	pods := make(map[string]*Pod, len(keys))
+	for k := range keys {
+		if pod, ok := s.pods[k]; ok {
+			pods[k] = pod.Snapshot()
+		}
+	}
+	return pods
+}
+
+// Keys returns the set of keys of all pods in the store
+func (s *podStore) Keys() map[string]struct{} {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	keys := make(map[string]struct{}, len(s.pods))
+	for k := range s.pods {
+		keys[k] = struct{}{}
+	}
+	return keys
+}
+
+// Len returns the number of pods in the store
+func (s *podStore) Len() int {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return len(s.pods)
+}
+
+// View calls f with the live pod map while holding the read lock. f must not
+// modify the pods or retain any references to them after returning.
+func (s *podStore) View(f func(pods map[string]*Pod)) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	f(s.pods)
+}
+
+// Apply calls f with the live pod map while holding the write lock. As every
+// reader waits on this lock, f must not block (e.g. on network calls).
+func (s *podStore) Apply(f func(pods map[string]*Pod)) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	f(s.pods)
+}
+
+// Update calls f with the live pod stored under key while holding the write
+// lock, returning whether the pod was found.
+func (s *podStore) Update(key string, f func(*Pod)) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	pod, ok := s.pods[key]
+	if !ok {
+		return false
+	}
+	f(pod)
+	return true
+}
@@ -0,0 +1,166 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	k8sApi "k8s.io/api/core/v1"
+)
+
+// staticKubelet is a Kubelet that returns whatever PodList it was last given
+type staticKubelet struct {
+	l       sync.Mutex
+	podList *k8sApi.PodList
+	err     error
+}
+
+func (k *staticKubelet) GetPodList(ctx context.Context) (*k8sApi.PodList, error) {
+	k.l.Lock()
+	defer k.l.Unlock()
+	if k.err != nil {
+		return nil, k.err
+	}
+	return k.podList.DeepCopy(), nil
+}
+
+// SetError has all fetches fail with err until it is set to nil again
+func (k *staticKubelet) SetError(err error) {
+	k.l.Lock()
+	defer k.l.Unlock()
+	k.err = err
+}
+
+func (k *staticKubelet) SetPods(pods ...k8sApi.Pod) {
+	k.l.Lock()
+	defer k.l.Unlock()
+	k.podList = &k8sApi.PodList{Items: pods}
+}
+
+func loadTestPod(t *testing.T, testDir string) k8sApi.Pod {
+	b, err := ioutil.ReadFile(path.Join(podTestDir, testDir, "input.json"))
+	if err != nil {
+		t.Fatalf("Unable to read input: %v", err)
+	}
+	var pod k8sApi.Pod
+	if err := json.Unmarshal(b, &pod); err != nil {
+		t.Fatalf("unable to unmarshal input to pod: %v", err)
+	}
+	return pod
+}
+
+func TestPodStoreSnapshot(t *testing.T) {
+	store := newPodStore()
+	p, err := NewPod(loadTestPod(t, "sidecar/working"), &DaemonConfig{})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	key := podCacheKey(p.Namespace, p.Name)
+	store.Apply(func(pods map[string]*Pod) {
+		pods[key] = p
+	})
+
+	snap, ok := store.Get(key)
+	if !ok {
+		t.Fatalf("pod missing from store")
+	}
+
+	// Mutations to the snapshot must not leak into the store
+	snap.SidecarState.Ready = false
+	snap.SyncStatuses.GetStatus("foo").SetError(nil)
+	snap.Pod.ObjectMeta.Annotations[ConsulServiceNames] = "changed"
+
+	current, _ := store.Get(key)
+	if !current.SidecarState.Ready {
+		t.Fatalf("snapshot mutation changed sidecar state")
+	}
+	if _, ok := current.SyncStatuses["foo"]; ok {
+		t.Fatalf("snapshot mutation changed sync statuses")
+	}
+	if current.Pod.ObjectMeta.Annotations[ConsulServiceNames] == "changed" {
+		t.Fatalf("snapshot mutation changed pod annotations")
+	}
+
+	// Mutations through the store must show up in later snapshots
+	if !store.Update(key, func(p *Pod) { p.SidecarState.Ready = false }) {
+		t.Fatalf("update didn't find pod")
+	}
+	if current, _ := store.Get(key); current.SidecarState.Ready {
+		t.Fatalf("update wasn't reflected in snapshot")
+	}
+	if store.Update("missing/pod", func(*Pod) {}) {
+		t.Fatalf("update found a missing pod")
+	}
+}
+
+// TestDaemonStateConcurrency hammers the sidecar (Register/Deregister) state
+// mutations concurrently with the kubelet sync loop; this is mostly useful
+// when run with -race.
+func TestDaemonStateConcurrency(t *testing.T) {
+	k8sPod := loadTestPod(t, "sidecar/working")
+	key := podCacheKey(k8sPod.Namespace, k8sPod.Name)
+
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(k8sPod)
+
+	d := NewDaemon(DaemonConfig{MaxSyncInterval: time.Second}, kubelet, nil, nil)
+	if _, err := d.fetchK8s(context.Background()); err != nil {
+		t.Fatalf("error fetching pods: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	stopCh := make(chan struct{})
+	loop := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				f(i)
+			}
+		}()
+	}
+
+	// sync loop; periodically dropping the pod from the kubelet response
+	loop(func(i int) {
+		if i%10 == 0 {
+			kubelet.SetPods()
+		} else {
+			kubelet.SetPods(k8sPod)
+		}
+		if _, err := d.fetchK8s(context.Background()); err != nil {
+			t.Errorf("error fetching pods: %v", err)
+		}
+		d.state.View(func(pods map[string]*Pod) {
+			for _, pod := range pods {
+				d.podSyncInterval(pod)
+			}
+		})
+	})
+	// Register/Deregister
+	for n := 0; n < 4; n++ {
+		ready := n%2 == 0
+		loop(func(int) {
+			d.setSidecarState(key, "katalog-sync-sidecar", ready)
+		})
+	}
+	// readers
+	loop(func(int) {
+		for _, pod := range d.state.Snapshot() {
+			pod.Ready()
+			pod.SyncStatuses.GetError()
+		}
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	close(stopCh)
+	wg.Wait()
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,7 +17,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 // ReadinessGate
@@ -23,26 +24,58 @@ const ReadinessGateType = "katalog-sync.wish.com/synced" // name of readiness ga
 
 var (
 	// Annotation names
-	ConsulServiceNames          = "katalog-sync.wish.com/service-names"     // comma-separated list of service names
-	ConsulServicePort           = "katalog-sync.wish.com/service-port"      // port to use for consul entry
-	ConsulServicePortOverride   = "katalog-sync.wish.com/service-port-"     // port override to use for a specific service name
-	ConsulServiceTags           = "katalog-sync.wish.com/service-tags"      // tags for the service
-	ConsulServiceTagsOverride   = "katalog-sync.wish.com/service-tags-"     // tags override to use for a specific service name
-	ConsulServiceMeta           = "katalog-sync.wish.com/service-meta"      // meta for the service
-	ConsulServiceMetaOverride   = "katalog-sync.wish.com/service-meta-"     // meta override to use for a specific service name
-	ConsulServiceHealth         = "katalog-sync.wish.com/service-health"    // health status for the service (passing/warning/critical)
-	ConsulServiceHealthOverride = "katalog-sync.wish.com/service-health-"   // health status override
-	SidecarName                 = "katalog-sync.wish.com/sidecar"           // Name of sidecar container, only to be set if it exists
-	SyncInterval                = "katalog-sync.wish.com/sync-interval"     // How frequently we want to sync this service
-	ConsulServiceCheckTTL       = "katalog-sync.wish.com/service-check-ttl" // TTL for the service checks we put in consul
-	ContainerExclusion          = "katalog-sync.wish.com/container-exclude" // comma-separated list of containers to exclude from ready check
+	ConsulServices               = "katalog-sync.wish.com/services"          // JSON or YAML list of service definitions, see ServiceSpec
+	ConsulServiceNames           = "katalog-sync.wish.com/service-names"     // comma-separated list of service names
+	ConsulServicePort            = "katalog-sync.wish.com/service-port"      // port to use for consul entry
+	ConsulServicePortOverride    = "katalog-sync.wish.com/service-port-"     // port override to use for a specific service name
+	ConsulServiceTags            = "katalog-sync.wish.com/service-tags"      // tags for the service
+	ConsulServiceTagsOverride    = "katalog-sync.wish.com/service-tags-"     // tags override to use for a specific service name
+	ConsulServiceMeta            = "katalog-sync.wish.com/service-meta"      // meta for the service
+	ConsulServiceMetaOverride    = "katalog-sync.wish.com/service-meta-"     // meta override to use for a specific service name
+	ConsulServiceHealth          = "katalog-sync.wish.com/service-health"    // health status for the service (passing/warning/critical)
+	ConsulServiceHealthOverride  = "katalog-sync.wish.com/service-health-"   // health status override
+	SidecarName                  = "katalog-sync.wish.com/sidecar"           // Name of sidecar container, only to be set if it exists
+	SyncInterval                 = "katalog-sync.wish.com/sync-interval"     // How frequently we want to sync this service
+	ConsulServiceCheckTTL        = "katalog-sync.wish.com/service-check-ttl" // TTL for the service checks we put in consul
+	ContainerExclusion           = "katalog-sync.wish.com/container-exclude" // comma-separated list of containers to exclude from ready check
+	ConsulServiceAddress         = "katalog-sync.wish.com/service-address"   // address source for the service (podIP/hostIP/ipv4/ipv6) or a literal address
+	ConsulServiceAddressOverride = "katalog-sync.wish.com/service-address-"  // address override to use for a specific service name
+	ConsulServiceWeight          = "katalog-sync.wish.com/service-weight"    // weight of the service in DNS/SRV answers while passing
+	ConsulServiceWeightOverride  = "katalog-sync.wish.com/service-weight-"   // weight override to use for a specific service name
+
+	ConsulServiceWeightWarning         = "katalog-sync.wish.com/service-weight-warning"  // weight of the service in DNS/SRV answers while warning
+	ConsulServiceWeightWarningOverride = "katalog-sync.wish.com/service-weight-warning-" // warning weight override to use for a specific service name
+
+	ConsulDeregisterCriticalServiceAfter = "katalog-sync.wish.com/deregister-critical-service-after" // how long the service may be critical before consul deregisters it
+
+	ConsulMaintenance         = "katalog-sync.wish.com/maintenance"  // puts the services into maintenance mode, value is the reason ("true" for none, "false" to disable)
+	ConsulMaintenanceOverride = "katalog-sync.wish.com/maintenance-" // maintenance override to use for a specific service name
+
+	// Consul connect annotation names
+	ConsulConnectNative            = "katalog-sync.wish.com/connect-native"          // whether the service natively supports connect (true/false)
+	ConsulConnectNativeOverride    = "katalog-sync.wish.com/connect-native-"         // connect native override for a specific service name
+	ConsulConnectProxyPort         = "katalog-sync.wish.com/connect-proxy-port"      // port of the connect sidecar proxy, registers a connect-proxy service if set
+	ConsulConnectProxyPortOverride = "katalog-sync.wish.com/connect-proxy-port-"     // connect proxy port override for a specific service name
+	ConsulConnectUpstreams         = "katalog-sync.wish.com/connect-upstreams"       // comma-separated list of service:port[:datacenter] upstreams of the proxy
+	ConsulConnectUpstreamsOverride = "katalog-sync.wish.com/connect-upstreams-"      // connect upstreams override for a specific service name
+	ConsulConnectProxyContainer    = "katalog-sync.wish.com/connect-proxy-container" // name of the container running the connect proxy
+
+	// Probe check annotation names
+	ConsulProbeChecks                = "katalog-sync.wish.com/probe-checks"          // comma-separated list of probes (readiness/liveness) to register as consul checks
+	ConsulProbeChecksOverride        = "katalog-sync.wish.com/probe-checks-"         // probe checks override for a specific service name
+	ConsulProbeCheckInterval         = "katalog-sync.wish.com/probe-check-interval"  // interval of the probe checks, defaults to the probe's period
+	ConsulProbeCheckIntervalOverride = "katalog-sync.wish.com/probe-check-interval-" // probe check interval override for a specific service name
+	ConsulProbeCheckTimeout          = "katalog-sync.wish.com/probe-check-timeout"   // timeout of the probe checks, defaults to the probe's timeout
+	ConsulProbeCheckTimeoutOverride  = "katalog-sync.wish.com/probe-check-timeout-"  // probe check timeout override for a specific service name
 )
 
 // NewPod returns a daemon pod based on a config and a k8s pod
 func NewPod(pod corev1.Pod, dc *DaemonConfig) (*Pod, error) {
+	a := dc.annotations().forPod(pod.ObjectMeta.Annotations)
+
 	var sidecarState *SidecarState
 	// If we have an annotation saying we have a sidecar, lets load it
-	if sidecarContainerName, ok := pod.ObjectMeta.Annotations[SidecarName]; ok {
+	if sidecarContainerName, ok := a.lookup(pod.ObjectMeta.Annotations, SidecarName); ok {
 		// we want to mark the initial state based on what the sidecar container state
 		// is, this way if the daemon gets reloaded we don't require a re-negotiation
 		sidecarReady := false
@@ -65,52 +98,139 @@ func NewPod(pod corev1.Pod, dc *DaemonConfig) (*Pod, error) {
 	}
 
 	// Check if we have a readiness gate defined
-	var ourReadinessGate corev1.PodReadinessGate
-	for _, gate := range pod.Spec.ReadinessGates {
-		if gate.ConditionType == ReadinessGateType {
-			ourReadinessGate = gate
-		}
+	_, hasReadinessGate := a.readinessGateType(&pod)
+
+	p := &Pod{
+		Pod:                      pod,
+		SidecarState:             sidecarState,
+		SyncStatuses:             make(map[string]*SyncStatus),
+		OutstandingReadinessGate: hasReadinessGate,
+
+		AddressSource:          dc.DefaultServiceAddress,
+		ClusterName:            dc.ClusterName,
+		ClusterNameInServiceID: dc.ClusterNameInServiceID && dc.ClusterName != "",
+		annotations:            a,
+	}
+	if err := p.configure(dc); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
 	}
 
+	p.warnMissingExclusions()
+
+	p.Ctx, p.Cancel = context.WithCancel(context.Background())
+	return p, nil
+}
+
+// configure sets the settings of the pod which are derived from its
+// annotations. They are only changed if the annotations are all valid.
+func (p *Pod) configure(dc *DaemonConfig) error {
+	a := p.annotations
+	annotations := p.Pod.ObjectMeta.Annotations
+
 	// Calculate SyncInterval
 	syncInterval := dc.DefaultSyncInterval
-	if interval, ok := pod.ObjectMeta.Annotations[SyncInterval]; ok {
+	if interval, ok := a.lookup(annotations, SyncInterval); ok {
 		duration, err := time.ParseDuration(interval)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		syncInterval = duration
 	}
 
 	// Calculate CheckTTL
 	checkTTL := dc.DefaultCheckTTL
-	if interval, ok := pod.ObjectMeta.Annotations[ConsulServiceCheckTTL]; ok {
+	if interval, ok := a.lookup(annotations, ConsulServiceCheckTTL); ok {
 		duration, err := time.ParseDuration(interval)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		checkTTL = duration
 	}
 
 	// Ensure that the checkTTL is at least SyncTTLBuffer greater than syncTTL
-	if minCheckTTL := syncInterval + dc.SyncTTLBuffer; checkTTL < minCheckTTL {
+	minCheckTTL := syncInterval + dc.SyncTTLBuffer
+	if checkTTL < minCheckTTL {
 		checkTTL = minCheckTTL
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// Services may define check TTLs of their own
+	services, maxCheckTTL, err := p.validateServiceSpecs(minCheckTTL)
+	if err != nil {
+		return err
+	}
+	if maxCheckTTL < checkTTL {
+		maxCheckTTL = checkTTL
+	}
 
-	return &Pod{
-		Pod:                      pod,
-		SidecarState:             sidecarState,
-		SyncStatuses:             make(map[string]*SyncStatus),
-		OutstandingReadinessGate: ourReadinessGate.ConditionType == ReadinessGateType,
+	// Calculate DeregisterCriticalServiceAfter
+	deregisterAfter := dc.DefaultDeregisterCriticalServiceAfter
+	if after, ok := a.lookup(annotations, ConsulDeregisterCriticalServiceAfter); ok {
+		duration, err := time.ParseDuration(after)
+		if err != nil {
+			return err
+		}
+		// The service must not be deregistered before we had a chance to update its check
+		if duration != 0 && duration <= maxCheckTTL {
+			return fmt.Errorf("%s (%s) must be greater than the check TTL (%s)", a.key(ConsulDeregisterCriticalServiceAfter), duration, maxCheckTTL)
+		}
+		deregisterAfter = duration
+	} else if deregisterAfter != 0 && deregisterAfter <= maxCheckTTL {
+		// The default may be below the check TTL of pods which raised theirs
+		deregisterAfter = maxCheckTTL + dc.SyncTTLBuffer
+	}
 
-		CheckTTL:     checkTTL,
-		SyncInterval: syncInterval,
-		Ctx:          ctx,
-		Cancel:       cancel,
-	}, nil
+	p.SyncInterval = syncInterval
+	p.CheckTTL = checkTTL
+	p.DeregisterCriticalServiceAfter = deregisterAfter
+	p.services = services
+	return nil
+}
 
+// validate checks the annotations of the pod which NewPod rejects pods for
+func (p *Pod) validate() error {
+	if err := p.validateConnect(); err != nil {
+		return err
+	}
+	if err := p.validateAddresses(); err != nil {
+		return err
+	}
+	if err := p.validateProbeChecks(); err != nil {
+		return err
+	}
+	if err := p.validateWeightAnnotations(); err != nil {
+		return err
+	}
+	for _, serviceName := range p.GetServiceNames() {
+		if _, err := p.GetWeights(serviceName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigError returns the first problem with the annotations of the pod,
+// including those which only keep single services from being synced. As
+// annotations can change after NewPod this checks them all again.
+func (p *Pod) ConfigError(dc *DaemonConfig) error {
+	// configure only changes the settings of the copy
+	if err := (&Pod{Pod: p.Pod, AddressSource: p.AddressSource, annotations: p.annotations}).configure(dc); err != nil {
+		return err
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+	for _, serviceName := range p.GetServiceNames() {
+		if _, err := p.GetPort(serviceName); err != nil {
+			return err
+		}
+		if _, err := p.serviceHealth(serviceName); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Pod is our representation of a pod in k8s
@@ -122,16 +242,71 @@ type Pod struct {
 	OutstandingReadinessGate bool // Do we have a ReadinessGate to set
 	InitialSyncDone          bool // Ready and in consul
 
-	CheckTTL     time.Duration
-	SyncInterval time.Duration
-	Ctx          context.Context
-	Cancel       context.CancelFunc
+	CheckTTL                       time.Duration
+	DeregisterCriticalServiceAfter time.Duration // 0 if consul shouldn't deregister critical services
+	SyncInterval                   time.Duration
+	AddressSource                  string // default source of service addresses, see GetServiceAddress
+	ClusterName                    string
+	ClusterNameInServiceID         bool
+	// services which keep their ID from before the cluster name was put into it
+	AdoptedServiceIDs map[string]struct{}
+	// maintenance requested through the API, service name ("" for all) -> state
+	MaintenanceOverrides map[string]MaintenanceState
+	Ctx                  context.Context
+	Cancel               context.CancelFunc
+
+	// where to look up our annotations, picked for the pod by forPod
+	annotations annotations
+	// services defined in the services annotation, see serviceSpecs
+	services []ServiceSpec
 
 	l sync.Mutex
 
 	waitCh []chan struct{}
 }
 
+// Snapshot returns a copy of the pod which shares no mutable state with p
+func (p *Pod) Snapshot() *Pod {
+	snap := &Pod{
+		Pod:                      *p.Pod.DeepCopy(),
+		SyncStatuses:             make(SyncStatuses, len(p.SyncStatuses)),
+		OutstandingReadinessGate: p.OutstandingReadinessGate,
+		InitialSyncDone:          p.InitialSyncDone,
+
+		CheckTTL:                       p.CheckTTL,
+		DeregisterCriticalServiceAfter: p.DeregisterCriticalServiceAfter,
+		SyncInterval:                   p.SyncInterval,
+		AddressSource:                  p.AddressSource,
+		ClusterName:                    p.ClusterName,
+		ClusterNameInServiceID:         p.ClusterNameInServiceID,
+		annotations:                    p.annotations,
+		services:                       p.services,
+		Ctx:                            p.Ctx,
+		Cancel:                         p.Cancel,
+	}
+	if p.SidecarState != nil {
+		sidecarState := *p.SidecarState
+		snap.SidecarState = &sidecarState
+	}
+	if p.AdoptedServiceIDs != nil {
+		snap.AdoptedServiceIDs = make(map[string]struct{}, len(p.AdoptedServiceIDs))
+		for serviceName := range p.AdoptedServiceIDs {
+			snap.AdoptedServiceIDs[serviceName] = struct{}{}
+		}
+	}
+	if p.MaintenanceOverrides != nil {
+		snap.MaintenanceOverrides = make(map[string]MaintenanceState, len(p.MaintenanceOverrides))
+		for serviceName, state := range p.MaintenanceOverrides {
+			snap.MaintenanceOverrides[serviceName] = state
+		}
+	}
+	for serviceName, status := range p.SyncStatuses {
+		s := *status
+		snap.SyncStatuses[serviceName] = &s
+	}
+	return snap
+}
+
 func (p *Pod) WaitChanges() chan struct{} {
 	ch := make(chan struct{}, 5)
 	p.l.Lock()
@@ -140,22 +315,88 @@ func (p *Pod) WaitChanges() chan struct{} {
 	return ch
 }
 
-// HasChange will return whether a change has been made that needs a full resync
-// if not then a simple TTL update will suffice
-func (p *Pod) HasChange(service *consulApi.AgentService) bool {
-	if service.Port != p.GetPort(service.Service) {
-		return true
+// Registration returns the agent service definition for the given service
+// with its check set to status/notes
+func (p *Pod) Registration(serviceName, status, notes string) *consulApi.AgentServiceRegistration {
+	// Define the base metadata that katalog-sync requires
+	meta := map[string]string{
+		"external-source":    "kubernetes",                                           // Define the source of this service; see https://github.com/hashicorp/consul/blob/fc1d9e5d78749edc55249e5e7c1a8f7a24add99d/website/source/docs/platform/k8s/service-sync.html.md#service-meta
+		ConsulSyncSourceName: ConsulSyncSourceValue,                                  // Mark this as katalog-sync so we know we generated this
+		ConsulK8sLinkName:    podCacheKey(p.ObjectMeta.Namespace, p.ObjectMeta.Name), // which includes full path to this (ns, pod name, etc.)
+		ConsulK8sNamespace:   p.ObjectMeta.Namespace,
+		ConsulK8sPod:         p.ObjectMeta.Name,
+	}
+	if p.ClusterName != "" {
+		meta[ConsulK8sCluster] = p.ClusterName
+	}
+	// Add in any metadata that the pod annotations define
+	for k, v := range p.GetServiceMeta(serviceName) {
+		if _, ok := meta[k]; !ok {
+			meta[k] = v
+		}
 	}
 
-	if service.Address != p.Status.PodIP {
-		return true
+	weights, err := p.GetWeights(serviceName)
+	if err != nil {
+		logrus.Errorf("Unable to parse weights for %s: %v", serviceName, err)
 	}
 
-	return false
+	// PlanSync doesn't register services whose port can't be resolved
+	port, err := p.GetPort(serviceName)
+	if err != nil {
+		logrus.Errorf("Unable to get port for %s: %v", serviceName, err)
+	}
+	checkTTL := p.GetCheckTTL(serviceName)
+	registration := &consulApi.AgentServiceRegistration{
+		ID:              p.GetServiceID(serviceName),
+		Name:            serviceName,
+		Port:            port,
+		Address:         p.GetServiceAddress(serviceName),
+		TaggedAddresses: p.GetTaggedAddresses(serviceName, port),
+		Meta:            meta,
+		Tags:            p.GetTags(serviceName),
+		Weights:         weights,
+
+		Check: &consulApi.AgentServiceCheck{
+			CheckID: p.GetServiceID(serviceName), // TODO: better name? -- the name cannot have `/` in it -- its used in the API query path
+			Name:    ttlCheckName(checkTTL, p.DeregisterCriticalServiceAfter),
+			TTL:     checkTTL.String(),
+			Status:  p.GetServiceHealth(serviceName, status), // Current status of check
+			Notes:   notes,                                   // Map of container->ready
+		},
+	}
+	if p.DeregisterCriticalServiceAfter > 0 {
+		registration.Check.DeregisterCriticalServiceAfter = p.DeregisterCriticalServiceAfter.String()
+	}
+	// Probe checks start out with the pod's readiness (which reflects the
+	// probes) instead of critical until consul first runs them
+	for _, check := range p.GetProbeChecks(serviceName) {
+		check.Status = status
+		registration.Checks = append(registration.Checks, check)
+	}
+	if p.GetConnectNative(serviceName) {
+		registration.Connect = &consulApi.AgentServiceConnect{Native: true}
+	}
+	return registration
 }
 
 // GetServiceID returns an identifier that addresses this pod.
 func (p *Pod) GetServiceID(serviceName string) string {
+	if _, ok := p.AdoptedServiceIDs[serviceName]; ok || !p.ClusterNameInServiceID {
+		return p.legacyServiceID(serviceName)
+	}
+	// ServiceID is katalog-sync_cluster_service_namespace_pod
+	return strings.Join([]string{
+		"katalog-sync",
+		p.ClusterName,
+		serviceName,
+		p.Pod.ObjectMeta.Namespace,
+		p.Pod.ObjectMeta.Name,
+	}, "_")
+}
+
+// legacyServiceID returns the identifier of the service without a cluster name
+func (p *Pod) legacyServiceID(serviceName string) string {
 	// ServiceID is katalog-sync_service_namespace_pod
 	return strings.Join([]string{
 		"katalog-sync",
@@ -165,11 +406,24 @@ func (p *Pod) GetServiceID(serviceName string) string {
 	}, "_")
 }
 
-// UpdatePod updates the k8s pod
-func (p *Pod) UpdatePod(k8sPod corev1.Pod) {
+// UpdatePod updates the k8s pod, returning whether anything we sync to consul
+// (annotations or status) changed. Settings derived from the annotations are
+// recalculated with dc, the previous ones are kept if the annotations became invalid.
+func (p *Pod) UpdatePod(k8sPod corev1.Pod, dc *DaemonConfig) bool {
 	p.l.Lock()
 	defer p.l.Unlock()
+	annotationsChanged := !reflect.DeepEqual(p.Pod.ObjectMeta.Annotations, k8sPod.ObjectMeta.Annotations)
+	changed := annotationsChanged ||
+		!reflect.DeepEqual(p.Pod.ObjectMeta.DeletionTimestamp, k8sPod.ObjectMeta.DeletionTimestamp) ||
+		!reflect.DeepEqual(p.Pod.Status, k8sPod.Status)
 	p.Pod = k8sPod
+	if annotationsChanged {
+		p.annotations = dc.annotations().forPod(k8sPod.ObjectMeta.Annotations)
+		if err := p.configure(dc); err != nil {
+			logrus.Errorf("Keeping previous settings of %s: %v", podCacheKey(k8sPod.Namespace, k8sPod.Name), err)
+		}
+		p.warnMissingExclusions()
+	}
 
 	// notify waiters
 	for i, ch := range p.waitCh {
@@ -182,11 +436,53 @@ func (p *Pod) UpdatePod(k8sPod corev1.Pod) {
 			p.waitCh = p.waitCh[:len(p.waitCh)-1]
 		}
 	}
+	return changed
 }
 
-// GetServiceNames returns the list of service names defined in the k8s annotations
+// GetServiceNames returns the list of service names defined in the k8s
+// annotations: those of the services annotation followed by the remaining ones
+// of the service-names annotation
 func (p *Pod) GetServiceNames() []string {
-	return strings.Split(p.Pod.ObjectMeta.Annotations[ConsulServiceNames], ",")
+	specs := p.serviceSpecs()
+	names := make([]string, 0, len(specs))
+	defined := make(map[string]struct{}, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+		defined[spec.Name] = struct{}{}
+	}
+	if namesStr, ok := p.annotation(ConsulServiceNames); ok {
+		for _, name := range strings.Split(namesStr, ",") {
+			// An empty name would never match a registered service, which
+			// would get the real ones deregistered
+			if _, ok := defined[name]; !ok && name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// GetServiceIDs returns the IDs of all services this pod defines, including
+// those of connect sidecar proxies
+func (p *Pod) GetServiceIDs() []string {
+	var ids []string
+	for _, serviceName := range p.GetServiceNames() {
+		ids = append(ids, p.GetServiceID(serviceName))
+		if p.HasConnectProxy(serviceName) {
+			ids = append(ids, p.GetConnectProxyServiceID(serviceName))
+		}
+	}
+	return ids
+}
+
+// HasServiceID returns whether a given ID is one of the services this pod defines
+func (p *Pod) HasServiceID(id string) bool {
+	for _, serviceID := range p.GetServiceIDs() {
+		if serviceID == id {
+			return true
+		}
+	}
+	return false
 }
 
 // HasServiceName returns whether a given name is one of the annotated service names for this pod
@@ -202,24 +498,41 @@ func (p *Pod) HasServiceName(n string) bool {
 // GetTags returns the tags for a given service for this pod
 // This first checks the service-specific tags, and falls back to the service-level tags
 func (p *Pod) GetTags(n string) []string {
-	if tagStr, ok := p.Pod.ObjectMeta.Annotations[ConsulServiceTagsOverride+n]; ok {
+	if spec := p.serviceSpec(n); spec != nil && spec.Tags != nil {
+		return spec.Tags
+	}
+
+	if tagStr, ok := p.annotation(ConsulServiceTagsOverride + n); ok {
 		return strings.Split(tagStr, ",")
 	}
 
-	if tagStr, ok := p.Pod.ObjectMeta.Annotations[ConsulServiceTags]; ok {
+	if tagStr, ok := p.annotation(ConsulServiceTags); ok {
 		return strings.Split(tagStr, ",")
 	}
 
 	return nil
 }
 
+// serviceAnnotation returns the value of the service-specific annotation
+// (override+n) for the given service, falling back to the pod-level annotation
+func (p *Pod) serviceAnnotation(annotation, override, n string) (string, bool) {
+	if v, ok := p.annotation(override + n); ok {
+		return v, true
+	}
+	return p.annotation(annotation)
+}
+
 // GetServiceMeta returns a map of metadata to be added to the ServiceMetadata
 func (p *Pod) GetServiceMeta(n string) map[string]string {
-	if metaStr, ok := p.Pod.ObjectMeta.Annotations[ConsulServiceMetaOverride+n]; ok {
+	if spec := p.serviceSpec(n); spec != nil && spec.Meta != nil {
+		return spec.Meta
+	}
+
+	if metaStr, ok := p.annotation(ConsulServiceMetaOverride + n); ok {
 		return ParseMap(metaStr)
 	}
 
-	if metaStr, ok := p.Pod.ObjectMeta.Annotations[ConsulServiceMeta]; ok {
+	if metaStr, ok := p.annotation(ConsulServiceMeta); ok {
 		return ParseMap(metaStr)
 	}
 
@@ -228,49 +541,165 @@ func (p *Pod) GetServiceMeta(n string) map[string]string {
 
 // GetServiceHealth returns the service health specified in annotation, or defaultVal if not specified.
 func (p *Pod) GetServiceHealth(n string, defaultVal string) string {
-	healthStr := p.Pod.ObjectMeta.Annotations[ConsulServiceHealthOverride+n]
+	healthStr, err := p.serviceHealth(n)
+	if err != nil {
+		logrus.Errorf("%v ignored", err)
+	}
+	if healthStr == "" {
+		return defaultVal
+	}
+	return healthStr
+}
+
+// serviceHealth returns the health status the annotations fix for the given
+// service, "" if they don't
+func (p *Pod) serviceHealth(n string) (string, error) {
+	var healthStr string
+	if spec := p.serviceSpec(n); spec != nil {
+		healthStr = spec.Health
+	}
+	if healthStr == "" {
+		healthStr, _ = p.annotation(ConsulServiceHealthOverride + n)
+	}
 	if healthStr == "" {
-		healthStr = p.Pod.ObjectMeta.Annotations[ConsulServiceHealth]
+		healthStr, _ = p.annotation(ConsulServiceHealth)
 	}
 	switch healthStr {
-	case consulApi.HealthCritical, consulApi.HealthPassing, consulApi.HealthWarning:
-		return healthStr
-	case "": // annotation not set
+	case consulApi.HealthCritical, consulApi.HealthPassing, consulApi.HealthWarning, "":
+		return healthStr, nil
 	default:
-		logrus.Errorf("Unknown service health status '%v' ignored", healthStr)
+		return "", fmt.Errorf("Unknown service health status '%v' of %s", healthStr, n)
 	}
-	return defaultVal
 }
 
 // GetPort returns the port for a given service for this pod
 // This first checks the service-specific port, and falls back to the service-level port
-func (p *Pod) GetPort(n string) int {
-	if portStr, ok := p.Pod.ObjectMeta.Annotations[ConsulServicePortOverride+n]; ok {
-		port, err := strconv.Atoi(portStr)
-		if err == nil {
-			return port
+func (p *Pod) GetPort(n string) (int, error) {
+	if spec := p.serviceSpec(n); spec != nil {
+		if spec.Port != 0 {
+			return spec.Port, nil
+		}
+		if spec.PortName != "" {
+			return p.namedPort(spec.PortName)
 		}
-		logrus.Errorf("Unable to parse port from annotation %s: %v", portStr, err)
 	}
 
-	// First we look for a port in an annotation
-	if portStr, ok := p.Pod.ObjectMeta.Annotations[ConsulServicePort]; ok {
-		port, err := strconv.Atoi(portStr)
-		if err == nil {
-			return port
+	if portStr, ok := p.serviceAnnotation(ConsulServicePort, ConsulServicePortOverride, n); ok {
+		port, err := p.resolvePort(portStr)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to resolve port of %s: %v", n, err)
 		}
-		logrus.Errorf("Unable to parse port from annotation %s: %v", portStr, err)
+		return port, nil
 	}
 
 	// If no port was defined, we find the first port we can in the spec and use that
 	for _, container := range p.Pod.Spec.Containers {
 		for _, port := range container.Ports {
-			return int(port.ContainerPort)
+			return int(port.ContainerPort), nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unable to resolve port of %s: no %s annotation and no container ports", n, p.annotations.key(ConsulServicePort))
+}
+
+// resolvePort returns the port a service-port annotation refers to: either a
+// port number or the name of a container port, optionally qualified by the
+// container as container/portname
+func (p *Pod) resolvePort(portStr string) (int, error) {
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return p.namedPort(portStr)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %d: must be between 1 and 65535", port)
+	}
+	return port, nil
+}
+
+// namedPort returns the number of the container port with the given name,
+// which may be qualified by the container as container/portname. Unqualified
+// names must be unique across the containers of the pod.
+func (p *Pod) namedPort(name string) (int, error) {
+	containerName := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		containerName, name = name[:i], name[i+1:]
+	}
+
+	port, found := 0, ""
+	for _, container := range p.Pod.Spec.Containers {
+		if containerName != "" && container.Name != containerName {
+			continue
+		}
+		for _, containerPort := range container.Ports {
+			if containerPort.Name != name {
+				continue
+			}
+			if found != "" {
+				return 0, fmt.Errorf("port name %q is defined by containers %s and %s, qualify it as container/%s", name, found, container.Name, name)
+			}
+			port, found = int(containerPort.ContainerPort), container.Name
+		}
+	}
+	if found == "" {
+		if containerName != "" {
+			return 0, fmt.Errorf("no port named %q in container %q", name, containerName)
+		}
+		return 0, fmt.Errorf("no container port named %q", name)
+	}
+	return port, nil
+}
+
+// validateWeightAnnotations checks that the service-specific weight annotations
+// of the pod can only be read one way. The passing weight override of a service
+// named "warning-X" is also the warning weight override of service X (and of a
+// service named "warning" the pod's warning weight).
+func (p *Pod) validateWeightAnnotations() error {
+	for _, serviceName := range p.GetServiceNames() {
+		if serviceName != "warning" && !strings.HasPrefix(serviceName, "warning-") {
+			continue
+		}
+		if _, ok := p.annotation(ConsulServiceWeightOverride + serviceName); ok {
+			return fmt.Errorf("Annotation %s is ambiguous: it is also a warning weight; set the weights of service %s in %s instead", p.annotations.key(ConsulServiceWeightOverride+serviceName), serviceName, p.annotations.key(ConsulServices))
 		}
 	}
+	return nil
+}
+
+// GetWeights returns the weights for a given service for this pod, nil if
+// neither weight annotation is set (consul then defaults both to 1)
+func (p *Pod) GetWeights(n string) (*consulApi.AgentWeights, error) {
+	if spec := p.serviceSpec(n); spec != nil && spec.Weights != nil {
+		return spec.Weights.weights(), nil
+	}
+
+	passingStr, passingOK := p.serviceAnnotation(ConsulServiceWeight, ConsulServiceWeightOverride, n)
+	warningStr, warningOK := p.serviceAnnotation(ConsulServiceWeightWarning, ConsulServiceWeightWarningOverride, n)
+	if !passingOK && !warningOK {
+		return nil, nil
+	}
 
-	// TODO: error?
-	return -1
+	weights := &consulApi.AgentWeights{Passing: 1, Warning: 1}
+	if passingOK {
+		passing, err := strconv.Atoi(passingStr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse weight from annotation %s: %v", passingStr, err)
+		}
+		if passing < 1 {
+			return nil, fmt.Errorf("Invalid weight %d: must be at least 1", passing)
+		}
+		weights.Passing = passing
+	}
+	if warningOK {
+		warning, err := strconv.Atoi(warningStr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse warning weight from annotation %s: %v", warningStr, err)
+		}
+		if warning < 0 {
+			return nil, fmt.Errorf("Invalid warning weight %d: must not be negative", warning)
+		}
+		weights.Warning = warning
+	}
+	return weights, nil
 }
 
 // Ready checks the readiness of the containers in the pod
@@ -295,7 +724,6 @@ func (p *Pod) Ready() (bool, map[string]bool) {
 	excludeContainers := p.ContainerExclusion()
 	for _, containerStatus := range p.Pod.Status.ContainerStatuses {
 		if _, ok := excludeContainers[containerStatus.Name]; ok {
-			delete(excludeContainers, containerStatus.Name)
 			continue
 		}
 		// If we have a sidecar defined, we skip the container for it -- as the request showed up
@@ -304,18 +732,19 @@ func (p *Pod) Ready() (bool, map[string]bool) {
 				continue
 			}
 		}
+		// The connect proxy has a check of its own
+		if containerStatus.Name == p.ConnectProxyContainer() {
+			continue
+		}
 		podReady = podReady && containerStatus.Ready
 		containerReadiness[containerStatus.Name] = containerStatus.Ready
 	}
-	if len(excludeContainers) > 0 {
-		logrus.Warnf("Some exclude containers for %s not found in pod: %v", p.ObjectMeta.SelfLink, excludeContainers)
-	}
 	return podReady, containerReadiness
 }
 
 // ContainerExclusion returns the containers that should be excluded from a readiness check
 func (p *Pod) ContainerExclusion() map[string]struct{} {
-	str, ok := p.Pod.ObjectMeta.Annotations[ContainerExclusion]
+	str, ok := p.annotation(ContainerExclusion)
 	if !ok {
 		return nil
 	}
@@ -329,18 +758,37 @@ func (p *Pod) ContainerExclusion() map[string]struct{} {
 	return m
 }
 
-func (p *Pod) HandleReadinessGate() error {
+// warnMissingExclusions logs the excluded containers which the pod doesn't have
+func (p *Pod) warnMissingExclusions() {
+	excludeContainers := p.ContainerExclusion()
+	for _, container := range p.Pod.Spec.Containers {
+		delete(excludeContainers, container.Name)
+	}
+	if len(excludeContainers) > 0 {
+		logrus.Warnf("Some exclude containers for %s not found in pod: %v", podCacheKey(p.ObjectMeta.Namespace, p.ObjectMeta.Name), excludeContainers)
+	}
+}
+
+// HandleReadinessGate sets the readiness gate condition of the pod through
+// clientset, if it has a readiness gate which isn't done yet
+func (p *Pod) HandleReadinessGate(clientset kubernetes.Interface) error {
 	p.l.Lock()
 	defer p.l.Unlock()
 	logrus.Debugf("HandleReadinessGate: %v", p.GetServiceNames())
-	// Fast path for things without a readiness gate or with a completed readiness gate
+	maintenance := p.InMaintenance()
+	// Fast path for things without a readiness gate or with a completed
+	// readiness gate, unless the pod was put into maintenance since
 	if !p.OutstandingReadinessGate {
-		return nil
+		if len(maintenance) == 0 || !p.hasReadinessGate() {
+			return nil
+		}
+		p.OutstandingReadinessGate = true
 	}
 
+	gateType, _ := p.annotations.readinessGateType(&p.Pod)
 	var ourCondition corev1.PodCondition
 	for _, condition := range p.Pod.Status.Conditions {
-		if condition.Type == ReadinessGateType {
+		if condition.Type == corev1.PodConditionType(gateType) {
 			ourCondition = condition
 		}
 	}
@@ -348,26 +796,35 @@ func (p *Pod) HandleReadinessGate() error {
 	logrus.Tracef("condition: %v", ourCondition)
 
 	// If the pod is already marked ready; we are done
-	if ourCondition.Status == corev1.ConditionTrue {
+	if ourCondition.Status == corev1.ConditionTrue && len(maintenance) == 0 {
 		p.OutstandingReadinessGate = false
 		return nil
 	}
 
 	// We didn't find it, set it!
-	if ourCondition.Type != ReadinessGateType {
-		ourCondition.Type = ReadinessGateType
+	if ourCondition.Type != corev1.PodConditionType(gateType) {
+		ourCondition.Type = corev1.PodConditionType(gateType)
 	}
 
 	ready, reasonMap := p.Ready()
-	if ready {
+	if len(maintenance) > 0 {
+		ourCondition.Status = corev1.ConditionFalse
+		ourCondition.Reason = "Maintenance"
+		notesB, err := json.MarshalIndent(maintenance, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		ourCondition.Message = string(notesB)
+	} else if ready {
 		// Assuming the pod is ready; we need to check sync status
 		var notSyncedServices []string
 		for serviceName, status := range p.SyncStatuses {
 			if status.LastError != nil {
-				notSyncedServices = append(notSyncedServices, serviceName)
+				notSyncedServices = append(notSyncedServices, fmt.Sprintf("%s (%v)", serviceName, status.LastError))
 			}
 		}
 		if len(notSyncedServices) != 0 {
+			sort.Strings(notSyncedServices)
 			ourCondition.Status = corev1.ConditionFalse
 			ourCondition.Reason = "Not all services synced to consul"
 			ourCondition.Message = fmt.Sprintf("The following services haven't been synced to consul yet: %s", notSyncedServices)
@@ -400,16 +857,9 @@ func (p *Pod) HandleReadinessGate() error {
 		return err
 	}
 
-	// TODO: pass in
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return err
+	if clientset == nil {
+		return fmt.Errorf("no apiserver client to set the readiness gate with")
 	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return err
-	}
-
 	podsClient := clientset.CoreV1().Pods(p.Pod.ObjectMeta.Namespace)
 
 	_, err = podsClient.Patch(context.TODO(), p.Pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
@@ -420,6 +870,12 @@ func (p *Pod) HandleReadinessGate() error {
 	return nil
 }
 
+// hasReadinessGate returns whether the pod has our readiness gate
+func (p *Pod) hasReadinessGate() bool {
+	_, ok := p.annotations.readinessGateType(&p.Pod)
+	return ok
+}
+
 // State from our sidecar service
 type SidecarState struct {
 	SidecarName string // name of the sidecar container
@@ -439,6 +895,15 @@ func (s SyncStatuses) GetStatus(n string) *SyncStatus {
 	return status
 }
 
+// Lookup returns the SyncStatus for the given serviceName without creating
+// it, the zero SyncStatus if there is none yet
+func (s SyncStatuses) Lookup(n string) SyncStatus {
+	if status, ok := s[n]; ok {
+		return *status
+	}
+	return SyncStatus{}
+}
+
 // GetError returns the first error found in the set of SyncStatuses
 func (s SyncStatuses) GetError() error {
 	for _, status := range s {
@@ -8,7 +8,9 @@ import (
 	"path"
 	"path/filepath"
 	"testing"
+	"time"
 
+	consulApi "github.com/hashicorp/consul/api"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	k8sApi "k8s.io/api/core/v1"
 )
@@ -24,6 +26,11 @@ type podTestResult struct {
 	Ready                    map[string]map[string]bool   `json:"ready"`
 	ServiceMeta              map[string]map[string]string `json:"service_meta"`
 	OutstandingReadinessGate bool                         `json:"outstandingReadinessGate,omitempty"`
+
+	ConnectNative  map[string]bool                                `json:"connect_native,omitempty"`
+	ConnectProxies map[string]*consulApi.AgentServiceRegistration `json:"connect_proxies,omitempty"`
+
+	Weights map[string]*consulApi.AgentWeights `json:"weights,omitempty"`
 }
 
 func TestPod(t *testing.T) {
@@ -39,12 +46,23 @@ func TestPod(t *testing.T) {
 		}
 		// TODO: subtest stuff
 		t.Run(file.Name(), func(t *testing.T) {
-			runPodIntegrationTest(t, file.Name())
+			runPodIntegrationTest(t, file.Name(), "", false)
+		})
+		// The same pods annotated under another prefix, or still under the
+		// default one in legacy mode, must give the same results
+		t.Run(file.Name()+"/prefix", func(t *testing.T) {
+			runPodIntegrationTest(t, file.Name(), "katalog-sync.example.com/", false)
+		})
+		t.Run(file.Name()+"/legacy", func(t *testing.T) {
+			runPodIntegrationTest(t, file.Name(), "", true)
 		})
 	}
 }
 
-func runPodIntegrationTest(t *testing.T, testDir string) {
+// runPodIntegrationTest compares the results for the pods of testDir to their
+// baselines. With a prefix the annotations of the pods are moved to it, in
+// legacy mode the daemon uses another prefix than the pods.
+func runPodIntegrationTest(t *testing.T, testDir, prefix string, legacy bool) {
 	filepath.Walk(path.Join(podTestDir, testDir), func(fpath string, info os.FileInfo, err error) error {
 		// If its not a directory, skip it
 		if !info.IsDir() {
@@ -60,6 +78,9 @@ func runPodIntegrationTest(t *testing.T, testDir string) {
 			t.Fatalf("Unable to read input: %v", err)
 		}
 
+		if prefix != "" {
+			b = bytes.ReplaceAll(b, []byte(DefaultAnnotationPrefix), []byte(prefix))
+		}
 		if err := json.Unmarshal(b, &k8sPod); err != nil {
 			t.Fatalf("unable to unmarshal input to pod: %v", err)
 		}
@@ -76,9 +97,18 @@ func runPodIntegrationTest(t *testing.T, testDir string) {
 				Ports:       make(map[string]int),
 				Ready:       make(map[string]map[string]bool),
 				ServiceMeta: make(map[string]map[string]string),
+
+				ConnectNative:  make(map[string]bool),
+				ConnectProxies: make(map[string]*consulApi.AgentServiceRegistration),
+
+				Weights: make(map[string]*consulApi.AgentWeights),
 			}
 
-			pod, err := NewPod(k8sPod, &DaemonConfig{})
+			dc := &DaemonConfig{AnnotationPrefix: prefix}
+			if legacy {
+				dc = &DaemonConfig{AnnotationPrefix: "katalog-sync.example.com/", LegacyAnnotations: true}
+			}
+			pod, err := NewPod(k8sPod, dc)
 			result.Err = err != nil
 			if err == nil {
 				result.ServiceNames = pod.GetServiceNames()
@@ -86,15 +116,24 @@ func runPodIntegrationTest(t *testing.T, testDir string) {
 				for _, name := range result.ServiceNames {
 					result.ServiceIDs[name] = pod.GetServiceID(name)
 					result.Tags[name] = pod.GetTags(name)
-					result.Ports[name] = pod.GetPort(name)
+					result.Ports[name], _ = pod.GetPort(name)
 					_, result.Ready[name] = pod.Ready()
 					result.ServiceMeta[name] = pod.GetServiceMeta(name)
+					if pod.GetConnectNative(name) {
+						result.ConnectNative[name] = true
+					}
+					if pod.HasConnectProxy(name) {
+						result.ConnectProxies[name] = pod.ConnectProxyRegistration(name, consulApi.HealthPassing, "")
+					}
+					if weights, _ := pod.GetWeights(name); weights != nil {
+						result.Weights[name] = weights
+					}
 				}
 			}
 
 			// handle
 			if pod != nil {
-				pod.HandleReadinessGate()
+				pod.HandleReadinessGate(nil)
 				result.OutstandingReadinessGate = pod.OutstandingReadinessGate
 			}
 
@@ -102,7 +141,9 @@ func runPodIntegrationTest(t *testing.T, testDir string) {
 			if err != nil {
 				panic(err)
 			}
-			ioutil.WriteFile(path.Join(fpath, "result.json"), b, 0644)
+			if prefix == "" && !legacy {
+				ioutil.WriteFile(path.Join(fpath, "result.json"), b, 0644)
+			}
 
 			baselineResultBytes, err := ioutil.ReadFile(path.Join(fpath, "baseline.json"))
 			if err != nil {
@@ -120,3 +161,118 @@ func runPodIntegrationTest(t *testing.T, testDir string) {
 		return nil
 	})
 }
+
+func TestGetPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		port        int
+		err         string
+	}{
+		{
+			name: "first container port",
+			port: 8080,
+		},
+		{
+			name:        "number",
+			annotations: map[string]string{ConsulServicePort: "9090"},
+			port:        9090,
+		},
+		{
+			name:        "name",
+			annotations: map[string]string{ConsulServicePort: "metrics"},
+			port:        9102,
+		},
+		{
+			name:        "service-specific name",
+			annotations: map[string]string{ConsulServicePort: "9090", ConsulServicePortOverride + "hw-service-name": "hw/grpc"},
+			port:        5000,
+		},
+		{
+			name:        "qualified name",
+			annotations: map[string]string{ConsulServicePort: "proxy/http"},
+			port:        15000,
+		},
+		{
+			name:        "ambiguous name",
+			annotations: map[string]string{ConsulServicePort: "http"},
+			err:         `Unable to resolve port of hw-service-name: port name "http" is defined by containers hw and proxy, qualify it as container/http`,
+		},
+		{
+			name:        "unknown name",
+			annotations: map[string]string{ConsulServicePort: "admin"},
+			err:         `Unable to resolve port of hw-service-name: no container port named "admin"`,
+		},
+		{
+			name:        "unknown container",
+			annotations: map[string]string{ConsulServicePort: "web/http"},
+			err:         `Unable to resolve port of hw-service-name: no port named "http" in container "web"`,
+		},
+		{
+			name:        "invalid number",
+			annotations: map[string]string{ConsulServicePort: "0"},
+			err:         "Unable to resolve port of hw-service-name: invalid port 0: must be between 1 and 65535",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k8sPod := loadTestPod(t, "basic/working")
+			delete(k8sPod.ObjectMeta.Annotations, ConsulServicePort)
+			for k, v := range test.annotations {
+				k8sPod.ObjectMeta.Annotations[k] = v
+			}
+			k8sPod.Spec.Containers[0].Ports = []k8sApi.ContainerPort{
+				{Name: "http", ContainerPort: 8080},
+				{Name: "grpc", ContainerPort: 5000},
+				{Name: "metrics", ContainerPort: 9102},
+			}
+			k8sPod.Spec.Containers = append(k8sPod.Spec.Containers, k8sApi.Container{
+				Name:  "proxy",
+				Ports: []k8sApi.ContainerPort{{Name: "http", ContainerPort: 15000}},
+			})
+
+			pod, err := NewPod(k8sPod, &DaemonConfig{})
+			if err != nil {
+				t.Fatalf("error creating pod: %v", err)
+			}
+			port, err := pod.GetPort("hw-service-name")
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %d, %v", test.err, port, err)
+				}
+				return
+			}
+			if err != nil || port != test.port {
+				t.Fatalf("expected port %d, got %d, %v", test.port, port, err)
+			}
+		})
+	}
+}
+
+func TestUpdatePod(t *testing.T) {
+	dc := &DaemonConfig{DefaultCheckTTL: 10 * time.Second, DefaultDeregisterCriticalServiceAfter: time.Minute}
+	pod, err := NewPod(loadTestPod(t, "basic/working"), dc)
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+
+	// Changed annotations change the settings derived from them
+	k8sPod := *pod.Pod.DeepCopy()
+	k8sPod.ObjectMeta.Annotations[ConsulServiceCheckTTL] = "1m"
+	k8sPod.ObjectMeta.Annotations[ConsulDeregisterCriticalServiceAfter] = "5m"
+	if !pod.UpdatePod(k8sPod, dc) {
+		t.Fatalf("expected pod to be changed")
+	}
+	if pod.CheckTTL != time.Minute || pod.DeregisterCriticalServiceAfter != 5*time.Minute {
+		t.Fatalf("expected check TTL 1m and deregister after 5m, got %s and %s", pod.CheckTTL, pod.DeregisterCriticalServiceAfter)
+	}
+
+	// Invalid ones keep the previous settings
+	k8sPod = *pod.Pod.DeepCopy()
+	k8sPod.ObjectMeta.Annotations[ConsulServiceCheckTTL] = "10m"
+	pod.UpdatePod(k8sPod, dc)
+	if pod.CheckTTL != time.Minute || pod.DeregisterCriticalServiceAfter != 5*time.Minute {
+		t.Fatalf("expected check TTL 1m and deregister after 5m, got %s and %s", pod.CheckTTL, pod.DeregisterCriticalServiceAfter)
+	}
+}
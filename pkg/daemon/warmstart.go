@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"strings"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// warmStartResult counts the services of a pod by how they are registered in
+// the agent
+type warmStartResult struct {
+	Adopted int // registered as the pod defines them
+	Changed int // registered, but with a different definition
+	Missing int // not registered
+
+	RestoredMaintenance int // services put into maintenance through the API of a previous daemon
+}
+
+// adoptRegistrations takes over the services a previous daemon registered in
+// the agent for the pod. Services which are registered the way the pod defines
+// them, with their check in the status we would set, get a SyncStatus as if
+// we had updated the check, so they don't get a TTL update right away. The
+// agent doesn't report when the check was last updated, only that it didn't
+// expire (which would have made it critical), so the next update is due after
+// a quarter of the TTL rather than half of it. If all services are registered
+// the pod was synced before, so we don't need to wait for the services to reach
+// the catalog again.
+func (p *Pod) adoptRegistrations(agentServices map[string]*consulApi.AgentService, agentChecks map[string]*consulApi.AgentCheck, now time.Time) warmStartResult {
+	p.adoptLegacyServiceIDs(agentServices)
+
+	status := consulApi.HealthCritical
+	if ready, _ := p.Ready(); ready {
+		status = consulApi.HealthPassing
+	}
+
+	var result warmStartResult
+	adopt := func(serviceName, serviceID, status string, expected *consulApi.AgentServiceRegistration) {
+		service, ok := agentServices[serviceID]
+		if !ok || !isSyncedService(service) {
+			result.Missing++
+			return
+		}
+		check := agentChecks[serviceID]
+		if len(registrationDiff(expected, service)) > 0 || len(checkDiff(expected.Check, check)) > 0 {
+			result.Changed++
+			return
+		}
+		result.Adopted++
+		if check.Status == status {
+			p.SyncStatuses.GetStatus(serviceName).LastUpdated = now.Add(-p.GetCheckTTL(serviceName) / 4)
+		}
+	}
+
+	for _, serviceName := range p.GetServiceNames() {
+		adopt(serviceName, p.GetServiceID(serviceName), p.GetServiceHealth(serviceName, status), p.Registration(serviceName, consulApi.HealthPassing, ""))
+		if p.HasConnectProxy(serviceName) {
+			proxyStatus := status
+			if proxyReady, _ := p.ConnectProxyReady(); !proxyReady {
+				proxyStatus = consulApi.HealthCritical
+			}
+			adopt(p.GetConnectProxyServiceName(serviceName), p.GetConnectProxyServiceID(serviceName), p.GetServiceHealth(serviceName, proxyStatus), p.ConnectProxyRegistration(serviceName, consulApi.HealthPassing, ""))
+		}
+	}
+
+	if result.Adopted > 0 && result.Changed == 0 && result.Missing == 0 {
+		p.InitialSyncDone = true
+	}
+	return result
+}
+
+// restoreMaintenance recreates the maintenance a previous daemon was asked for
+// through its API, which only lives in memory: our maintenance modes in the
+// agent which the annotations don't request. Otherwise the first sync would
+// take the services out of maintenance.
+func (p *Pod) restoreMaintenance(agentChecks map[string]*consulApi.AgentCheck) int {
+	restored := 0
+	for _, serviceName := range p.GetServiceNames() {
+		check, ok := agentChecks[consulServiceMaintenancePrefix+p.GetServiceID(serviceName)]
+		if !ok || !strings.HasPrefix(check.Notes, maintenanceReasonPrefix) {
+			continue
+		}
+		if reason, enabled := p.GetMaintenance(serviceName); enabled && reason == check.Notes {
+			continue
+		}
+		p.SetMaintenance(serviceName, MaintenanceState{Enabled: true, Reason: strings.TrimPrefix(check.Notes, maintenanceReasonPrefix)})
+		restored++
+	}
+	return restored
+}
+
+// warmStart adopts the services a previous daemon registered in the agent for
+// the pods we know of, so a restart of the daemon doesn't re-register them
+func (d *Daemon) warmStart() error {
+	services, err := d.consulAgent.Services()
+	if err != nil {
+		return err
+	}
+	checks, err := d.consulAgent.Checks()
+	if err != nil {
+		return err
+	}
+	// Services of other clusters aren't ours to adopt
+	for serviceID, service := range services {
+		if !d.ownsService(service) {
+			delete(services, serviceID)
+		}
+	}
+
+	var total warmStartResult
+	now := time.Now()
+	for key := range d.state.Keys() {
+		d.state.Update(key, func(p *Pod) {
+			result := p.adoptRegistrations(services, checks, now)
+			total.Adopted += result.Adopted
+			total.Changed += result.Changed
+			total.Missing += result.Missing
+			total.RestoredMaintenance += p.restoreMaintenance(checks)
+		})
+	}
+	logrus.Infof("Warm start: adopted %d services registered in the agent, %d changed and %d missing; restored maintenance of %d", total.Adopted, total.Changed, total.Missing, total.RestoredMaintenance)
+	return nil
+}
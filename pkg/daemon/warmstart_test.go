@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/wish/katalog-sync/pkg/daemon/consultest"
+	katalogsync "github.com/wish/katalog-sync/proto"
+)
+
+func TestDaemonWarmStart(t *testing.T) {
+	const (
+		basicKey        = "hw/hw-7df6995f69-96wth"
+		sidecarKey      = "hw/hw-6f596c7944-5q5t7"
+		basicServiceID2 = "katalog-sync_servicename2_hw_hw-7df6995f69-96wth"
+	)
+
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	consul := consultest.New(testNodeName)
+
+	// A previous daemon registered the services and went away
+	previous := NewDaemon(testDaemonConfig(), kubelet, consul.Agent(), consul.Catalog())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := previous.Start(ctx); err != nil {
+		t.Fatalf("error starting daemon: %v", err)
+	}
+	if err := previous.Stop(ctx); err != nil {
+		t.Fatalf("error stopping daemon: %v", err)
+	}
+
+	// One of the checks expired while no daemon was running
+	if err := consul.Agent().UpdateTTL(basicServiceID2, "TTL expired", consulApi.HealthCritical); err != nil {
+		t.Fatalf("error updating check: %v", err)
+	}
+
+	// On restart a new pod showed up, which is the only one to register; of
+	// the adopted services only the expired check is updated right away
+	kubelet.SetPods(loadTestPod(t, "basic/working"), loadTestPod(t, "sidecar/working"))
+	d := NewDaemon(testDaemonConfig(), kubelet, consul.Agent(), consul.Catalog())
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("error starting daemon: %v", err)
+	}
+	t.Cleanup(func() { d.Stop(ctx) })
+
+	counts := make(map[SyncActionType][]string)
+	for _, action := range d.LastPlan().Actions {
+		counts[action.Type] = append(counts[action.Type], action.ServiceID)
+	}
+	expected := map[SyncActionType][]string{
+		SyncActionUpdateTTL: {basicServiceID2},
+		SyncActionRegister:  {sidecarServiceID, "katalog-sync_servicename2_hw_hw-6f596c7944-5q5t7"},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Mismatch expected=%v actual=%v", expected, counts)
+	}
+	if s := checkStatus(consul, basicServiceID); s != consulApi.HealthPassing {
+		t.Fatalf("expected check to stay passing, is %q", s)
+	}
+	if s := checkStatus(consul, basicServiceID2); s != consulApi.HealthPassing {
+		t.Fatalf("expected expired check to be passing again, is %q", s)
+	}
+
+	if pod, _ := d.state.Get(basicKey); !pod.InitialSyncDone {
+		t.Fatalf("expected adopted pod to be synced already")
+	}
+	if pod, _ := d.state.Get(sidecarKey); pod.InitialSyncDone {
+		t.Fatalf("expected new pod not to be synced yet")
+	}
+}
+
+func TestDaemonWarmStartMaintenance(t *testing.T) {
+	kubelet := &staticKubelet{}
+	kubelet.SetPods(loadTestPod(t, "basic/working"))
+	consul := consultest.New(testNodeName)
+
+	// A previous daemon was asked to put a service into maintenance
+	previous := NewDaemon(testDaemonConfig(), kubelet, consul.Agent(), consul.Catalog())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := previous.Start(ctx); err != nil {
+		t.Fatalf("error starting daemon: %v", err)
+	}
+	query := &katalogsync.SetMaintenanceQuery{Namespace: "hw", PodName: "hw-7df6995f69-96wth", ServiceName: "hw-service-name", Enable: true, Reason: "heap dump"}
+	if _, err := previous.SetMaintenance(ctx, query); err != nil {
+		t.Fatalf("error enabling maintenance: %v", err)
+	}
+	if err := previous.Stop(ctx); err != nil {
+		t.Fatalf("error stopping daemon: %v", err)
+	}
+
+	// The service stays in maintenance after a restart
+	d := startTestDaemon(t, testDaemonConfig(), kubelet, consul)
+	if check := consul.AgentChecks()[consulServiceMaintenancePrefix+basicServiceID]; check == nil || check.Notes != "katalog-sync: heap dump" {
+		t.Fatalf("expected service to stay in maintenance, got %+v", check)
+	}
+	for _, action := range d.LastPlan().Actions {
+		if action.Type == SyncActionDisableMaintenance || action.Type == SyncActionEnableMaintenance {
+			t.Fatalf("unexpected maintenance action %s", action)
+		}
+	}
+
+	// and can be taken out of it through the API
+	query.Enable = false
+	if _, err := d.SetMaintenance(ctx, query); err != nil {
+		t.Fatalf("error disabling maintenance: %v", err)
+	}
+	if check := consul.AgentChecks()[consulServiceMaintenancePrefix+basicServiceID]; check != nil {
+		t.Fatalf("expected service out of maintenance, got %+v", check)
+	}
+}
@@ -12,6 +12,8 @@
 		RegisterResult
 		DeregisterQuery
 		DeregisterResult
+		SetMaintenanceQuery
+		SetMaintenanceResult
 */
 package katalogsync
 
@@ -120,11 +122,69 @@ func (m *DeregisterResult) String() string            { return proto.CompactText
 func (*DeregisterResult) ProtoMessage()               {}
 func (*DeregisterResult) Descriptor() ([]byte, []int) { return fileDescriptorKatalogSync, []int{3} }
 
+type SetMaintenanceQuery struct {
+	Namespace   string `protobuf:"bytes,1,opt,name=Namespace,proto3" json:"Namespace,omitempty"`
+	PodName     string `protobuf:"bytes,2,opt,name=PodName,proto3" json:"PodName,omitempty"`
+	ServiceName string `protobuf:"bytes,3,opt,name=ServiceName,proto3" json:"ServiceName,omitempty"`
+	Enable      bool   `protobuf:"varint,4,opt,name=Enable,proto3" json:"Enable,omitempty"`
+	Reason      string `protobuf:"bytes,5,opt,name=Reason,proto3" json:"Reason,omitempty"`
+}
+
+func (m *SetMaintenanceQuery) Reset()                    { *m = SetMaintenanceQuery{} }
+func (m *SetMaintenanceQuery) String() string            { return proto.CompactTextString(m) }
+func (*SetMaintenanceQuery) ProtoMessage()               {}
+func (*SetMaintenanceQuery) Descriptor() ([]byte, []int) { return fileDescriptorKatalogSync, []int{4} }
+
+func (m *SetMaintenanceQuery) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *SetMaintenanceQuery) GetPodName() string {
+	if m != nil {
+		return m.PodName
+	}
+	return ""
+}
+
+func (m *SetMaintenanceQuery) GetServiceName() string {
+	if m != nil {
+		return m.ServiceName
+	}
+	return ""
+}
+
+func (m *SetMaintenanceQuery) GetEnable() bool {
+	if m != nil {
+		return m.Enable
+	}
+	return false
+}
+
+func (m *SetMaintenanceQuery) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+type SetMaintenanceResult struct {
+}
+
+func (m *SetMaintenanceResult) Reset()                    { *m = SetMaintenanceResult{} }
+func (m *SetMaintenanceResult) String() string            { return proto.CompactTextString(m) }
+func (*SetMaintenanceResult) ProtoMessage()               {}
+func (*SetMaintenanceResult) Descriptor() ([]byte, []int) { return fileDescriptorKatalogSync, []int{5} }
+
 func init() {
 	proto.RegisterType((*RegisterQuery)(nil), "katalogsync.RegisterQuery")
 	proto.RegisterType((*RegisterResult)(nil), "katalogsync.RegisterResult")
 	proto.RegisterType((*DeregisterQuery)(nil), "katalogsync.DeregisterQuery")
 	proto.RegisterType((*DeregisterResult)(nil), "katalogsync.DeregisterResult")
+	proto.RegisterType((*SetMaintenanceQuery)(nil), "katalogsync.SetMaintenanceQuery")
+	proto.RegisterType((*SetMaintenanceResult)(nil), "katalogsync.SetMaintenanceResult")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -140,6 +200,7 @@ const _ = grpc.SupportPackageIsVersion4
 type KatalogSyncClient interface {
 	Register(ctx context.Context, in *RegisterQuery, opts ...grpc.CallOption) (*RegisterResult, error)
 	Deregister(ctx context.Context, in *DeregisterQuery, opts ...grpc.CallOption) (*DeregisterResult, error)
+	SetMaintenance(ctx context.Context, in *SetMaintenanceQuery, opts ...grpc.CallOption) (*SetMaintenanceResult, error)
 }
 
 type katalogSyncClient struct {
@@ -168,11 +229,21 @@ func (c *katalogSyncClient) Deregister(ctx context.Context, in *DeregisterQuery,
 	return out, nil
 }
 
+func (c *katalogSyncClient) SetMaintenance(ctx context.Context, in *SetMaintenanceQuery, opts ...grpc.CallOption) (*SetMaintenanceResult, error) {
+	out := new(SetMaintenanceResult)
+	err := grpc.Invoke(ctx, "/katalogsync.KatalogSync/SetMaintenance", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for KatalogSync service
 
 type KatalogSyncServer interface {
 	Register(context.Context, *RegisterQuery) (*RegisterResult, error)
 	Deregister(context.Context, *DeregisterQuery) (*DeregisterResult, error)
+	SetMaintenance(context.Context, *SetMaintenanceQuery) (*SetMaintenanceResult, error)
 }
 
 func RegisterKatalogSyncServer(s *grpc.Server, srv KatalogSyncServer) {
@@ -215,6 +286,24 @@ func _KatalogSync_Deregister_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _KatalogSync_SetMaintenance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetMaintenanceQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KatalogSyncServer).SetMaintenance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/katalogsync.KatalogSync/SetMaintenance",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KatalogSyncServer).SetMaintenance(ctx, req.(*SetMaintenanceQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _KatalogSync_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "katalogsync.KatalogSync",
 	HandlerType: (*KatalogSyncServer)(nil),
@@ -227,6 +316,10 @@ var _KatalogSync_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Deregister",
 			Handler:    _KatalogSync_Deregister_Handler,
 		},
+		{
+			MethodName: "SetMaintenance",
+			Handler:    _KatalogSync_SetMaintenance_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "katalog-sync.proto",
@@ -340,6 +433,76 @@ func (m *DeregisterResult) MarshalTo(dAtA []byte) (int, error) {
 	return i, nil
 }
 
+func (m *SetMaintenanceQuery) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *SetMaintenanceQuery) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Namespace) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintKatalogSync(dAtA, i, uint64(len(m.Namespace)))
+		i += copy(dAtA[i:], m.Namespace)
+	}
+	if len(m.PodName) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintKatalogSync(dAtA, i, uint64(len(m.PodName)))
+		i += copy(dAtA[i:], m.PodName)
+	}
+	if len(m.ServiceName) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintKatalogSync(dAtA, i, uint64(len(m.ServiceName)))
+		i += copy(dAtA[i:], m.ServiceName)
+	}
+	if m.Enable {
+		dAtA[i] = 0x20
+		i++
+		if m.Enable {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if len(m.Reason) > 0 {
+		dAtA[i] = 0x2a
+		i++
+		i = encodeVarintKatalogSync(dAtA, i, uint64(len(m.Reason)))
+		i += copy(dAtA[i:], m.Reason)
+	}
+	return i, nil
+}
+
+func (m *SetMaintenanceResult) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *SetMaintenanceResult) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	return i, nil
+}
+
 func encodeFixed64KatalogSync(dAtA []byte, offset int, v uint64) int {
 	dAtA[offset] = uint8(v)
 	dAtA[offset+1] = uint8(v >> 8)
@@ -415,6 +578,37 @@ func (m *DeregisterResult) Size() (n int) {
 	return n
 }
 
+func (m *SetMaintenanceQuery) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Namespace)
+	if l > 0 {
+		n += 1 + l + sovKatalogSync(uint64(l))
+	}
+	l = len(m.PodName)
+	if l > 0 {
+		n += 1 + l + sovKatalogSync(uint64(l))
+	}
+	l = len(m.ServiceName)
+	if l > 0 {
+		n += 1 + l + sovKatalogSync(uint64(l))
+	}
+	if m.Enable {
+		n += 2
+	}
+	l = len(m.Reason)
+	if l > 0 {
+		n += 1 + l + sovKatalogSync(uint64(l))
+	}
+	return n
+}
+
+func (m *SetMaintenanceResult) Size() (n int) {
+	var l int
+	_ = l
+	return n
+}
+
 func sovKatalogSync(x uint64) (n int) {
 	for {
 		n++
@@ -802,6 +996,242 @@ func (m *DeregisterResult) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *SetMaintenanceQuery) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowKatalogSync
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SetMaintenanceQuery: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SetMaintenanceQuery: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Namespace", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowKatalogSync
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthKatalogSync
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Namespace = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PodName", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowKatalogSync
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthKatalogSync
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PodName = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServiceName", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowKatalogSync
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthKatalogSync
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServiceName = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Enable", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowKatalogSync
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Enable = bool(v != 0)
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Reason", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowKatalogSync
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthKatalogSync
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Reason = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipKatalogSync(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthKatalogSync
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *SetMaintenanceResult) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowKatalogSync
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SetMaintenanceResult: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SetMaintenanceResult: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		default:
+			iNdEx = preIndex
+			skippy, err := skipKatalogSync(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthKatalogSync
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipKatalogSync(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -910,20 +1340,25 @@ var (
 func init() { proto.RegisterFile("katalog-sync.proto", fileDescriptorKatalogSync) }
 
 var fileDescriptorKatalogSync = []byte{
-	// 229 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0xca, 0x4e, 0x2c, 0x49,
-	0xcc, 0xc9, 0x4f, 0xd7, 0x2d, 0xae, 0xcc, 0x4b, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2,
-	0x86, 0x8a, 0x81, 0x84, 0x94, 0x72, 0xb9, 0x78, 0x83, 0x52, 0xd3, 0x33, 0x8b, 0x4b, 0x52, 0x8b,
-	0x02, 0x4b, 0x53, 0x8b, 0x2a, 0x85, 0x64, 0xb8, 0x38, 0xfd, 0x12, 0x73, 0x53, 0x8b, 0x0b, 0x12,
-	0x93, 0x53, 0x25, 0x18, 0x15, 0x18, 0x35, 0x38, 0x83, 0x10, 0x02, 0x42, 0x12, 0x5c, 0xec, 0x01,
-	0xf9, 0x29, 0x20, 0xbe, 0x04, 0x13, 0x58, 0x0e, 0xc6, 0x15, 0x52, 0xe1, 0xe2, 0x75, 0xce, 0xcf,
-	0x2b, 0x49, 0xcc, 0xcc, 0x4b, 0x2d, 0x02, 0xcb, 0x33, 0x83, 0xe5, 0x51, 0x05, 0x95, 0x04, 0xb8,
-	0xf8, 0x60, 0xd6, 0x05, 0xa5, 0x16, 0x97, 0xe6, 0x94, 0x28, 0xe5, 0x73, 0xf1, 0xbb, 0xa4, 0x16,
-	0xd1, 0xd1, 0x09, 0x42, 0x5c, 0x02, 0x08, 0x0b, 0x21, 0x8e, 0x30, 0x9a, 0xcb, 0xc8, 0xc5, 0xed,
-	0x0d, 0x09, 0x95, 0xe0, 0xca, 0xbc, 0x64, 0x21, 0x67, 0x2e, 0x0e, 0x98, 0x33, 0x85, 0xa4, 0xf4,
-	0x90, 0xc2, 0x4b, 0x0f, 0x25, 0xb0, 0xa4, 0xa4, 0xb1, 0xca, 0x41, 0x0c, 0x15, 0xf2, 0xe4, 0xe2,
-	0x42, 0x58, 0x24, 0x24, 0x83, 0xa2, 0x14, 0xcd, 0xcb, 0x52, 0xb2, 0x38, 0x64, 0x21, 0x46, 0x39,
-	0x09, 0x9c, 0x78, 0x24, 0xc7, 0x78, 0xe1, 0x91, 0x1c, 0xe3, 0x83, 0x47, 0x72, 0x8c, 0x13, 0x1e,
-	0xcb, 0x31, 0x24, 0xb1, 0x81, 0xe3, 0xd2, 0x18, 0x10, 0x00, 0x00, 0xff, 0xff, 0xa8, 0xe2, 0x98,
-	0x1c, 0xe1, 0x01, 0x00, 0x00,
+	// 320 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xbc, 0x92, 0x4f, 0x4a, 0xc3, 0x40,
+	0x14, 0xc6, 0x1d, 0xff, 0xd4, 0xf6, 0x95, 0xd6, 0xf2, 0x94, 0x12, 0x62, 0x0d, 0x31, 0xb8, 0xe8,
+	0xc6, 0x2e, 0xf4, 0x06, 0x56, 0x17, 0x22, 0x8a, 0xa6, 0x78, 0x80, 0x69, 0x7c, 0x94, 0x60, 0x3b,
+	0x53, 0x26, 0x53, 0xa1, 0xb7, 0xf0, 0x06, 0x5e, 0xc7, 0xa5, 0x47, 0x90, 0x78, 0x05, 0x0f, 0x20,
+	0xf9, 0x47, 0x32, 0x52, 0xdd, 0x08, 0x2e, 0xbf, 0xef, 0x9b, 0x79, 0xf3, 0xe3, 0x7d, 0x03, 0xf8,
+	0xc8, 0x35, 0x9f, 0xca, 0xc9, 0x71, 0xb4, 0x14, 0xc1, 0x60, 0xae, 0xa4, 0x96, 0xd8, 0xcc, 0xbd,
+	0xc4, 0xf2, 0x66, 0xd0, 0xf2, 0x69, 0x12, 0x46, 0x9a, 0xd4, 0xdd, 0x82, 0xd4, 0x12, 0x7b, 0xd0,
+	0xb8, 0xe1, 0x33, 0x8a, 0xe6, 0x3c, 0x20, 0x8b, 0xb9, 0xac, 0xdf, 0xf0, 0x4b, 0x03, 0x2d, 0xd8,
+	0xbe, 0x95, 0x0f, 0x89, 0xb6, 0xd6, 0xd3, 0xac, 0x90, 0x78, 0x04, 0xad, 0xa1, 0x14, 0x9a, 0x87,
+	0x82, 0x54, 0x9a, 0x6f, 0xa4, 0xb9, 0x69, 0x7a, 0x1d, 0x68, 0x17, 0xcf, 0xf9, 0x14, 0x2d, 0xa6,
+	0xda, 0x93, 0xb0, 0x73, 0x4e, 0xea, 0x1f, 0x11, 0x10, 0x3a, 0xe5, 0x83, 0x39, 0xc4, 0x0b, 0x83,
+	0xdd, 0x11, 0xe9, 0x6b, 0x1e, 0x0a, 0x4d, 0x82, 0x8b, 0x80, 0xfe, 0x46, 0xe2, 0x42, 0x73, 0x44,
+	0xea, 0x29, 0x0c, 0xa8, 0xc2, 0x51, 0xb5, 0xb0, 0x0b, 0xb5, 0x0b, 0xc1, 0xc7, 0x53, 0xb2, 0x36,
+	0x5d, 0xd6, 0xaf, 0xfb, 0xb9, 0x4a, 0x7c, 0x9f, 0x78, 0x24, 0x85, 0xb5, 0x95, 0x5e, 0xca, 0x95,
+	0xd7, 0x85, 0x3d, 0x13, 0x30, 0x23, 0x3f, 0xf9, 0x64, 0xd0, 0xbc, 0xca, 0xfa, 0x1c, 0x2d, 0x45,
+	0x80, 0x43, 0xa8, 0x17, 0x0b, 0x46, 0x7b, 0x50, 0x69, 0x7a, 0x60, 0xd4, 0x6c, 0xef, 0xaf, 0xcc,
+	0xb2, 0xa1, 0x78, 0x09, 0x50, 0xae, 0x08, 0x7b, 0xc6, 0xd1, 0x6f, 0x65, 0xd9, 0x07, 0x3f, 0xa4,
+	0xf9, 0xa8, 0x7b, 0x68, 0x9b, 0xdc, 0xe8, 0x1a, 0x17, 0x56, 0x6c, 0xdd, 0x3e, 0xfc, 0xe5, 0x44,
+	0x36, 0xf6, 0xac, 0xf3, 0x1a, 0x3b, 0xec, 0x2d, 0x76, 0xd8, 0x7b, 0xec, 0xb0, 0xe7, 0x0f, 0x67,
+	0x6d, 0x5c, 0x4b, 0x3f, 0xf7, 0xe9, 0xd7, 0x00, 0x6a, 0xd2, 0xba, 0xad, 0xf2, 0x02, 0x00, 0x00,
 }